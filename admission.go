@@ -0,0 +1,223 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	"github.com/open-policy-agent/opa/rego"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	ActionDeny = "deny"
+	ActionWarn = "warn"
+)
+
+// AdmissionRule configures an admission policy. Exactly one of CEL or Rego
+// needs to be set.
+//
+// CEL expressions have access to `object` and `event` and must evaluate to
+// true for the object to pass. Otherwise Message is reported with Action.
+//
+// Rego modules must be in package `webhook` and are evaluated with `object`
+// and `event` as input. Each message in the `deny` and `warn` sets is
+// reported with the respective action.
+type AdmissionRule struct {
+	Name    string `json:"name"`
+	Action  string `json:"action,omitempty"`
+	Message string `json:"message,omitempty"`
+	CEL     string `json:"cel,omitempty"`
+	Rego    string `json:"rego,omitempty"`
+}
+
+// Finding is reported by an AdmissionPolicy for an object.
+type Finding struct {
+	Policy  string `json:"policy"`
+	Object  string `json:"object"`
+	Action  string `json:"action"`
+	Message string `json:"message"`
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s: %s: %s (%s)", f.Action, f.Object, f.Message, f.Policy)
+}
+
+// AdmissionPolicy evaluates an object together with the event it's applied
+// for.
+type AdmissionPolicy interface {
+	Evaluate(ctx context.Context, event *Event, obj *unstructured.Unstructured) ([]Finding, error)
+}
+
+// NewAdmissionPolicy compiles rule.
+func NewAdmissionPolicy(rule *AdmissionRule) (AdmissionPolicy, error) {
+	action := rule.Action
+	if action == "" {
+		action = ActionDeny
+	}
+	if action != ActionDeny && action != ActionWarn {
+		return nil, fmt.Errorf("Admission rule %s has invalid action %q", rule.Name, rule.Action)
+	}
+	switch {
+	case rule.CEL != "" && rule.Rego != "":
+		return nil, fmt.Errorf("Admission rule %s can't have both cel and rego", rule.Name)
+	case rule.CEL != "":
+		return newCELPolicy(rule.Name, action, rule.Message, rule.CEL)
+	case rule.Rego != "":
+		return newRegoPolicy(rule.Name, rule.Rego)
+	}
+	return nil, fmt.Errorf("Admission rule %s needs either cel or rego", rule.Name)
+}
+
+// NewAdmissionPolicies compiles all rules.
+func NewAdmissionPolicies(rules []*AdmissionRule) ([]AdmissionPolicy, error) {
+	policies := make([]AdmissionPolicy, len(rules))
+	for i, rule := range rules {
+		policy, err := NewAdmissionPolicy(rule)
+		if err != nil {
+			return nil, err
+		}
+		policies[i] = policy
+	}
+	return policies, nil
+}
+
+// Admit evaluates all policies for each object in obj.
+func Admit(ctx context.Context, policies []AdmissionPolicy, event *Event, obj runtime.Object) ([]Finding, error) {
+	findings := []Finding{}
+	err := eachObject(obj, func(o *unstructured.Unstructured) error {
+		for _, policy := range policies {
+			f, err := policy.Evaluate(ctx, event, o)
+			if err != nil {
+				return err
+			}
+			findings = append(findings, f...)
+		}
+		return nil
+	})
+	return findings, err
+}
+
+// Denied returns true if any of the findings denies admission.
+func Denied(findings []Finding) bool {
+	for _, f := range findings {
+		if f.Action == ActionDeny {
+			return true
+		}
+	}
+	return false
+}
+
+// admissionInput returns the variables policies are evaluated with. The
+// object is round-tripped through JSON to get plain JSON types.
+func admissionInput(event *Event, obj *unstructured.Unstructured) (map[string]interface{}, error) {
+	content, err := json.Marshal(obj.Object)
+	if err != nil {
+		return nil, err
+	}
+	object := map[string]interface{}{}
+	if err := json.Unmarshal(content, &object); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"object": object,
+		"event":  event.Data(),
+	}, nil
+}
+
+type celPolicy struct {
+	name    string
+	action  string
+	message string
+	program cel.Program
+}
+
+func newCELPolicy(name, action, message, expression string) (*celPolicy, error) {
+	env, err := cel.NewEnv(cel.Declarations(
+		decls.NewIdent("object", decls.NewMapType(decls.String, decls.Dyn), nil),
+		decls.NewIdent("event", decls.NewMapType(decls.String, decls.Dyn), nil),
+	))
+	if err != nil {
+		return nil, err
+	}
+	ast, iss := env.Compile(expression)
+	if iss != nil && iss.Err() != nil {
+		return nil, fmt.Errorf("Couldn't compile admission rule %s: %s", name, iss.Err())
+	}
+	if !proto.Equal(ast.ResultType(), decls.Bool) && !proto.Equal(ast.ResultType(), decls.Dyn) {
+		return nil, fmt.Errorf("Admission rule %s must evaluate to bool", name)
+	}
+	program, err := env.Program(ast)
+	if err != nil {
+		return nil, err
+	}
+	if message == "" {
+		message = "Failed " + expression
+	}
+	return &celPolicy{name: name, action: action, message: message, program: program}, nil
+}
+
+func (p *celPolicy) Evaluate(ctx context.Context, event *Event, obj *unstructured.Unstructured) ([]Finding, error) {
+	input, err := admissionInput(event, obj)
+	if err != nil {
+		return nil, err
+	}
+	out, _, err := p.program.Eval(input)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't evaluate admission rule %s for %s: %s", p.name, objectID(obj), err)
+	}
+	ok, isBool := out.Value().(bool)
+	if !isBool {
+		return nil, fmt.Errorf("Admission rule %s didn't evaluate to bool for %s but %v", p.name, objectID(obj), out.Value())
+	}
+	if ok {
+		return nil, nil
+	}
+	return []Finding{{Policy: p.name, Object: objectID(obj), Action: p.action, Message: p.message}}, nil
+}
+
+type regoPolicy struct {
+	name  string
+	query rego.PreparedEvalQuery
+}
+
+func newRegoPolicy(name, module string) (*regoPolicy, error) {
+	query, err := rego.New(
+		rego.Query("data.webhook"),
+		rego.Module(name+".rego", module),
+	).PrepareForEval(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't compile admission rule %s: %s", name, err)
+	}
+	return &regoPolicy{name: name, query: query}, nil
+}
+
+func (p *regoPolicy) Evaluate(ctx context.Context, event *Event, obj *unstructured.Unstructured) ([]Finding, error) {
+	input, err := admissionInput(event, obj)
+	if err != nil {
+		return nil, err
+	}
+	rs, err := p.query.Eval(ctx, rego.EvalInput(input))
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't evaluate admission rule %s for %s: %s", p.name, objectID(obj), err)
+	}
+	findings := []Finding{}
+	if len(rs) == 0 || len(rs[0].Expressions) == 0 {
+		return findings, nil
+	}
+	result, ok := rs[0].Expressions[0].Value.(map[string]interface{})
+	if !ok {
+		return findings, nil
+	}
+	for _, action := range []string{ActionDeny, ActionWarn} {
+		messages, _ := result[action].([]interface{})
+		for _, msg := range messages {
+			findings = append(findings, Finding{Policy: p.name, Object: objectID(obj), Action: action, Message: fmt.Sprint(msg)})
+		}
+	}
+	return findings, nil
+}
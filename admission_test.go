@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-github/v24/github"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const regoModule = `package webhook
+
+deny[msg] {
+	input.object.kind == "Pod"
+	input.object.spec.containers[_].securityContext.privileged
+	msg := "Pods must not be privileged"
+}
+
+warn[msg] {
+	not input.object.spec.activeDeadlineSeconds
+	msg := "Workflows should set activeDeadlineSeconds"
+}
+`
+
+func TestAdmit(t *testing.T) {
+	policies, err := NewAdmissionPolicies([]*AdmissionRule{
+		{
+			Name:    "prod-deployer",
+			CEL:     `!has(object.spec.serviceAccountName) || object.spec.serviceAccountName != "prod-deployer" || event.ref == "refs/heads/main"`,
+			Message: "Only main may use prod-deployer",
+		},
+		{Name: "rego", Rego: regoModule},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		main    = &Event{Ref: "refs/heads/main", Repository: &github.Repository{FullName: p("foo/bar")}}
+		feature = &Event{Ref: "refs/heads/feature", Repository: &github.Repository{FullName: p("foo/bar")}}
+
+		prodWorkflow  = &unstructured.Unstructured{Object: map[string]interface{}{"kind": "Workflow", "metadata": map[string]interface{}{"name": "foo"}, "spec": map[string]interface{}{"serviceAccountName": "prod-deployer", "activeDeadlineSeconds": int64(60)}}}
+		privilegedPod = &unstructured.Unstructured{Object: map[string]interface{}{"kind": "Pod", "metadata": map[string]interface{}{"name": "foo"}, "spec": map[string]interface{}{"activeDeadlineSeconds": int64(60), "containers": []interface{}{map[string]interface{}{"securityContext": map[string]interface{}{"privileged": true}}}}}}
+	)
+
+	for _, test := range []struct {
+		event    *Event
+		obj      *unstructured.Unstructured
+		findings []Finding
+	}{
+		{main, prodWorkflow, []Finding{}},
+		{feature, prodWorkflow, []Finding{{Policy: "prod-deployer", Object: "Workflow/foo", Action: ActionDeny, Message: "Only main may use prod-deployer"}}},
+		{main, workflow(), []Finding{{Policy: "rego", Object: "Workflow/hello-world-*", Action: ActionWarn, Message: "Workflows should set activeDeadlineSeconds"}}},
+		{main, privilegedPod, []Finding{{Policy: "rego", Object: "Pod/foo", Action: ActionDeny, Message: "Pods must not be privileged"}}},
+	} {
+		findings, err := Admit(context.Background(), policies, test.event, test.obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(test.findings, findings); diff != "" {
+			t.Fatalf("Not Equal (-want +got):\n%s", diff)
+		}
+	}
+}
+
+func TestNewAdmissionPolicy(t *testing.T) {
+	for _, test := range []struct {
+		rule        *AdmissionRule
+		expectError bool
+	}{
+		{&AdmissionRule{Name: "cel", CEL: `object.kind == "Workflow"`}, false},
+		{&AdmissionRule{Name: "warn", Action: ActionWarn, CEL: `true`}, false},
+		{&AdmissionRule{Name: "rego", Rego: regoModule}, false},
+		{&AdmissionRule{Name: "none"}, true},
+		{&AdmissionRule{Name: "both", CEL: "true", Rego: regoModule}, true},
+		{&AdmissionRule{Name: "action", Action: "block", CEL: "true"}, true},
+		{&AdmissionRule{Name: "not bool", CEL: `"foo"`}, true},
+		{&AdmissionRule{Name: "syntax", CEL: `object.kind ==`}, true},
+		{&AdmissionRule{Name: "rego syntax", Rego: "package webhook\ndeny[msg] {"}, true},
+	} {
+		_, err := NewAdmissionPolicy(test.rule)
+		if test.expectError && err == nil {
+			t.Fatalf("Expected error but got nil: %v", test.rule)
+		}
+		if !test.expectError && err != nil {
+			t.Fatalf("Failed with %s for %v", err, test.rule)
+		}
+	}
+}
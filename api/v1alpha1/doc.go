@@ -0,0 +1,6 @@
+// Package v1alpha1 contains the WebhookRun API recording the deliveries
+// handled by k8s-webhook-handler.
+//
+// +k8s:deepcopy-gen=package
+// +groupName=k8s-webhook-handler.io
+package v1alpha1
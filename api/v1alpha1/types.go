@@ -0,0 +1,87 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// RunPhase is the result of handling a delivery.
+type RunPhase string
+
+const (
+	// RunSucceeded means the delivery was handled without errors. This
+	// includes deliveries which were skipped, e.g. for ignored refs.
+	RunSucceeded RunPhase = "Succeeded"
+	// RunRejected means the delivery or its manifest wasn't allowed.
+	RunRejected RunPhase = "Rejected"
+	// RunFailed means the delivery couldn't be handled.
+	RunFailed RunPhase = "Failed"
+)
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// WebhookRun records how a webhook delivery was handled.
+type WebhookRun struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   WebhookRunSpec   `json:"spec"`
+	Status WebhookRunStatus `json:"status,omitempty"`
+}
+
+// WebhookRunSpec describes the delivery.
+type WebhookRunSpec struct {
+	// DeliveryID is GitHub's unique ID of the delivery.
+	DeliveryID string `json:"deliveryID,omitempty"`
+	EventType  string `json:"eventType"`
+	Action     string `json:"action,omitempty"`
+	Repo       string `json:"repo"`
+	Ref        string `json:"ref,omitempty"`
+	Revision   string `json:"revision,omitempty"`
+	// Rule is the name of the config file rule matching the repository.
+	Rule string `json:"rule,omitempty"`
+	// Namespace is the target namespace of the manifest.
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// WebhookRunStatus is the outcome of handling the delivery.
+type WebhookRunStatus struct {
+	Phase RunPhase `json:"phase,omitempty"`
+	// Message is the response sent to GitHub.
+	Message string `json:"message,omitempty"`
+	// Objects are all objects which were applied or attempted to.
+	Objects []ObjectStatus `json:"objects,omitempty"`
+	Errors  []string       `json:"errors,omitempty"`
+
+	StartTime      *metav1.Time `json:"startTime,omitempty"`
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+	// Stages lists the time spent in each stage of handling the delivery.
+	Stages []StageTiming `json:"stages,omitempty"`
+}
+
+// ObjectStatus is the outcome of applying an object.
+type ObjectStatus struct {
+	APIVersion string    `json:"apiVersion"`
+	Kind       string    `json:"kind"`
+	Namespace  string    `json:"namespace,omitempty"`
+	Name       string    `json:"name"`
+	UID        types.UID `json:"uid,omitempty"`
+	Outcome    string    `json:"outcome"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// StageTiming is the time spent in a stage.
+type StageTiming struct {
+	Name     string          `json:"name"`
+	Duration metav1.Duration `json:"duration"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// WebhookRunList is a list of WebhookRuns.
+type WebhookRunList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []WebhookRun `json:"items"`
+}
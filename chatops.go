@@ -0,0 +1,187 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/google/go-github/v24/github"
+)
+
+// commandRegex matches valid command names.
+var commandRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Reactions acknowledging commands.
+const (
+	reactionAccepted = "+1"
+	reactionDenied   = "-1"
+)
+
+// CommandRule maps a slash command in pull request comments to a manifest.
+type CommandRule struct {
+	// Command is the name of the command without slash, e.g. deploy for
+	// /deploy staging.
+	Command string `json:"command"`
+	// ResourcePath, if set, is loaded instead of the global resource path.
+	ResourcePath string `json:"resourcePath,omitempty"`
+}
+
+// Validate returns an error if the command name is invalid.
+func (r *CommandRule) Validate() error {
+	if !commandRegex.MatchString(r.Command) {
+		return fmt.Errorf("Invalid command %q", r.Command)
+	}
+	return nil
+}
+
+// Command returns the rule for command or nil if it isn't configured.
+func (c *Config) Command(command string) *CommandRule {
+	for _, rule := range c.Commands {
+		if rule.Command == command {
+			return rule
+		}
+	}
+	return nil
+}
+
+// CommentClient is used to handle commands in pull request comments.
+type CommentClient interface {
+	// Permission returns the permission of user on repo, e.g. admin, write,
+	// read or none.
+	Permission(ctx context.Context, repo, user string) (string, error)
+	// PullRequestHead returns the SHA of the pull request's head.
+	PullRequestHead(ctx context.Context, repo string, number int) (string, error)
+	// React adds a reaction like +1 to a comment.
+	React(ctx context.Context, repo string, commentID int64, reaction string) error
+}
+
+// Permission returns the permission of user on repo.
+func (l *GithubLoader) Permission(ctx context.Context, repo, user string) (string, error) {
+	parts := strings.SplitN(repo, "/", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("Invalid repository %q", repo)
+	}
+	level, _, err := l.Client.Repositories.GetPermissionLevel(ctx, parts[0], parts[1], user)
+	if err != nil {
+		return "", err
+	}
+	return level.GetPermission(), nil
+}
+
+// PullRequestHead returns the SHA of the pull request's head.
+func (l *GithubLoader) PullRequestHead(ctx context.Context, repo string, number int) (string, error) {
+	parts := strings.SplitN(repo, "/", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("Invalid repository %q", repo)
+	}
+	pr, _, err := l.Client.PullRequests.Get(ctx, parts[0], parts[1], number)
+	if err != nil {
+		return "", err
+	}
+	return pr.GetHead().GetSHA(), nil
+}
+
+// React adds a reaction to a comment.
+func (l *GithubLoader) React(ctx context.Context, repo string, commentID int64, reaction string) error {
+	parts := strings.SplitN(repo, "/", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("Invalid repository %q", repo)
+	}
+	_, _, err := l.Client.Reactions.CreateIssueCommentReaction(ctx, parts[0], parts[1], commentID, reaction)
+	return err
+}
+
+// CommandEvent is a synthetic event for a command in a pull request
+// comment.
+type CommandEvent struct {
+	Repository *github.Repository
+	// Number is the pull request's number.
+	Number   int
+	Revision string
+	// Sender is the login of the commenter.
+	Sender  string
+	Command string
+	Args    []string
+}
+
+// parseCommand returns the command and its arguments from the first line of
+// body starting with a slash.
+func parseCommand(body string) (string, []string) {
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "/") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, "/"))
+		if len(fields) == 0 {
+			return "", nil
+		}
+		return strings.ToLower(fields[0]), fields[1:]
+	}
+	return "", nil
+}
+
+// commandEvent returns the CommandEvent for a comment on a pull request and
+// the rule of its command. If the comment can't be handled, a response
+// is returned instead.
+func (h *Handler) commandEvent(ctx context.Context, logger log.Logger, e *github.IssueCommentEvent) (*CommandEvent, *CommandRule, *handlerResponse, error) {
+	if e.GetAction() != "created" || e.Issue == nil || !e.Issue.IsPullRequest() {
+		return nil, nil, &handlerResponse{outcome: ResponseIgnored, message: "Not a new pull request comment, skipping"}, nil
+	}
+	command, args := parseCommand(e.GetComment().GetBody())
+	rule := h.Config.Command(command)
+	if rule == nil {
+		return nil, nil, &handlerResponse{outcome: ResponseIgnored, message: "No known command, skipping"}, nil
+	}
+	if h.Comments == nil {
+		return nil, nil, &handlerResponse{code: CodeInternal, message: "Commands not enabled"}, errors.New("No comment client configured")
+	}
+	var (
+		repo      = e.GetRepo().GetFullName()
+		sender    = e.GetComment().GetUser().GetLogin()
+		commentID = e.GetComment().GetID()
+	)
+	logger = log.With(logger, "command", command, "sender", sender)
+
+	permission, err := h.Comments.Permission(ctx, repo, sender)
+	if err != nil {
+		return nil, nil, &handlerResponse{status: http.StatusBadGateway, code: CodePermissionFailed, message: "Couldn't check permission"}, err
+	}
+	if permission != "admin" && permission != "write" {
+		level.Info(logger).Log("msg", "Rejecting command by user without write permission", "permission", permission)
+		h.react(ctx, logger, repo, commentID, reactionDenied)
+		return nil, nil, &handlerResponse{status: http.StatusForbidden, code: CodeCommandForbidden, message: "Commands need write permission"}, fmt.Errorf("%s has %s permission on %s", sender, permission, repo)
+	}
+	number := e.GetIssue().GetNumber()
+	revision, err := h.Comments.PullRequestHead(ctx, repo, number)
+	if err != nil {
+		return nil, nil, &handlerResponse{status: http.StatusBadGateway, code: CodeResolveFailed, message: "Couldn't get pull request"}, err
+	}
+	h.react(ctx, logger, repo, commentID, reactionAccepted)
+	return &CommandEvent{
+		Repository: e.GetRepo(),
+		Number:     number,
+		Revision:   revision,
+		Sender:     sender,
+		Command:    command,
+		Args:       args,
+	}, rule, nil, nil
+}
+
+// react adds reaction to a comment, logging failures.
+func (h *Handler) react(ctx context.Context, logger log.Logger, repo string, commentID int64, reaction string) {
+	if err := h.Comments.React(ctx, repo, commentID, reaction); err != nil {
+		level.Error(logger).Log("msg", "Couldn't react to comment", "reaction", reaction, "err", err)
+	}
+}
+
+// pullRequestRef returns the ref of a pull request's head.
+func pullRequestRef(number int) string {
+	return "refs/pull/" + strconv.Itoa(number) + "/head"
+}
@@ -0,0 +1,195 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+type mockCommentClient struct {
+	permission string
+	reactions  []string
+}
+
+func (c *mockCommentClient) Permission(ctx context.Context, repo, user string) (string, error) {
+	return c.permission, nil
+}
+
+func (c *mockCommentClient) PullRequestHead(ctx context.Context, repo string, number int) (string, error) {
+	return "abc", nil
+}
+
+func (c *mockCommentClient) React(ctx context.Context, repo string, commentID int64, reaction string) error {
+	c.reactions = append(c.reactions, fmt.Sprintf("%d:%s", commentID, reaction))
+	return nil
+}
+
+func commentPayload(action, body string, pullRequest bool) []byte {
+	issue := map[string]interface{}{"number": 42}
+	if pullRequest {
+		issue["pull_request"] = map[string]interface{}{"url": "https://api.github.com/repos/foo/bar/pulls/42"}
+	}
+	payload, _ := json.Marshal(map[string]interface{}{
+		"action":  action,
+		"issue":   issue,
+		"comment": map[string]interface{}{"id": 7, "body": body, "user": map[string]interface{}{"login": "alice"}},
+		"repository": map[string]interface{}{
+			"full_name": "foo/bar",
+			"git_url":   "git://github.com/foo/bar.git",
+			"ssh_url":   "git@github.com:foo/bar.git",
+		},
+	})
+	return payload
+}
+
+func TestParseCommand(t *testing.T) {
+	for _, test := range []struct {
+		body    string
+		command string
+		args    []string
+	}{
+		{"/rerun", "rerun", []string{}},
+		{"/deploy staging", "deploy", []string{"staging"}},
+		{"LGTM\n\n  /Deploy  staging eu-west-1 \nthanks", "deploy", []string{"staging", "eu-west-1"}},
+		{"no command here", "", nil},
+		{"/", "", nil},
+	} {
+		command, args := parseCommand(test.body)
+		if command != test.command {
+			t.Errorf("Expected command %q for %q but got %q", test.command, test.body, command)
+		}
+		if diff := cmp.Diff(test.args, args); diff != "" {
+			t.Errorf("Unexpected args for %q (-want +got):\n%s", test.body, diff)
+		}
+	}
+}
+
+func TestHandleCommand(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		action      string
+		body        string
+		pullRequest bool
+		permission  string
+		status      int
+		outcome     string
+		code        ErrorCode
+		reactions   []string
+	}{
+		{name: "issue", action: "created", body: "/deploy staging", status: http.StatusOK, outcome: ResponseIgnored},
+		{name: "edited", action: "edited", body: "/deploy staging", pullRequest: true, status: http.StatusOK, outcome: ResponseIgnored},
+		{name: "no command", action: "created", body: "LGTM", pullRequest: true, status: http.StatusOK, outcome: ResponseIgnored},
+		{name: "unknown command", action: "created", body: "/destroy", pullRequest: true, status: http.StatusOK, outcome: ResponseIgnored},
+		{name: "read permission", action: "created", body: "/deploy staging", pullRequest: true, permission: "read", status: http.StatusForbidden, code: CodeCommandForbidden, reactions: []string{"7:-1"}},
+		{name: "write permission", action: "created", body: "/deploy staging", pullRequest: true, permission: "write", status: http.StatusOK, outcome: ResponseCreated, reactions: []string{"7:+1"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			config := &Config{
+				Namespace:    "ci",
+				ResourcePath: ".ci/workflow.yaml",
+				Insecure:     true,
+				Commands:     []*CommandRule{{Command: "deploy", ResourcePath: ".ci/deploy.yaml"}, {Command: "rerun"}},
+			}
+			obj := workflow()
+			obj.Object["spec"] = map[string]interface{}{"environment": "{{arg1}}", "command": "{{command}} {{args}}"}
+			kc := &mockKubernetesClient{}
+			loader := &mockLoader{obj: obj}
+			comments := &mockCommentClient{permission: test.permission}
+			handler := NewGithubHookHandler(log.NewNopLogger(), config, kc, loader, newTestMetrics())
+			handler.Comments = comments
+
+			req := newRequest("issue_comment", commentPayload(test.action, test.body, test.pullRequest), "")
+			req.Header.Set("Accept", "application/json")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != test.status {
+				t.Fatalf("Expected status %d but got %d: %s", test.status, w.Code, w.Body.String())
+			}
+			resp := &Response{}
+			if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+				t.Fatal(err)
+			}
+			if test.code != "" && (resp.Error == nil || resp.Error.Code != test.code) {
+				t.Fatalf("Expected error code %s but got %s", test.code, w.Body.String())
+			}
+			if test.outcome != "" && resp.Outcome != test.outcome {
+				t.Fatalf("Expected outcome %s but got %s", test.outcome, w.Body.String())
+			}
+			if diff := cmp.Diff(test.reactions, comments.reactions); diff != "" {
+				t.Fatalf("Unexpected reactions (-want +got):\n%s", diff)
+			}
+			if test.outcome != ResponseCreated {
+				if len(kc.applied) != 0 {
+					t.Fatalf("Expected nothing to be applied but got %d objects", len(kc.applied))
+				}
+				return
+			}
+
+			if loader.path != ".ci/deploy.yaml" {
+				t.Fatalf("Expected command's resource path to be loaded but got %s", loader.path)
+			}
+			applied := kc.obj.(*unstructured.Unstructured)
+			if diff := cmp.Diff(map[string]interface{}{"environment": "staging", "command": "deploy staging"}, applied.Object["spec"]); diff != "" {
+				t.Fatalf("Unexpected expanded manifest (-want +got):\n%s", diff)
+			}
+			annotations := applied.GetAnnotations()
+			for k, v := range map[string]string{
+				"event_type":   "issue_comment",
+				"event_action": "deploy",
+				"sender":       "alice",
+				"command":      "deploy",
+				"command_args": "staging",
+				"ref":          "refs/pull/42/head",
+				"revision":     "abc",
+			} {
+				if annotations[annotationPrefix+k] != v {
+					t.Errorf("Expected annotation %s=%s but got %v", k, v, annotations)
+				}
+			}
+		})
+	}
+}
+
+func TestGithubCommentClient(t *testing.T) {
+	var reaction string
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/repos/foo/bar/collaborators/alice/permission", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"permission": "write"}`)
+	})
+	mux.HandleFunc("/repos/foo/bar/pulls/42", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"number": 42, "head": {"sha": "abc"}}`)
+	})
+	mux.HandleFunc("/repos/foo/bar/issues/comments/7/reactions", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		reaction = r.Method + " " + string(body)
+		fmt.Fprint(w, `{}`)
+	})
+	loader, err := NewGithubLoader("", server.URL+"/", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if permission, err := loader.Permission(ctx, "foo/bar", "alice"); err != nil || permission != "write" {
+		t.Fatalf("Expected write permission but got %q, %v", permission, err)
+	}
+	if sha, err := loader.PullRequestHead(ctx, "foo/bar", 42); err != nil || sha != "abc" {
+		t.Fatalf("Expected head abc but got %q, %v", sha, err)
+	}
+	if err := loader.React(ctx, "foo/bar", 7, reactionAccepted); err != nil {
+		t.Fatal(err)
+	}
+	if reaction != "POST {\"content\":\"+1\"}\n" {
+		t.Fatalf("Unexpected reaction request %q", reaction)
+	}
+}
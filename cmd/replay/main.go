@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+func main() {
+	var (
+		adminURL  = flag.String("url", "http://localhost:8080/-/admin/", "URL of the webhook handler's admin endpoint")
+		revision  = flag.String("revision", "", "If set, apply this revision instead of the delivery's")
+		namespace = flag.String("namespace", "", "If set, apply to this namespace instead of the configured one")
+		dryRun    = flag.Bool("dry", false, "Dry run; Do not apply resource manifest")
+		show      = flag.Bool("show", false, "Print the stored delivery instead of replaying it")
+	)
+	flag.Parse()
+	if flag.NArg() != 1 {
+		log.Fatal("Usage: replay [flags] delivery-id")
+	}
+	token := os.Getenv("ADMIN_TOKEN")
+	if token == "" {
+		log.Fatal("ADMIN_TOKEN not set")
+	}
+
+	u, err := url.Parse(strings.TrimSuffix(*adminURL, "/") + "/deliveries/" + url.PathEscape(flag.Arg(0)))
+	if err != nil {
+		log.Fatal(err)
+	}
+	method := http.MethodGet
+	if !*show {
+		method = http.MethodPost
+		u.Path += "/replay"
+		query := url.Values{}
+		if *revision != "" {
+			query.Set("revision", *revision)
+		}
+		if *namespace != "" {
+			query.Set("namespace", *namespace)
+		}
+		if *dryRun {
+			query.Set("dry", strconv.FormatBool(*dryRun))
+		}
+		u.RawQuery = query.Encode()
+	}
+
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(os.Stdout, resp.Body); err != nil {
+		log.Fatal(err)
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		fmt.Fprintln(os.Stderr, resp.Status)
+		os.Exit(1)
+	}
+}
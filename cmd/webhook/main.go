@@ -1,49 +1,168 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/go-kit/kit/metrics/statsd"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/transport"
 
 	handler "github.com/airbnb/k8s-webhook-handler"
 )
 
 var (
-	listenAddr   = flag.String("l", ":8080", "Address to listen on for webhook requests")
-	namespace    = flag.String("ns", "ci", "Namespace to deploy workflows to")
-	resourcePath = flag.String("p", ".ci/workflow.yaml", "Path to resource manifest in repository")
-	livenessPath = flag.String("lp", "/-/alive", "Path for liveness endpoint (Always returns 200 OK")
-	kubeconfig   = flag.String("kubeconfig", "", "If set, use this kubeconfig to connect to kubernetes")
-	baseURL      = flag.String("gh-base-url", "", "GitHub Enterprise: Base URL")
-	uploadURL    = flag.String("gh-upload-url", "", "GitHub Enterprise: Upload URL")
-	debug        = flag.Bool("debug", false, "Enable debug logging")
-	dryRun       = flag.Bool("dry", false, "Dry run; Do not apply resouce manifest")
-	insecure     = flag.Bool("insecure", false, "Allow omitting WEBHOOK_SECRET for testing")
-	ignoreRef    = flag.String("ignore", "", "Ignore refs matching this regex")
+	listenAddr    = flag.String("l", ":8080", "Address to listen on for webhook requests")
+	namespace     = flag.String("ns", "ci", "Namespace to deploy workflows to")
+	nsTemplate    = flag.String("ns-template", "", "If set, deploy workflows to a namespace per repository and ref named by this template, e.g. ci-{{name}}-{{shortref}}")
+	nsSeed        = flag.String("ns-seed", "", "Path to manifest to apply to namespaces created for -ns-template, e.g. with a ResourceQuota, LimitRange and RoleBinding")
+	resourcePath  = flag.String("p", ".ci/workflow.yaml", "Path to resource manifest in repository")
+	livenessPath  = flag.String("lp", "/-/alive", "Path for liveness endpoint (Always returns 200 OK")
+	readyPath     = flag.String("rp", "/-/ready", "Path for readiness endpoint, reporting whether this replica is the leader")
+	kubeconfig    = flag.String("kubeconfig", "", "If set, use this kubeconfig to connect to kubernetes")
+	baseURL       = flag.String("gh-base-url", "", "GitHub Enterprise: Base URL")
+	uploadURL     = flag.String("gh-upload-url", "", "GitHub Enterprise: Upload URL")
+	debug         = flag.Bool("debug", false, "Enable debug logging")
+	dryRun        = flag.Bool("dry", false, "Dry run; Do not apply resouce manifest")
+	insecure      = flag.Bool("insecure", false, "Allow omitting WEBHOOK_SECRET for testing")
+	ignoreRef     = flag.String("ignore", "", "Ignore refs matching this regex")
+	configFile    = flag.String("config", "", "Path to config file with per repository rules")
+	applyMode     = flag.String("apply-mode", "fail-fast", "How to handle failures applying multiple objects: fail-fast, atomic (delete objects created before) or best-effort (apply all objects)")
+	runAnchor     = flag.String("run-anchor", "", "If set to configmap, create a ConfigMap per delivery owning all objects created for it")
+	tagConstraint = flag.String("tag-constraint", "", "If set, only handle tags which are semantic versions matching this constraint, e.g. '>= 1.0'")
+	skipDirs      = flag.String("skip.directives", strings.Join(handler.DefaultSkipDirectives, ","), "Comma separated commit message directives skipping pushes, e.g. 'skip ci' for [skip ci]. [skip <manifest name>] skips only that manifest. Disabled if empty")
+	releaseActs   = flag.String("release-actions", strings.Join(handler.DefaultReleaseActions, ","), "Comma separated release actions to handle: published, prereleased or released")
+	skipAll       = flag.Bool("skip.all-commits", false, "Check all commits of a push for skip directives instead of only the head commit")
+	shutdownWait  = flag.Duration("shutdown-timeout", 10*time.Second, "Time to wait for requests in flight on SIGTERM")
+	impersonate   = flag.String("impersonate", "", "If set, apply manifests as this user. Supports placeholders like {{owner}} and {{name}}")
+
+	secretSelector = flag.String("secret.selector", "", "If set, read per repository webhook secrets from Secrets matching this label selector")
+	secretNS       = flag.String("secret.ns", "ci", "Namespace to read per repository webhook secrets from")
+	secretResync   = flag.Duration("secret.resync", 10*time.Minute, "Resync interval for per repository webhook secrets")
+
+	allowedKinds        = flag.String("policy.allowed-kinds", "", "Comma separated apiVersion/Kind patterns of namespaced kinds to allow. Allows all if empty")
+	allowedClusterKinds = flag.String("policy.allowed-cluster-kinds", "", "Comma separated apiVersion/Kind patterns of cluster-scoped kinds to allow")
+	namespaceMode       = flag.String("policy.namespace-mode", "reject", "How to handle namespaces set in manifests: reject, force or respect")
+	allowedNamespaces   = flag.String("policy.allowed-namespaces", "", "Comma separated patterns of namespaces manifests may set with -policy.namespace-mode=respect")
+
+	sourceCIDRs          = flag.String("source.cidrs", "", "If set, only allow requests from these comma separated CIDRs")
+	sourceGithubHooks    = flag.Bool("source.github-hooks", false, "Allow requests from GitHub's published hook ranges, disallowing all other sources not in -source.cidrs")
+	sourceGithubInterval = flag.Duration("source.github-hooks-interval", time.Hour, "Interval to refresh GitHub's hook ranges in")
+	sourceTrustedProxies = flag.String("source.trusted-proxies", "", "Comma separated CIDRs of proxies to honor X-Forwarded-For from")
+
+	runsNS            = flag.String("runs.ns", "", "If set, record every delivery as WebhookRun in this namespace")
+	runsTTL           = flag.Duration("runs.ttl", 7*24*time.Hour, "Delete WebhookRuns older than this. Disabled if 0")
+	runsPruneInterval = flag.Duration("runs.prune-interval", 10*time.Minute, "Interval to delete expired WebhookRuns in")
+
+	deliveriesDir = flag.String("deliveries.dir", "", "If set, store validated payloads in this directory for replaying them")
+	deliveriesMax = flag.Int("deliveries.max", 1000, "Maximum number of deliveries to store, older ones are deleted")
+	adminPrefix   = flag.String("admin.prefix", "/-/admin/", "Path prefix of the admin endpoint, enabled if ADMIN_TOKEN and -deliveries.dir are set")
+
+	triggerPath        = flag.String("trigger.path", "/trigger", "Path of the manual trigger endpoint, enabled if -trigger.tokens or -tls.client-ca is set")
+	triggerTokens      = flag.String("trigger.tokens", "", "Path to file with identity:token lines of callers allowed to trigger manual events")
+	triggerClientNames = flag.String("trigger.client-names", "", "Comma separated common names of client certificates allowed to trigger manual events. Allows all verified certificates if empty")
+
+	tlsCert     = flag.String("tls.cert", "", "If set, serve HTTPS with this certificate")
+	tlsKey      = flag.String("tls.key", "", "Key of the -tls.cert certificate")
+	tlsClientCA = flag.String("tls.client-ca", "", "If set, verify client certificates presented to the trigger endpoint by this CA bundle")
+
+	pruneInterval = flag.Duration("prune.interval", 10*time.Minute, "Interval to prune objects by the config file's prune rules in")
+	pruneDryRun   = flag.Bool("prune.dry", false, "Only log and count objects to prune instead of deleting them")
+
+	leaderElect         = flag.Bool("leader-elect", false, "Run background controllers like pruning only on the replica holding a Lease")
+	leaderElectNS       = flag.String("leader-elect.ns", "ci", "Namespace of the leader election Lease")
+	leaderElectName     = flag.String("leader-elect.name", "k8s-webhook-handler", "Name of the leader election Lease")
+	leaderElectLease    = flag.Duration("leader-elect.lease-duration", 15*time.Second, "Duration followers wait before trying to acquire an unrenewed Lease")
+	leaderElectRenew    = flag.Duration("leader-elect.renew-deadline", 10*time.Second, "Duration the leader retries renewing the Lease before giving up")
+	leaderElectRetry    = flag.Duration("leader-elect.retry-period", 2*time.Second, "Interval to try acquiring or renewing the Lease in")
+	leaderElectIdentity = flag.String("leader-elect.identity", "", "Identity of this replica. Defaults to the hostname")
+
+	discoveryInterval = flag.Duration("discovery-interval", 10*time.Minute, "Interval to refresh the cached kubernetes discovery information in")
+
+	metricsSink     = flag.String("metrics.sink", "statsd", "Where to report metrics to: statsd, prometheus or both")
+	metricsAddr     = flag.String("metrics.addr", ":9102", "Address to serve Prometheus metrics on at /metrics")
+	metricsMaxRepos = flag.Int("metrics.max-repos", 100, "Maximum number of repositories to use as metric label, all others are reported as 'other'")
+
+	otlpEndpoint    = flag.String("otlp.endpoint", "", "If set, export traces by OTLP over HTTP to this host:port")
+	otlpInsecure    = flag.Bool("otlp.insecure", false, "Export traces without TLS")
+	otlpServiceName = flag.String("otlp.service-name", "k8s-webhook-handler", "Service name to report traces as")
+	otlpSampleRatio = flag.Float64("otlp.sample-ratio", 1, "Ratio of webhooks to trace, unless the caller's trace is sampled")
 
 	statsdAddress  = flag.String("statsd.address", "localhost:8125", "Address to send statsd metrics to")
+	statsdPrefix   = flag.String("statsd.prefix", "k8s-webhook-handler.", "Prefix of all statsd metrics")
 	statsdProto    = flag.String("statsd.proto", "udp", "Protocol to use for statsd")
 	statsdInterval = flag.Duration("statsd.interval", 30*time.Second, "statsd flush interval")
 )
 
+// flushTraces exports batched spans before exiting if tracing is enabled.
+var flushTraces = func() {}
+
 func fatal(logger log.Logger, err error) {
 	// FIXME: override caller, not add it
 	level.Error(logger).Log("msg", err.Error(), "caller", log.Caller(4))
+	flushTraces()
 	os.Exit(1)
 }
 
+func splitList(list string) []string {
+	if list == "" {
+		return nil
+	}
+	return strings.Split(list, ",")
+}
+
+// readTokens reads identity:token lines from filename and returns the
+// identities by token.
+func readTokens(filename string) (map[string]string, error) {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	tokens := map[string]string{}
+	scanner := bufio.NewScanner(fh)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("%s:%d: expected identity:token", filename, n)
+		}
+		tokens[parts[1]] = parts[0]
+	}
+	return tokens, scanner.Err()
+}
+
 func main() {
 	logger := log.With(log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr)), "caller", log.Caller(5))
 	flag.Parse()
 	githubSecret := os.Getenv("WEBHOOK_SECRET")
-	if githubSecret == "" && !*insecure {
+	if githubSecret == "" && *secretSelector == "" && *configFile == "" && !*insecure {
 		fatal(logger, errors.New("WEBHOOK_SECRET not set. Use -insecure to disable webhook verification"))
 	}
 	if *debug {
@@ -53,11 +172,78 @@ func main() {
 	}
 
 	config := &handler.Config{
-		Namespace:           *namespace,
-		ResourcePath:        *resourcePath,
-		HandlerLivenessPath: *livenessPath,
-		Secret:              []byte(githubSecret),
-		DryRun:              *dryRun,
+		Namespace:            *namespace,
+		ResourcePath:         *resourcePath,
+		HandlerLivenessPath:  *livenessPath,
+		HandlerReadinessPath: *readyPath,
+		Secret:               []byte(githubSecret),
+		Insecure:             *insecure,
+		DryRun:               *dryRun,
+		Impersonate:          *impersonate,
+		NamespaceTemplate:    *nsTemplate,
+		ApplyMode:            handler.ApplyMode(*applyMode),
+		RunAnchor:            handler.RunAnchor(*runAnchor),
+		TagConstraint:        handler.TagConstraint(*tagConstraint),
+		SkipDirectives:       splitList(*skipDirs),
+		SkipAllCommits:       *skipAll,
+		ReleaseActions:       splitList(*releaseActs),
+		Policy: handler.Policy{
+			AllowedKinds:        splitList(*allowedKinds),
+			AllowedClusterKinds: splitList(*allowedClusterKinds),
+			NamespaceMode:       handler.NamespaceMode(*namespaceMode),
+			AllowedNamespaces:   splitList(*allowedNamespaces),
+		},
+	}
+	if err := config.Policy.Validate(); err != nil {
+		fatal(logger, err)
+	}
+	if err := config.ApplyMode.Validate(); err != nil {
+		fatal(logger, err)
+	}
+	if err := config.RunAnchor.Validate(); err != nil {
+		fatal(logger, err)
+	}
+	if err := config.TagConstraint.Validate(); err != nil {
+		fatal(logger, err)
+	}
+	if err := handler.ValidateReleaseActions(config.ReleaseActions); err != nil {
+		fatal(logger, err)
+	}
+
+	if *nsSeed != "" {
+		fh, err := os.Open(*nsSeed)
+		if err != nil {
+			fatal(logger, err)
+		}
+		seed, err := handler.Decode(fh)
+		fh.Close()
+		if err != nil {
+			fatal(logger, err)
+		}
+		config.NamespaceSeed = seed
+	}
+
+	var (
+		admissionRules []*handler.AdmissionRule
+		pruneRules     []*handler.PruneRule
+		scheduleRules  []*handler.ScheduleRule
+		deployments    *handler.DeploymentConfig
+	)
+	if *configFile != "" {
+		cf, err := handler.ReadConfigFile(*configFile)
+		if err != nil {
+			fatal(logger, err)
+		}
+		config.Rules = cf.Rules
+		config.Commands = cf.Commands
+		admissionRules = cf.Admission
+		pruneRules = cf.Prune
+		scheduleRules = cf.Schedules
+		deployments = cf.Deployments
+	}
+	admissionPolicies, err := handler.NewAdmissionPolicies(admissionRules)
+	if err != nil {
+		fatal(logger, err)
 	}
 
 	if *ignoreRef != "" {
@@ -69,25 +255,246 @@ func main() {
 		config.IgnoreRefRegex = regex
 	}
 
+	var providers handler.MultiProvider
+	switch *metricsSink {
+	case "statsd", "prometheus", "both":
+	default:
+		fatal(logger, fmt.Errorf("Invalid metrics sink %q", *metricsSink))
+	}
+	if *metricsSink != "prometheus" {
+		ticker := time.NewTicker(*statsdInterval)
+		defer ticker.Stop()
+		statsdClient := statsd.New(*statsdPrefix, logger)
+		go statsdClient.SendLoop(ticker.C, *statsdProto, *statsdAddress)
+		providers = append(providers, handler.NewStatsdProvider(statsdClient))
+	}
+	if *metricsSink != "statsd" {
+		providers = append(providers, handler.NewPrometheusProvider("k8s_webhook_handler", prometheus.DefaultRegisterer))
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		go func() {
+			level.Info(logger).Log("msg", "Serving metrics", "addr", *metricsAddr)
+			fatal(logger, http.ListenAndServe(*metricsAddr, mux))
+		}()
+	}
+
+	if *otlpEndpoint != "" {
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(*otlpEndpoint)}
+		if *otlpInsecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err := otlptracehttp.New(context.Background(), opts...)
+		if err != nil {
+			fatal(logger, err)
+		}
+		provider := sdktrace.NewTracerProvider(
+			sdktrace.WithBatcher(exporter),
+			sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(*otlpSampleRatio))),
+			sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(*otlpServiceName))),
+		)
+		// main only returns after shutting down on SIGTERM, otherwise it
+		// exits through fatal, so deferring this wouldn't run.
+		flushTraces = func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := provider.Shutdown(ctx); err != nil {
+				level.Error(logger).Log("msg", "Couldn't flush traces", "err", err)
+			}
+		}
+		otel.SetTracerProvider(provider)
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+		level.Info(logger).Log("msg", "Exporting traces", "endpoint", *otlpEndpoint)
+	}
+
 	level.Info(logger).Log("msg", "Connecting to kubernetes", "kubeconfig", *kubeconfig)
-	kClient, err := handler.NewKubernetesClient(*kubeconfig)
+	restConfig, err := handler.BuildKubernetesConfig(*kubeconfig)
 	if err != nil {
 		fatal(logger, err)
 	}
+	restConfig.WrapTransport = transport.Wrappers(restConfig.WrapTransport, handler.TracingTransport)
+	kClient, err := handler.NewKubernetesClient(restConfig, providers.NewCounter("discovery_refreshes", "Number of discovery information refreshes."))
+	if err != nil {
+		fatal(logger, err)
+	}
+	go kClient.RefreshDiscovery(logger, *discoveryInterval, make(chan struct{}))
+
+	// controllers are only run by the leader if leader election is enabled.
+	var controllers []handler.Controller
+	if len(pruneRules) > 0 {
+		pruner, err := handler.NewPruner(log.With(logger, "component", "pruner"), kClient, kClient, pruneRules, *pruneDryRun,
+			providers.NewCounter("pruned", "Number of pruned objects."), providers.NewCounter("prune_errors", "Number of objects which couldn't be pruned."))
+		if err != nil {
+			fatal(logger, err)
+		}
+		controllers = append(controllers, func(stopCh <-chan struct{}) { pruner.Run(*pruneInterval, stopCh) })
+	}
 
 	loader, err := handler.NewGithubLoader(os.Getenv("GITHUB_TOKEN"), *baseURL, *uploadURL)
 	if err != nil {
 		fatal(logger, err)
 	}
 
-	ticker := time.NewTicker(*statsdInterval)
-	defer ticker.Stop()
-	statsdClient := statsd.New("k8s-ci-purger.", logger)
-	go statsdClient.SendLoop(ticker.C, *statsdProto, *statsdAddress)
+	server := handler.NewGithubHookHandler(logger, config, kClient, loader, handler.NewMetrics(providers, *metricsMaxRepos))
+	server.AdmissionPolicies = admissionPolicies
+	server.Comments = loader
+	server.Refs = loader
+	server.Changes = loader
+	if deployments != nil {
+		tracker, err := handler.NewDeploymentTracker(log.With(logger, "component", "deployments"), kClient, kClient, loader, deployments)
+		if err != nil {
+			fatal(logger, err)
+		}
+		server.Deployments = tracker
+		// Deployments in progress are resumed by the leader, e.g. if the
+		// replica which applied them was restarted.
+		controllers = append(controllers, func(stopCh <-chan struct{}) {
+			if err := tracker.Resume(context.Background()); err != nil {
+				level.Error(logger).Log("msg", "Couldn't resume deployments", "err", err)
+			}
+		})
+	}
 
-	server := handler.NewGithubHookHandler(logger, config, kClient, loader, statsdClient)
+	if *runsNS != "" {
+		recorder := handler.NewKubernetesRunRecorder(kClient, *runsNS)
+		if *runsTTL > 0 {
+			controllers = append(controllers, func(stopCh <-chan struct{}) {
+				recorder.PruneRuns(logger, *runsTTL, *runsPruneInterval, stopCh)
+			})
+		}
+		server.Runs = recorder
+	}
+
+	if len(scheduleRules) > 0 {
+		scheduler, err := handler.NewScheduler(log.With(logger, "component", "scheduler"), server, loader, scheduleRules,
+			providers.NewCounter("schedules_fired", "Number of fired schedules."), providers.NewCounter("schedule_errors", "Number of fired schedules which couldn't be handled."))
+		if err != nil {
+			fatal(logger, err)
+		}
+		controllers = append(controllers, scheduler.Run)
+	}
+
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		fatal(logger, err)
+	}
+	if *secretSelector != "" {
+		store, err := handler.NewKubernetesSecretStore(clientset, *secretNS, *secretSelector, *secretResync)
+		if err != nil {
+			fatal(logger, err)
+		}
+		level.Info(logger).Log("msg", "Syncing webhook secrets", "namespace", *secretNS, "selector", *secretSelector)
+		if err := store.Run(make(chan struct{})); err != nil {
+			fatal(logger, err)
+		}
+		server.Secrets = store
+	}
+
+	if *sourceCIDRs != "" || *sourceGithubHooks {
+		filter, err := handler.NewSourceFilter(splitList(*sourceCIDRs), splitList(*sourceTrustedProxies))
+		if err != nil {
+			fatal(logger, err)
+		}
+		if *sourceGithubHooks {
+			if err := filter.UpdateGithubHooks(context.Background(), loader.Client); err != nil {
+				fatal(logger, err)
+			}
+			go filter.RefreshGithubHooks(logger, loader.Client, *sourceGithubInterval, make(chan struct{}))
+		}
+		server.SourceFilter = filter
+	}
+
+	if *leaderElect {
+		identity := *leaderElectIdentity
+		if identity == "" {
+			if identity, err = os.Hostname(); err != nil {
+				fatal(logger, err)
+			}
+		}
+		elector := handler.NewLeaderElector(log.With(logger, "component", "leader-election"), clientset, &handler.LeaderElectionConfig{
+			Namespace:     *leaderElectNS,
+			Name:          *leaderElectName,
+			Identity:      identity,
+			LeaseDuration: *leaderElectLease,
+			RenewDeadline: *leaderElectRenew,
+			RetryPeriod:   *leaderElectRetry,
+		}, providers.NewGauge("leader", "1 if this replica is the leader, 0 otherwise."), providers.NewCounter("leader_transitions", "Number of leader changes."))
+		go func() {
+			if err := elector.Run(context.Background(), controllers...); err != nil {
+				fatal(logger, err)
+			}
+		}()
+		server.Leader = elector
+	} else {
+		for _, controller := range controllers {
+			go controller(make(chan struct{}))
+		}
+	}
+
+	if *deliveriesDir != "" {
+		store, err := handler.NewDirectoryDeliveryStore(*deliveriesDir, *deliveriesMax)
+		if err != nil {
+			fatal(logger, err)
+		}
+		server.Deliveries = store
+		if token := os.Getenv("ADMIN_TOKEN"); token != "" {
+			http.Handle(*adminPrefix, handler.NewAdminHandler(log.With(logger, "component", "admin"), server, *adminPrefix, []byte(token)))
+		}
+	}
+
+	httpServer := &http.Server{Addr: *listenAddr}
+	if *tlsClientCA != "" {
+		if *tlsCert == "" {
+			fatal(logger, errors.New("-tls.client-ca requires -tls.cert and -tls.key"))
+		}
+		pem, err := ioutil.ReadFile(*tlsClientCA)
+		if err != nil {
+			fatal(logger, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			fatal(logger, fmt.Errorf("No certificates found in %s", *tlsClientCA))
+		}
+		// GitHub doesn't present client certificates, so they're only
+		// verified if given.
+		httpServer.TLSConfig = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	}
+	if *triggerTokens != "" || *tlsClientCA != "" {
+		tokens := map[string]string{}
+		if *triggerTokens != "" {
+			if tokens, err = readTokens(*triggerTokens); err != nil {
+				fatal(logger, err)
+			}
+		}
+		http.Handle(*triggerPath, handler.NewTriggerHandler(log.With(logger, "component", "trigger"), server, loader, tokens, splitList(*triggerClientNames)))
+	}
 
 	http.Handle("/", server)
-	level.Info(logger).Log("msg", "Start listening", "addr", *listenAddr)
-	fatal(logger, http.ListenAndServe(*listenAddr, nil))
+
+	stopped := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+		level.Info(logger).Log("msg", "Shutting down", "signal", <-signals)
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownWait)
+		defer cancel()
+		if err := httpServer.Shutdown(ctx); err != nil {
+			level.Error(logger).Log("msg", "Couldn't shut down gracefully", "err", err)
+		}
+		if server.Deployments != nil {
+			server.Deployments.Stop()
+		}
+		close(stopped)
+	}()
+
+	level.Info(logger).Log("msg", "Start listening", "addr", *listenAddr, "tls", *tlsCert != "")
+	if *tlsCert != "" {
+		err = httpServer.ListenAndServeTLS(*tlsCert, *tlsKey)
+	} else {
+		err = httpServer.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		fatal(logger, err)
+	}
+	<-stopped
+	flushTraces()
 }
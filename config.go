@@ -0,0 +1,132 @@
+package handler
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Rule holds settings for all repositories matching Repo.
+type Rule struct {
+	Name string `json:"name"`
+	// Repo is matched against the full repository name (e.g. airbnb/foo)
+	// with path.Match, so "airbnb/*" matches all repositories of an org.
+	Repo string `json:"repo"`
+	// Secret is used to validate webhooks for this repository instead of
+	// the global secret.
+	Secret string `json:"secret,omitempty"`
+	// Policy overrides the global policy's fields it sets.
+	Policy *Policy `json:"policy,omitempty"`
+	// Impersonate overrides the global template of the identity to apply
+	// objects as.
+	Impersonate string `json:"impersonate,omitempty"`
+	// ApplyMode overrides the global apply mode.
+	ApplyMode ApplyMode `json:"applyMode,omitempty"`
+	// TagConstraint overrides the global tag constraint.
+	TagConstraint TagConstraint `json:"tagConstraint,omitempty"`
+	// Inputs declares the inputs dispatch events may pass. Dispatch events
+	// with undeclared inputs are rejected.
+	Inputs []*InputSpec `json:"inputs,omitempty"`
+	// Paths and PathsIgnore filter pushes by the files they change. Pushes
+	// are skipped unless a changed file matches Paths, if set, and doesn't
+	// match PathsIgnore.
+	Paths       []string `json:"paths,omitempty"`
+	PathsIgnore []string `json:"pathsIgnore,omitempty"`
+}
+
+// ConfigFile is the format of the file passed to cmd/webhook with -config.
+type ConfigFile struct {
+	Rules     []*Rule          `json:"rules"`
+	Admission []*AdmissionRule `json:"admission"`
+	Prune     []*PruneRule     `json:"prune"`
+	Schedules []*ScheduleRule  `json:"schedules"`
+	Commands  []*CommandRule   `json:"commands"`
+	// Deployments enables handling deployment events.
+	Deployments *DeploymentConfig `json:"deployments"`
+}
+
+// ReadConfigFile reads and validates a YAML config file.
+func ReadConfigFile(filename string) (*ConfigFile, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	cf := &ConfigFile{}
+	if err := yaml.UnmarshalStrict(content, cf); err != nil {
+		return nil, fmt.Errorf("Couldn't parse config file %s: %s", filename, err)
+	}
+	for i, rule := range cf.Rules {
+		if rule.Repo == "" {
+			return nil, fmt.Errorf("Rule %d (%s) has no repo", i, rule.Name)
+		}
+		if _, err := path.Match(rule.Repo, ""); err != nil {
+			return nil, fmt.Errorf("Rule %d (%s) has invalid repo pattern %q: %s", i, rule.Name, rule.Repo, err)
+		}
+		if err := rule.ApplyMode.Validate(); err != nil {
+			return nil, fmt.Errorf("Rule %d (%s) has invalid apply mode: %s", i, rule.Name, err)
+		}
+		if err := rule.TagConstraint.Validate(); err != nil {
+			return nil, fmt.Errorf("Rule %d (%s) has invalid tag constraint: %s", i, rule.Name, err)
+		}
+		for _, pattern := range append(append([]string{}, rule.Paths...), rule.PathsIgnore...) {
+			if err := validatePathPattern(pattern); err != nil {
+				return nil, fmt.Errorf("Rule %d (%s) has invalid paths: %s", i, rule.Name, err)
+			}
+		}
+		for _, spec := range rule.Inputs {
+			if err := spec.Validate(); err != nil {
+				return nil, fmt.Errorf("Rule %d (%s) has invalid input: %s", i, rule.Name, err)
+			}
+		}
+		if rule.Policy != nil {
+			if err := rule.Policy.Validate(); err != nil {
+				return nil, fmt.Errorf("Rule %d (%s) has invalid policy: %s", i, rule.Name, err)
+			}
+		}
+	}
+	for _, rule := range cf.Prune {
+		if err := rule.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	names := map[string]bool{}
+	for _, rule := range cf.Schedules {
+		if err := rule.Validate(); err != nil {
+			return nil, err
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("Schedule %s is defined twice", rule.Name)
+		}
+		names[rule.Name] = true
+	}
+	if cf.Deployments != nil {
+		if err := cf.Deployments.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	commands := map[string]bool{}
+	for _, rule := range cf.Commands {
+		if err := rule.Validate(); err != nil {
+			return nil, err
+		}
+		if commands[rule.Command] {
+			return nil, fmt.Errorf("Command %s is defined twice", rule.Command)
+		}
+		commands[rule.Command] = true
+	}
+	return cf, nil
+}
+
+// Rule returns the first rule matching repo or nil if none matches.
+func (c *Config) Rule(repo string) *Rule {
+	repo = strings.ToLower(repo)
+	for _, rule := range c.Rules {
+		if ok, _ := path.Match(strings.ToLower(rule.Repo), repo); ok {
+			return rule
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestReadConfigFile(t *testing.T) {
+	for _, test := range []struct {
+		content     string
+		expectRules int
+		expectError bool
+	}{
+		{"rules:\n- name: foo\n  repo: airbnb/*\n  secret: bar\n", 1, false},
+		{"rules: []\n", 0, false},
+		{"rules:\n- name: foo\n", 0, true},
+		{"rules:\n- repo: '[airbnb'\n", 0, true},
+		{"unknown: field\n", 0, true},
+		{"prune:\n- name: workflows\n  apiVersion: argoproj.io/v1alpha1\n  kind: Workflow\n  ttl: 72h\n", 0, false},
+		{"prune:\n- name: workflows\n  apiVersion: argoproj.io/v1alpha1\n  kind: Workflow\n", 0, true},
+		{"schedules:\n- name: nightly\n  repo: airbnb/foo\n  ref: master\n  schedule: 0 3 * * *\n  timezone: America/Los_Angeles\n", 0, false},
+		{"schedules:\n- name: nightly\n  repo: airbnb/foo\n  ref: master\n  schedule: 0 3 * * *\n- name: nightly\n  repo: airbnb/bar\n  ref: master\n  schedule: 0 3 * * *\n", 0, true},
+		{"commands:\n- command: deploy\n  resourcePath: .ci/deploy.yaml\n- command: rerun\n", 0, false},
+		{"commands:\n- command: /deploy\n", 0, true},
+		{"rules:\n- name: foo\n  repo: airbnb/*\n  tagConstraint: '>= 1.0'\n", 1, false},
+		{"rules:\n- name: foo\n  repo: airbnb/*\n  tagConstraint: foo\n", 0, true},
+		{"rules:\n- name: foo\n  repo: airbnb/*\n  inputs:\n  - name: env\n    pattern: staging|prod\n", 1, false},
+		{"rules:\n- name: foo\n  repo: airbnb/*\n  inputs:\n  - name: env\n    pattern: '('\n", 0, true},
+		{"deployments:\n  resourcePath: .ci/deploy-{{environment}}.yaml\n  statusPath: '{.status.phase}'\n  successValues: [Succeeded]\n  timeout: 1h\n", 0, false},
+		{"deployments:\n  statusPath: '{.status.phase}'\n", 0, true},
+		{"rules:\n- name: foo\n  repo: airbnb/*\n  paths: [services/api/**]\n  pathsIgnore: ['**/*.md']\n", 1, false},
+		{"rules:\n- name: foo\n  repo: airbnb/*\n  paths: ['services/[a-']\n", 0, true},
+	} {
+		fh, err := ioutil.TempFile("", "config")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(fh.Name())
+		if _, err := fh.WriteString(test.content); err != nil {
+			t.Fatal(err)
+		}
+		fh.Close()
+
+		cf, err := ReadConfigFile(fh.Name())
+		if test.expectError && err == nil {
+			t.Fatalf("Expected error but got nil: %v", test)
+		}
+		if err != nil {
+			if test.expectError {
+				continue
+			}
+			t.Fatalf("Failed with %s for %v", err, test)
+		}
+		if len(cf.Rules) != test.expectRules {
+			t.Fatalf("Expected %d rules but got %d", test.expectRules, len(cf.Rules))
+		}
+	}
+}
+
+func TestConfigRule(t *testing.T) {
+	config := &Config{Rules: []*Rule{
+		{Name: "exact", Repo: "airbnb/k8s-webhook-handler"},
+		{Name: "org", Repo: "airbnb/*"},
+	}}
+	for repo, name := range map[string]string{
+		"airbnb/k8s-webhook-handler": "exact",
+		"Airbnb/K8s-Webhook-Handler": "exact",
+		"airbnb/foo":                 "org",
+		"other/foo":                  "",
+	} {
+		rule := config.Rule(repo)
+		if rule == nil {
+			if name != "" {
+				t.Fatalf("Expected rule %s for %s but got nil", name, repo)
+			}
+			continue
+		}
+		if rule.Name != name {
+			t.Fatalf("Expected rule %s for %s but got %s", name, repo, rule.Name)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrDeliveryNotFound is returned by DeliveryStores for unknown deliveries.
+var ErrDeliveryNotFound = errors.New("Delivery not found")
+
+// deliveryIDRegex matches valid delivery IDs. GitHub uses UUIDs.
+var deliveryIDRegex = regexp.MustCompile(`^[A-Za-z0-9-]{1,128}$`)
+
+// Delivery is a validated webhook payload.
+type Delivery struct {
+	ID        string    `json:"id"`
+	EventType string    `json:"eventType"`
+	Received  time.Time `json:"received"`
+	Payload   []byte    `json:"payload"`
+}
+
+// DeliveryStore persists deliveries, so they can be replayed.
+type DeliveryStore interface {
+	Put(delivery *Delivery) error
+	// Get returns the delivery with id or ErrDeliveryNotFound.
+	Get(id string) (*Delivery, error)
+}
+
+// DirectoryDeliveryStore stores deliveries as JSON files in a directory,
+// e.g. on a PersistentVolume. Only the most recent ones are kept.
+type DirectoryDeliveryStore struct {
+	dir string
+	max int
+	mu  sync.Mutex
+}
+
+// NewDirectoryDeliveryStore returns a store keeping the max most recent
+// deliveries in dir, which is created if needed.
+func NewDirectoryDeliveryStore(dir string, max int) (*DirectoryDeliveryStore, error) {
+	if max <= 0 {
+		return nil, fmt.Errorf("Invalid maximum number of deliveries %d", max)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &DirectoryDeliveryStore{dir: dir, max: max}, nil
+}
+
+func (s *DirectoryDeliveryStore) filename(id string) (string, error) {
+	if !deliveryIDRegex.MatchString(id) {
+		return "", fmt.Errorf("Invalid delivery ID %q", id)
+	}
+	return filepath.Join(s.dir, id+".json"), nil
+}
+
+// Put stores delivery and deletes the oldest deliveries exceeding the
+// maximum.
+func (s *DirectoryDeliveryStore) Put(delivery *Delivery) error {
+	filename, err := s.filename(delivery.ID)
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Write to a temporary file first, so Get never reads partial files.
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return err
+	}
+	// Deliveries are trimmed by modification time, so use the time they
+	// were received.
+	if !delivery.Received.IsZero() {
+		if err := os.Chtimes(filename, delivery.Received, delivery.Received); err != nil {
+			return err
+		}
+	}
+	return s.trim()
+}
+
+// trim deletes the oldest deliveries exceeding the maximum.
+func (s *DirectoryDeliveryStore) trim() error {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	deliveries := []os.FileInfo{}
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), ".json") {
+			deliveries = append(deliveries, f)
+		}
+	}
+	if len(deliveries) <= s.max {
+		return nil
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].ModTime().Before(deliveries[j].ModTime())
+	})
+	for _, f := range deliveries[:len(deliveries)-s.max] {
+		if err := os.Remove(filepath.Join(s.dir, f.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get returns the delivery with id.
+func (s *DirectoryDeliveryStore) Get(id string) (*Delivery, error) {
+	filename, err := s.filename(id)
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, ErrDeliveryNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	delivery := &Delivery{}
+	if err := json.Unmarshal(content, delivery); err != nil {
+		return nil, fmt.Errorf("Couldn't decode delivery %s: %s", id, err)
+	}
+	return delivery, nil
+}
@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDirectoryDeliveryStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deliveries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewDirectoryDeliveryStore(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	deliveries := []*Delivery{
+		{ID: "a", EventType: "push", Received: now.Add(-2 * time.Minute), Payload: []byte(`{"a":1}`)},
+		{ID: "b", EventType: "push", Received: now.Add(-time.Minute), Payload: []byte(`{"b":1}`)},
+		{ID: "c", EventType: "delete", Received: now, Payload: []byte(`{"c":1}`)},
+	}
+	for _, d := range deliveries {
+		if err := store.Put(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := store.Get("a"); err != ErrDeliveryNotFound {
+		t.Fatalf("Expected oldest delivery to be deleted but got %v", err)
+	}
+	for _, want := range deliveries[1:] {
+		got, err := store.Get(want.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Fatalf("Not Equal (-want +got):\n%s", diff)
+		}
+	}
+
+	for _, id := range []string{"", "../etc/passwd", "a/b"} {
+		if err := store.Put(&Delivery{ID: id}); err == nil {
+			t.Fatalf("Expected error for ID %q", id)
+		}
+		if _, err := store.Get(id); err == nil {
+			t.Fatalf("Expected error for ID %q", id)
+		}
+	}
+}
@@ -0,0 +1,426 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/google/go-github/v24/github"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/util/jsonpath"
+)
+
+// Deployment states reported to GitHub.
+const (
+	DeploymentInProgress = "in_progress"
+	DeploymentSuccess    = "success"
+	DeploymentFailure    = "failure"
+	DeploymentError      = "error"
+)
+
+const (
+	defaultDeploymentTimeout  = 30 * time.Minute
+	defaultDeploymentInterval = 10 * time.Second
+	// maxDescriptionLength is the maximum length of deployment status
+	// descriptions accepted by GitHub.
+	maxDescriptionLength = 140
+)
+
+// environmentRegex matches environments which can be used in paths and
+// namespaces.
+var environmentRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,62}$`)
+
+// DeploymentConfig configures how deployment events are handled.
+type DeploymentConfig struct {
+	// ResourcePath, if set, is a template of the manifest to apply instead
+	// of the global resource path, e.g. .ci/deploy-{{environment}}.yaml.
+	ResourcePath string `json:"resourcePath,omitempty"`
+	// Namespace, if set, is a template of the namespace to apply to, e.g.
+	// deploy-{{environment}}.
+	Namespace string `json:"namespace,omitempty"`
+	// APIVersion and Kind select the applied objects to watch. All applied
+	// objects are watched if empty.
+	APIVersion string `json:"apiVersion,omitempty"`
+	Kind       string `json:"kind,omitempty"`
+	// StatusPath, if set, is a JSONPath like {.status.phase}. Deployments
+	// succeed once it yields one of SuccessValues for all watched objects
+	// and fail once it yields one of FailureValues for any. Otherwise they
+	// succeed once applied.
+	StatusPath    string   `json:"statusPath,omitempty"`
+	SuccessValues []string `json:"successValues,omitempty"`
+	FailureValues []string `json:"failureValues,omitempty"`
+	// URLPath, if set, is a JSONPath yielding the environment URL from the
+	// watched objects, e.g. {.metadata.annotations.url}.
+	URLPath string `json:"urlPath,omitempty"`
+	// Timeout after which unfinished deployments fail. Defaults to 30m.
+	Timeout metav1.Duration `json:"timeout,omitempty"`
+	// Interval to check watched objects in. Defaults to 10s.
+	Interval metav1.Duration `json:"interval,omitempty"`
+}
+
+// Validate returns an error if a JSONPath is invalid or success values are
+// missing.
+func (c *DeploymentConfig) Validate() error {
+	if (c.APIVersion == "") != (c.Kind == "") {
+		return fmt.Errorf("Deployments need both apiVersion and kind or neither")
+	}
+	if c.StatusPath != "" && len(c.SuccessValues) == 0 {
+		return fmt.Errorf("Deployments with statusPath need successValues")
+	}
+	if _, err := parseJSONPath("status", c.StatusPath); err != nil {
+		return fmt.Errorf("Deployments have invalid statusPath: %s", err)
+	}
+	if _, err := parseJSONPath("url", c.URLPath); err != nil {
+		return fmt.Errorf("Deployments have invalid urlPath: %s", err)
+	}
+	return nil
+}
+
+func parseJSONPath(name, path string) (*jsonpath.JSONPath, error) {
+	if path == "" {
+		return nil, nil
+	}
+	jp := jsonpath.New(name).AllowMissingKeys(true)
+	if err := jp.Parse(path); err != nil {
+		return nil, err
+	}
+	return jp, nil
+}
+
+// DeploymentStatusClient reports the state of deployments.
+type DeploymentStatusClient interface {
+	SetDeploymentStatus(ctx context.Context, repo string, id int64, state, description, environmentURL string) error
+	// DeploymentState returns the state of the latest status of a
+	// deployment or an empty string if it has none.
+	DeploymentState(ctx context.Context, repo string, id int64) (string, error)
+}
+
+// SetDeploymentStatus creates a status for a deployment.
+func (l *GithubLoader) SetDeploymentStatus(ctx context.Context, repo string, id int64, state, description, environmentURL string) error {
+	parts := strings.SplitN(repo, "/", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("Invalid repository %q", repo)
+	}
+	request := &github.DeploymentStatusRequest{State: github.String(state), Description: github.String(description)}
+	if environmentURL != "" {
+		request.EnvironmentURL = github.String(environmentURL)
+	}
+	_, _, err := l.Client.Repositories.CreateDeploymentStatus(ctx, parts[0], parts[1], id, request)
+	return err
+}
+
+// DeploymentState returns the state of the latest status of a deployment.
+func (l *GithubLoader) DeploymentState(ctx context.Context, repo string, id int64) (string, error) {
+	parts := strings.SplitN(repo, "/", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("Invalid repository %q", repo)
+	}
+	// Statuses are listed newest first.
+	statuses, _, err := l.Client.Repositories.ListDeploymentStatuses(ctx, parts[0], parts[1], id, &github.ListOptions{PerPage: 1})
+	if err != nil || len(statuses) == 0 {
+		return "", err
+	}
+	return statuses[0].GetState(), nil
+}
+
+// DeploymentTracker reports the state of deployments to GitHub by watching
+// the objects applied for them.
+type DeploymentTracker struct {
+	log.Logger
+	client     dynamic.Interface
+	mapper     Mapper
+	statuses   DeploymentStatusClient
+	config     *DeploymentConfig
+	statusPath *jsonpath.JSONPath
+	urlPath    *jsonpath.JSONPath
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+
+	mu sync.Mutex
+	// tracked are the deployments tracked by repo and ID.
+	tracked map[string]bool
+}
+
+// NewDeploymentTracker returns a tracker for deployments handled by config.
+func NewDeploymentTracker(logger log.Logger, client dynamic.Interface, mapper Mapper, statuses DeploymentStatusClient, config *DeploymentConfig) (*DeploymentTracker, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	t := &DeploymentTracker{
+		Logger:   logger,
+		client:   client,
+		mapper:   mapper,
+		statuses: statuses,
+		config:   config,
+		tracked:  map[string]bool{},
+	}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	t.statusPath, _ = parseJSONPath("status", config.StatusPath)
+	t.urlPath, _ = parseJSONPath("url", config.URLPath)
+	return t, nil
+}
+
+// resourcePath returns the manifest to apply for event or an empty string
+// to use the global one.
+func (t *DeploymentTracker) resourcePath(event *Event) string {
+	if t.config.ResourcePath == "" {
+		return ""
+	}
+	return expand(t.config.ResourcePath, event.Vars())
+}
+
+// namespace returns the namespace to apply to for event or an empty string
+// to use the global one.
+func (t *DeploymentTracker) namespace(event *Event) string {
+	if t.config.Namespace == "" {
+		return ""
+	}
+	return NamespaceName(expand(t.config.Namespace, event.Vars()))
+}
+
+// SetStatus reports the state of event's deployment, logging failures.
+func (t *DeploymentTracker) SetStatus(ctx context.Context, event *Event, state, description, environmentURL string) {
+	if len(description) > maxDescriptionLength {
+		description = description[:maxDescriptionLength-3] + "..."
+	}
+	logger := log.With(t.Logger, "repo", event.GetFullName(), "deployment", event.DeploymentID, "state", state)
+	if err := t.statuses.SetDeploymentStatus(ctx, event.GetFullName(), event.DeploymentID, state, description, environmentURL); err != nil {
+		level.Error(logger).Log("msg", "Couldn't set deployment status", "err", err)
+		return
+	}
+	level.Info(logger).Log("msg", "Set deployment status", "description", description, "url", environmentURL)
+}
+
+// Track watches the objects applied for event's deployment in the
+// background until they finished and reports the result.
+func (t *DeploymentTracker) Track(event *Event, applied []*AppliedObject) {
+	t.start(event, applied, time.Now().Add(t.timeout()))
+}
+
+// start tracks a deployment until deadline unless it's tracked already.
+func (t *DeploymentTracker) start(event *Event, applied []*AppliedObject, deadline time.Time) bool {
+	key := event.GetFullName() + "#" + strconv.FormatInt(event.DeploymentID, 10)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.tracked[key] {
+		return false
+	}
+	t.tracked[key] = true
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		t.track(t.ctx, event, applied, deadline)
+		t.mu.Lock()
+		delete(t.tracked, key)
+		t.mu.Unlock()
+	}()
+	return true
+}
+
+// Wait blocks until all tracked deployments finished.
+func (t *DeploymentTracker) Wait() {
+	t.wg.Wait()
+}
+
+// Stop stops tracking deployments, e.g. on shutdown, and waits until all
+// trackers returned. Their deployments stay in progress until they're
+// resumed.
+func (t *DeploymentTracker) Stop() {
+	t.cancel()
+	t.wg.Wait()
+}
+
+// Resume tracks the deployments still in progress according to GitHub,
+// e.g. after a restart. Their watched objects are found by the
+// deployment_id annotation, so apiVersion and kind need to be configured
+// and the objects need to be applied as single object manifests.
+func (t *DeploymentTracker) Resume(ctx context.Context) error {
+	if t.config.Kind == "" {
+		level.Info(t.Logger).Log("msg", "Not resuming deployments, no kind to watch configured")
+		return nil
+	}
+	gv, err := schema.ParseGroupVersion(t.config.APIVersion)
+	if err != nil {
+		return err
+	}
+	mapping, err := t.mapper.RESTMapping(gv.WithKind(t.config.Kind).GroupKind(), gv.Version)
+	if err != nil {
+		return err
+	}
+	list, err := t.client.Resource(mapping.Resource).Namespace(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	type deployment struct {
+		event   *Event
+		watched []*AppliedObject
+		created time.Time
+	}
+	deployments := map[string]*deployment{}
+	keys := []string{}
+	for _, obj := range list.Items {
+		annotations := obj.GetAnnotations()
+		repo := annotations[annotationPrefix+"repo_name"]
+		id, err := strconv.ParseInt(annotations[annotationPrefix+"deployment_id"], 10, 64)
+		if repo == "" || err != nil {
+			continue
+		}
+		key := repo + "#" + strconv.FormatInt(id, 10)
+		d, ok := deployments[key]
+		if !ok {
+			d = &deployment{
+				event:   &Event{Repository: &github.Repository{FullName: github.String(repo)}, DeploymentID: id},
+				created: obj.GetCreationTimestamp().Time,
+			}
+			deployments[key] = d
+			keys = append(keys, key)
+		}
+		d.watched = append(d.watched, &AppliedObject{APIVersion: obj.GetAPIVersion(), Kind: obj.GetKind(), Namespace: obj.GetNamespace(), Name: obj.GetName(), UID: obj.GetUID()})
+		if created := obj.GetCreationTimestamp().Time; created.Before(d.created) {
+			d.created = created
+		}
+	}
+	resumed := 0
+	for _, key := range keys {
+		d := deployments[key]
+		logger := log.With(t.Logger, "repo", d.event.GetFullName(), "deployment", d.event.DeploymentID)
+		state, err := t.statuses.DeploymentState(ctx, d.event.GetFullName(), d.event.DeploymentID)
+		if err != nil {
+			level.Warn(logger).Log("msg", "Couldn't get deployment state", "err", err)
+			continue
+		}
+		if state != DeploymentInProgress {
+			continue
+		}
+		if t.start(d.event, d.watched, d.created.Add(t.timeout())) {
+			level.Info(logger).Log("msg", "Resumed tracking deployment")
+			resumed++
+		}
+	}
+	level.Info(t.Logger).Log("msg", "Resumed deployments", "count", resumed)
+	return nil
+}
+
+func (t *DeploymentTracker) timeout() time.Duration {
+	if t.config.Timeout.Duration <= 0 {
+		return defaultDeploymentTimeout
+	}
+	return t.config.Timeout.Duration
+}
+
+func (t *DeploymentTracker) track(ctx context.Context, event *Event, applied []*AppliedObject, deadline time.Time) {
+	interval := t.config.Interval.Duration
+	if interval <= 0 {
+		interval = defaultDeploymentInterval
+	}
+	watched := []*AppliedObject{}
+	for _, obj := range applied {
+		if t.config.Kind == "" || (obj.APIVersion == t.config.APIVersion && obj.Kind == t.config.Kind) {
+			watched = append(watched, obj)
+		}
+	}
+	// Without objects to watch, the deployment would succeed right away.
+	if len(watched) == 0 {
+		description := "No objects applied"
+		if t.config.Kind != "" {
+			description = fmt.Sprintf("No %s %s applied", t.config.APIVersion, t.config.Kind)
+		}
+		t.SetStatus(ctx, event, DeploymentFailure, description, "")
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var url string
+	for {
+		state, description, u, err := t.check(watched)
+		if u != "" {
+			url = u
+		}
+		if err != nil {
+			level.Warn(t.Logger).Log("msg", "Couldn't check deployed objects", "deployment", event.DeploymentID, "err", err)
+		} else if state != "" {
+			t.SetStatus(ctx, event, state, description, url)
+			return
+		}
+		if time.Now().After(deadline) {
+			t.SetStatus(ctx, event, DeploymentFailure, fmt.Sprintf("Timed out after %s", t.timeout()), url)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			level.Info(t.Logger).Log("msg", "Stopped tracking deployment", "deployment", event.DeploymentID)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check returns the state of the deployment if it finished, a description
+// and the environment URL if found.
+func (t *DeploymentTracker) check(watched []*AppliedObject) (state, description, url string, err error) {
+	succeeded := 0
+	for _, obj := range watched {
+		gv, err := schema.ParseGroupVersion(obj.APIVersion)
+		if err != nil {
+			return "", "", url, err
+		}
+		mapping, err := t.mapper.RESTMapping(gv.WithKind(obj.Kind).GroupKind(), gv.Version)
+		if err != nil {
+			return "", "", url, err
+		}
+		current, err := t.client.Resource(mapping.Resource).Namespace(obj.Namespace).Get(obj.Name, metav1.GetOptions{})
+		if err != nil {
+			return "", "", url, err
+		}
+		if url == "" && t.urlPath != nil {
+			url = evalJSONPath(t.urlPath, current.Object)
+		}
+		if t.statusPath == nil {
+			succeeded++
+			continue
+		}
+		switch value := evalJSONPath(t.statusPath, current.Object); {
+		case containsValue(t.config.FailureValues, value):
+			return DeploymentFailure, fmt.Sprintf("%s is %s", obj, value), url, nil
+		case containsValue(t.config.SuccessValues, value):
+			succeeded++
+		}
+	}
+	if succeeded < len(watched) {
+		return "", "", url, nil
+	}
+	return DeploymentSuccess, "Deployed successfully", url, nil
+}
+
+// evalJSONPath returns the result of path for obj or an empty string.
+func evalJSONPath(path *jsonpath.JSONPath, obj map[string]interface{}) string {
+	buf := &bytes.Buffer{}
+	if err := path.Execute(buf, obj); err != nil {
+		return ""
+	}
+	return buf.String()
+}
+
+func containsValue(values []string, value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,369 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-github/v24/github"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/fake"
+)
+
+type mockStatusClient struct {
+	sync.Mutex
+	states       []string
+	descriptions []string
+	url          string
+	err          error
+	// latest are the states returned by DeploymentState by deployment.
+	latest map[int64]string
+}
+
+func (c *mockStatusClient) SetDeploymentStatus(ctx context.Context, repo string, id int64, state, description, environmentURL string) error {
+	c.Lock()
+	defer c.Unlock()
+	c.states = append(c.states, state)
+	c.descriptions = append(c.descriptions, description)
+	c.url = environmentURL
+	return c.err
+}
+
+// anchoredClient fails creating run anchors which already exist, like the
+// API server does for redeliveries. Other objects fail with err if set.
+type anchoredClient struct {
+	*mockKubernetesClient
+	anchors map[string]bool
+	err     error
+}
+
+func (k *anchoredClient) Apply(ctx context.Context, obj runtime.Object, opts *ApplyOptions) ([]*AppliedObject, error) {
+	if u, ok := obj.(*unstructured.Unstructured); ok && strings.HasPrefix(u.GetName(), anchorPrefix) {
+		if k.anchors[u.GetName()] {
+			return nil, apierrors.NewAlreadyExists(schema.GroupResource{Resource: "configmaps"}, u.GetName())
+		}
+		if k.anchors == nil {
+			k.anchors = map[string]bool{}
+		}
+		k.anchors[u.GetName()] = true
+	} else if k.err != nil {
+		return nil, k.err
+	}
+	return k.mockKubernetesClient.Apply(ctx, obj, opts)
+}
+
+func (k *anchoredClient) Delete(ctx context.Context, obj *AppliedObject) error {
+	delete(k.anchors, obj.Name)
+	return k.mockKubernetesClient.Delete(ctx, obj)
+}
+
+func (c *mockStatusClient) DeploymentState(ctx context.Context, repo string, id int64) (string, error) {
+	return c.latest[id], c.err
+}
+
+// deployedWorkflow returns a client with a deployed workflow in phase.
+// It's created with the resource fakeRESTMapper maps workflows to.
+func deployedWorkflow(t *testing.T, phase string) dynamic.Interface {
+	obj := workflow()
+	obj.SetNamespace("deploy-staging")
+	obj.SetName("hello-world-abcde")
+	obj.SetAnnotations(map[string]string{"url": "https://staging.example.com"})
+	obj.Object["status"] = map[string]interface{}{"phase": phase}
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme())
+	resource := schema.GroupVersionResource{Group: "argoproj.io", Resource: "workflows"}
+	if _, err := client.Resource(resource).Namespace("deploy-staging").Create(obj, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestDeploymentConfigValidate(t *testing.T) {
+	for _, test := range []struct {
+		config      *DeploymentConfig
+		expectError bool
+	}{
+		{&DeploymentConfig{}, false},
+		{&DeploymentConfig{APIVersion: "argoproj.io/v1alpha1", Kind: "Workflow", StatusPath: "{.status.phase}", SuccessValues: []string{"Succeeded"}, URLPath: "{.metadata.annotations.url}"}, false},
+		{&DeploymentConfig{Kind: "Workflow"}, true},
+		{&DeploymentConfig{StatusPath: "{.status.phase}"}, true},
+		{&DeploymentConfig{StatusPath: "{.status", SuccessValues: []string{"Succeeded"}}, true},
+		{&DeploymentConfig{URLPath: "{.metadata"}, true},
+	} {
+		if err := test.config.Validate(); (err != nil) != test.expectError {
+			t.Errorf("Expected error to be %t for %#v but got %v", test.expectError, test.config, err)
+		}
+	}
+}
+
+func TestDeploymentTrackerTrack(t *testing.T) {
+	applied := []*AppliedObject{
+		{APIVersion: "v1", Kind: "ConfigMap", Namespace: "deploy-staging", Name: "config"},
+		{APIVersion: "argoproj.io/v1alpha1", Kind: "Workflow", Namespace: "deploy-staging", Name: "hello-world-abcde"},
+	}
+	for _, test := range []struct {
+		name    string
+		phase   string
+		applied []*AppliedObject
+		states  []string
+		url     string
+	}{
+		{"succeeded", "Succeeded", nil, []string{DeploymentSuccess}, "https://staging.example.com"},
+		{"failed", "Failed", nil, []string{DeploymentFailure}, "https://staging.example.com"},
+		{"timed out", "Running", nil, []string{DeploymentFailure}, "https://staging.example.com"},
+		{"nothing watched", "Succeeded", applied[:1], []string{DeploymentFailure}, ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			statuses := &mockStatusClient{}
+			client := deployedWorkflow(t, test.phase)
+			tracker, err := NewDeploymentTracker(log.NewNopLogger(), client, &fakeRESTMapper{}, statuses, &DeploymentConfig{
+				APIVersion:    "argoproj.io/v1alpha1",
+				Kind:          "Workflow",
+				StatusPath:    "{.status.phase}",
+				SuccessValues: []string{"Succeeded"},
+				FailureValues: []string{"Failed", "Error"},
+				URLPath:       "{.metadata.annotations.url}",
+				Timeout:       metav1.Duration{Duration: 10 * time.Millisecond},
+				Interval:      metav1.Duration{Duration: time.Millisecond},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			objects := applied
+			if test.applied != nil {
+				objects = test.applied
+			}
+			tracker.Track(&Event{Repository: &github.Repository{FullName: github.String("foo/bar")}, DeploymentID: 42}, objects)
+			tracker.Wait()
+			if diff := cmp.Diff(test.states, statuses.states); diff != "" {
+				t.Fatalf("Unexpected states (-want +got):\n%s", diff)
+			}
+			if statuses.url != test.url {
+				t.Fatalf("Expected environment URL %s but got %s", test.url, statuses.url)
+			}
+		})
+	}
+}
+
+func TestDeploymentTrackerResume(t *testing.T) {
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme())
+	resource := schema.GroupVersionResource{Group: "argoproj.io", Resource: "workflows"}
+	for id, name := range map[int64]string{1: "finished", 2: "in-progress", 0: "other"} {
+		obj := workflow()
+		obj.SetNamespace("deploy-staging")
+		obj.SetName(name)
+		obj.SetCreationTimestamp(metav1.Now())
+		obj.Object["status"] = map[string]interface{}{"phase": "Succeeded"}
+		if id != 0 {
+			obj.SetAnnotations(map[string]string{
+				annotationPrefix + "repo_name":     "foo/bar",
+				annotationPrefix + "deployment_id": strconv.FormatInt(id, 10),
+			})
+		}
+		if _, err := client.Resource(resource).Namespace("deploy-staging").Create(obj, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	statuses := &mockStatusClient{latest: map[int64]string{1: DeploymentSuccess, 2: DeploymentInProgress}}
+	tracker, err := NewDeploymentTracker(log.NewNopLogger(), client, &fakeRESTMapper{}, statuses, &DeploymentConfig{
+		APIVersion:    "argoproj.io/v1alpha1",
+		Kind:          "Workflow",
+		StatusPath:    "{.status.phase}",
+		SuccessValues: []string{"Succeeded"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tracker.Resume(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	tracker.Wait()
+	// Only the deployment in progress is resumed and reported.
+	if diff := cmp.Diff([]string{DeploymentSuccess}, statuses.states); diff != "" {
+		t.Fatalf("Unexpected states (-want +got):\n%s", diff)
+	}
+}
+
+func TestDeploymentTrackerStop(t *testing.T) {
+	statuses := &mockStatusClient{}
+	tracker, err := NewDeploymentTracker(log.NewNopLogger(), deployedWorkflow(t, "Running"), &fakeRESTMapper{}, statuses, &DeploymentConfig{
+		StatusPath:    "{.status.phase}",
+		SuccessValues: []string{"Succeeded"},
+		Interval:      metav1.Duration{Duration: time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker.Track(&Event{Repository: &github.Repository{FullName: github.String("foo/bar")}, DeploymentID: 42}, []*AppliedObject{
+		{APIVersion: "argoproj.io/v1alpha1", Kind: "Workflow", Namespace: "deploy-staging", Name: "hello-world-abcde"},
+	})
+	tracker.Stop()
+	// Stopped deployments stay in progress to be resumed.
+	if len(statuses.states) != 0 {
+		t.Fatalf("Expected no states but got %v", statuses.states)
+	}
+}
+
+func TestHandleDeployment(t *testing.T) {
+	deployment := func(env string) *github.DeploymentEvent {
+		return &github.DeploymentEvent{
+			Deployment: &github.Deployment{ID: github.Int64(42), SHA: github.String("abc"), Ref: github.String("master"), Task: github.String("deploy"), Environment: github.String(env)},
+			Repo:       &github.Repository{FullName: github.String("foo/bar"), GitURL: github.String("git://github.com/foo/bar.git"), SSHURL: github.String("git@github.com:foo/bar.git")},
+		}
+	}
+	newHandler := func(kc *mockKubernetesClient, loader *mockLoader, statuses *mockStatusClient) *Handler {
+		handler := NewGithubHookHandler(log.NewNopLogger(), &Config{Namespace: "ci", ResourcePath: ".ci/workflow.yaml"}, kc, loader, newTestMetrics())
+		tracker, err := NewDeploymentTracker(log.NewNopLogger(), deployedWorkflow(t, "Succeeded"), &fakeRESTMapper{}, statuses, &DeploymentConfig{
+			ResourcePath: ".ci/deploy-{{environment}}.yaml",
+			Namespace:    "deploy-{{environment}}",
+			URLPath:      "{.metadata.annotations.url}",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler.Deployments = tracker
+		return handler
+	}
+
+	t.Run("applied", func(t *testing.T) {
+		kc, loader, statuses := &mockKubernetesClient{}, &mockLoader{}, &mockStatusClient{}
+		handler := newHandler(kc, loader, statuses)
+		hr, err := handler.HandleEvent(context.Background(), deployment("staging"))
+		if err != nil {
+			t.Fatalf("Unexpected error %v: %v", err, hr)
+		}
+		handler.Deployments.Wait()
+		if loader.path != ".ci/deploy-staging.yaml" {
+			t.Fatalf("Expected .ci/deploy-staging.yaml to be loaded but got %s", loader.path)
+		}
+		if kc.namespace != "deploy-staging" {
+			t.Fatalf("Expected namespace deploy-staging but got %s", kc.namespace)
+		}
+		annotations := kc.obj.(*unstructured.Unstructured).GetAnnotations()
+		for k, v := range map[string]string{
+			"event_type":    "deployment",
+			"event_action":  "deploy",
+			"revision":      "abc",
+			"environment":   "staging",
+			"deployment_id": "42",
+		} {
+			if annotations[annotationPrefix+k] != v {
+				t.Errorf("Expected annotation %s=%s but got %v", k, v, annotations)
+			}
+		}
+		// Without statusPath, deployments succeed once the objects exist.
+		if diff := cmp.Diff([]string{DeploymentInProgress, DeploymentSuccess}, statuses.states); diff != "" {
+			t.Fatalf("Unexpected states (-want +got):\n%s", diff)
+		}
+		if statuses.url != "https://staging.example.com" {
+			t.Fatalf("Expected environment URL but got %q", statuses.url)
+		}
+	})
+
+	t.Run("apply failed", func(t *testing.T) {
+		kc, statuses := &mockKubernetesClient{err: errors.New("denied")}, &mockStatusClient{}
+		handler := newHandler(kc, &mockLoader{}, statuses)
+		if _, err := handler.HandleEvent(context.Background(), deployment("staging")); err == nil {
+			t.Fatal("Expected error")
+		}
+		if diff := cmp.Diff([]string{DeploymentInProgress, DeploymentError}, statuses.states); diff != "" {
+			t.Fatalf("Unexpected states (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("redelivered", func(t *testing.T) {
+		kc, statuses := &anchoredClient{mockKubernetesClient: &mockKubernetesClient{}}, &mockStatusClient{}
+		handler := newHandler(kc.mockKubernetesClient, &mockLoader{}, statuses)
+		handler.KubernetesClient = kc
+		handler.Config.RunAnchor = RunAnchorConfigMap
+		ctx := WithDeliveryID(context.Background(), "1234")
+		if _, err := handler.HandleEvent(ctx, deployment("staging")); err != nil {
+			t.Fatal(err)
+		}
+		handler.Deployments.Wait()
+		hr, err := handler.HandleEvent(ctx, deployment("staging"))
+		if err == nil || hr.code != CodeAlreadyHandled {
+			t.Fatalf("Expected %s but got %v: %v", CodeAlreadyHandled, hr, err)
+		}
+		if diff := cmp.Diff([]string{DeploymentInProgress, DeploymentSuccess}, statuses.states); diff != "" {
+			t.Fatalf("Unexpected states (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("admission findings", func(t *testing.T) {
+		policies, err := NewAdmissionPolicies([]*AdmissionRule{
+			{Name: "spec", Action: ActionWarn, CEL: `has(object.spec)`, Message: "No spec"},
+			{Name: "generate-name", CEL: `object.metadata.generateName != "forbidden-"`, Message: "Forbidden name"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		statuses := &mockStatusClient{}
+		handler := newHandler(&mockKubernetesClient{}, &mockLoader{}, statuses)
+		handler.AdmissionPolicies = policies
+		if _, err := handler.HandleEvent(context.Background(), deployment("staging")); err != nil {
+			t.Fatal(err)
+		}
+		handler.Deployments.Wait()
+		if want := "Applying manifest, admission findings: warn: Workflow/hello-world-*: No spec (spec)"; statuses.descriptions[0] != want {
+			t.Fatalf("Expected description %q but got %q", want, statuses.descriptions[0])
+		}
+
+		forbidden := workflow()
+		forbidden.SetGenerateName("forbidden-")
+		statuses = &mockStatusClient{}
+		handler = newHandler(&mockKubernetesClient{}, &mockLoader{obj: forbidden}, statuses)
+		handler.AdmissionPolicies = policies
+		if _, err := handler.HandleEvent(context.Background(), deployment("staging")); err == nil {
+			t.Fatal("Expected error")
+		}
+		if diff := cmp.Diff([]string{DeploymentError}, statuses.states); diff != "" {
+			t.Fatalf("Unexpected states (-want +got):\n%s", diff)
+		}
+		if want := "Manifest denied by admission policy: warn: Workflow/forbidden-*: No spec (spec), deny: Workflow/forbidden-*: Forbidden name (generate-name)"; statuses.descriptions[0] != want {
+			t.Fatalf("Expected description %q but got %q", want, statuses.descriptions[0])
+		}
+	})
+
+	t.Run("load failed", func(t *testing.T) {
+		statuses := &mockStatusClient{}
+		handler := newHandler(&mockKubernetesClient{}, &mockLoader{err: errors.New("not found")}, statuses)
+		if _, err := handler.HandleEvent(context.Background(), deployment("staging")); err == nil {
+			t.Fatal("Expected error")
+		}
+		if diff := cmp.Diff([]string{DeploymentError}, statuses.states); diff != "" {
+			t.Fatalf("Unexpected states (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("invalid environment", func(t *testing.T) {
+		kc, statuses := &mockKubernetesClient{}, &mockStatusClient{}
+		handler := newHandler(kc, &mockLoader{}, statuses)
+		hr, err := handler.HandleEvent(context.Background(), deployment("../prod"))
+		if err == nil || hr.code != CodeInvalidPayload {
+			t.Fatalf("Expected invalid payload but got %v: %v", hr, err)
+		}
+		if len(kc.applied) != 0 || len(statuses.states) != 0 {
+			t.Fatalf("Expected nothing to be applied or reported but got %v, %v", kc.applied, statuses.states)
+		}
+	})
+
+	t.Run("not enabled", func(t *testing.T) {
+		kc := &mockKubernetesClient{}
+		handler := NewGithubHookHandler(log.NewNopLogger(), &Config{Namespace: "ci"}, kc, &mockLoader{}, newTestMetrics())
+		hr, err := handler.HandleEvent(context.Background(), deployment("staging"))
+		if err != nil || hr.outcome != ResponseIgnored {
+			t.Fatalf("Expected deployment to be ignored but got %v: %v", hr, err)
+		}
+	})
+}
@@ -0,0 +1,253 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+
+	"github.com/google/go-github/v24/github"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	// inputAnnotationPrefix is the prefix of annotations holding dispatch
+	// inputs.
+	inputAnnotationPrefix = "inputs." + annotationPrefix
+
+	inputsPrefix = "webhook-inputs-"
+)
+
+// inputNameRegex matches input names valid as annotation name and
+// ConfigMap key.
+var inputNameRegex = regexp.MustCompile(`^[A-Za-z0-9]([-._A-Za-z0-9]{0,61}[A-Za-z0-9])?$`)
+
+// RepositoryDispatchEvent is sent for repository_dispatch API calls. It's
+// not supported by go-github v24.
+type RepositoryDispatchEvent struct {
+	// Action is the event_type passed by the caller.
+	Action        *string                `json:"action,omitempty"`
+	Branch        *string                `json:"branch,omitempty"`
+	ClientPayload map[string]interface{} `json:"client_payload,omitempty"`
+	Repo          *github.Repository     `json:"repository,omitempty"`
+	Sender        *github.User           `json:"sender,omitempty"`
+}
+
+// WorkflowDispatchEvent is sent for workflow_dispatch API calls. It's not
+// supported by go-github v24.
+type WorkflowDispatchEvent struct {
+	Inputs   map[string]interface{} `json:"inputs,omitempty"`
+	Ref      *string                `json:"ref,omitempty"`
+	Workflow *string                `json:"workflow,omitempty"`
+	Repo     *github.Repository     `json:"repository,omitempty"`
+	Sender   *github.User           `json:"sender,omitempty"`
+}
+
+// parseWebHook parses payload of eventType like github.ParseWebHook, adding
+// the dispatch events.
+func parseWebHook(eventType string, payload []byte) (interface{}, error) {
+	var event interface{}
+	switch eventType {
+	case "repository_dispatch":
+		event = &RepositoryDispatchEvent{}
+	case "workflow_dispatch":
+		event = &WorkflowDispatchEvent{}
+	default:
+		return github.ParseWebHook(eventType, payload)
+	}
+	return event, json.Unmarshal(payload, event)
+}
+
+// DispatchEvent is a synthetic event for dispatch events with the ref
+// resolved to its commit.
+type DispatchEvent struct {
+	// Type is repository_dispatch or workflow_dispatch.
+	Type       string
+	Action     string
+	Repository *github.Repository
+	Ref        string
+	Revision   string
+	Inputs     map[string]interface{}
+}
+
+// dispatchEvent returns the DispatchEvent for a RepositoryDispatchEvent or
+// WorkflowDispatchEvent. If the event can't be handled, a response is
+// returned instead.
+func (h *Handler) dispatchEvent(ctx context.Context, ev interface{}) (*DispatchEvent, *handlerResponse, error) {
+	event := &DispatchEvent{}
+	switch e := ev.(type) {
+	case *RepositoryDispatchEvent:
+		event.Type, event.Action, event.Repository, event.Inputs = "repository_dispatch", e.GetAction(), e.Repo, e.ClientPayload
+		event.Ref = branchToRef(e.GetBranch())
+	case *WorkflowDispatchEvent:
+		event.Type, event.Repository, event.Inputs = "workflow_dispatch", e.Repo, e.Inputs
+		event.Ref = normalizeRef(e.GetRef())
+	default:
+		return nil, &handlerResponse{status: http.StatusBadRequest, code: CodeUnsupportedEvent, message: "Invalid/unsupported event"}, ErrEventNotSupported
+	}
+	if event.Repository == nil || shortRef(event.Ref) == "" {
+		return nil, &handlerResponse{status: http.StatusBadRequest, code: CodeInvalidPayload, message: "Event has no repository or ref"}, ErrEventInvalid
+	}
+	if event.Inputs == nil {
+		event.Inputs = map[string]interface{}{}
+	}
+	if h.Refs == nil {
+		return nil, &handlerResponse{code: CodeInternal, message: "Dispatch events not enabled"}, errors.New("No ref resolver configured")
+	}
+	_, revision, err := h.Refs.ResolveRef(ctx, event.Repository.GetFullName(), event.Ref)
+	if err != nil {
+		if isRefNotFound(err) {
+			return nil, &handlerResponse{status: http.StatusNotFound, code: CodeRefNotFound, message: "Ref not found"}, err
+		}
+		return nil, &handlerResponse{status: http.StatusBadGateway, code: CodeResolveFailed, message: "Couldn't resolve ref"}, err
+	}
+	event.Revision = revision
+	return event, nil, nil
+}
+
+// GetAction returns the Action field if it's non-nil, zero value otherwise.
+func (e *RepositoryDispatchEvent) GetAction() string {
+	if e == nil || e.Action == nil {
+		return ""
+	}
+	return *e.Action
+}
+
+// GetBranch returns the Branch field if it's non-nil, zero value otherwise.
+func (e *RepositoryDispatchEvent) GetBranch() string {
+	if e == nil || e.Branch == nil {
+		return ""
+	}
+	return *e.Branch
+}
+
+// GetRef returns the Ref field if it's non-nil, zero value otherwise.
+func (e *WorkflowDispatchEvent) GetRef() string {
+	if e == nil || e.Ref == nil {
+		return ""
+	}
+	return *e.Ref
+}
+
+// inputValues returns the inputs as strings. Values which aren't strings
+// are JSON encoded.
+func inputValues(inputs map[string]interface{}) map[string]string {
+	values := make(map[string]string, len(inputs))
+	for k, v := range inputs {
+		if s, ok := v.(string); ok {
+			values[k] = s
+			continue
+		}
+		content, _ := json.Marshal(v)
+		values[k] = string(content)
+	}
+	return values
+}
+
+// InputSpec declares an input dispatch events may pass.
+type InputSpec struct {
+	Name string `json:"name"`
+	// Pattern, if set, is a regular expression the whole value needs to
+	// match.
+	Pattern  string `json:"pattern,omitempty"`
+	Required bool   `json:"required,omitempty"`
+}
+
+// Validate returns an error if the name or pattern are invalid.
+func (s *InputSpec) Validate() error {
+	if !inputNameRegex.MatchString(s.Name) {
+		return fmt.Errorf("Invalid input name %q", s.Name)
+	}
+	if _, err := s.pattern(); err != nil {
+		return fmt.Errorf("Input %s has invalid pattern: %s", s.Name, err)
+	}
+	return nil
+}
+
+func (s *InputSpec) pattern() (*regexp.Regexp, error) {
+	if s.Pattern == "" {
+		return nil, nil
+	}
+	return regexp.Compile(`^(?:` + s.Pattern + `)$`)
+}
+
+// checkInputs returns the violations of inputs against specs. Undeclared
+// inputs are violations.
+func checkInputs(specs []*InputSpec, inputs map[string]string) []string {
+	violations := []string{}
+	declared := map[string]bool{}
+	for _, spec := range specs {
+		declared[spec.Name] = true
+		value, ok := inputs[spec.Name]
+		if !ok {
+			if spec.Required {
+				violations = append(violations, fmt.Sprintf("Input %s is required", spec.Name))
+			}
+			continue
+		}
+		pattern, err := spec.pattern()
+		if err != nil {
+			violations = append(violations, fmt.Sprintf("Input %s has invalid pattern: %s", spec.Name, err))
+			continue
+		}
+		if pattern != nil && !pattern.MatchString(value) {
+			violations = append(violations, fmt.Sprintf("Input %s doesn't match %s", spec.Name, spec.Pattern))
+		}
+	}
+	undeclared := []string{}
+	for name := range inputs {
+		if !declared[name] {
+			undeclared = append(undeclared, name)
+		}
+	}
+	sort.Strings(undeclared)
+	for _, name := range undeclared {
+		violations = append(violations, fmt.Sprintf("Input %s is not declared", name))
+	}
+	return violations
+}
+
+// inputsConfigMapName returns the name of the ConfigMap holding the inputs
+// of delivery.
+func inputsConfigMapName(delivery string) string {
+	return NamespaceName(inputsPrefix + delivery)
+}
+
+// inputsConfigMap returns a ConfigMap holding the event's inputs, so
+// workloads can mount them or reference them in env.
+func inputsConfigMap(event *Event, delivery string) (*unstructured.Unstructured, error) {
+	labels, _ := namespaceLabels(event)
+	annotations := event.Annotations()
+	annotations[DeliveryAnnotation] = delivery
+
+	cm := &unstructured.Unstructured{}
+	cm.SetAPIVersion("v1")
+	cm.SetKind("ConfigMap")
+	cm.SetName(inputsConfigMapName(delivery))
+	cm.SetLabels(labels)
+	cm.SetAnnotations(annotations)
+	if err := unstructured.SetNestedStringMap(cm.Object, event.Inputs, "data"); err != nil {
+		return nil, err
+	}
+	return cm, nil
+}
+
+// withInputsConfigMap returns a list of the ConfigMap with the event's
+// inputs and the objects of obj, so they're applied together.
+func withInputsConfigMap(obj runtime.Object, event *Event, delivery string) (runtime.Object, error) {
+	cm, err := inputsConfigMap(event, delivery)
+	if err != nil {
+		return nil, err
+	}
+	list := &unstructured.UnstructuredList{Object: map[string]interface{}{"apiVersion": "v1", "kind": "List"}}
+	list.Items = append(list.Items, *cm)
+	err = eachObject(obj, func(o *unstructured.Unstructured) error {
+		list.Items = append(list.Items, *o)
+		return nil
+	})
+	return list, err
+}
@@ -0,0 +1,197 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+var dispatchRepository = map[string]interface{}{
+	"full_name": "foo/bar",
+	"git_url":   "git://github.com/foo/bar.git",
+	"ssh_url":   "git@github.com:foo/bar.git",
+}
+
+func TestParseWebHookDispatch(t *testing.T) {
+	ev, err := parseWebHook("repository_dispatch", []byte(`{"action": "deploy", "branch": "master", "client_payload": {"env": "staging", "replicas": 3}, "repository": {"full_name": "foo/bar"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd, ok := ev.(*RepositoryDispatchEvent)
+	if !ok || rd.GetAction() != "deploy" || rd.GetBranch() != "master" || rd.Repo.GetFullName() != "foo/bar" {
+		t.Fatalf("Unexpected event %#v", ev)
+	}
+	if diff := cmp.Diff(map[string]string{"env": "staging", "replicas": "3"}, inputValues(rd.ClientPayload)); diff != "" {
+		t.Fatalf("Unexpected inputs (-want +got):\n%s", diff)
+	}
+
+	ev, err = parseWebHook("workflow_dispatch", []byte(`{"ref": "refs/heads/main", "inputs": {"env": "prod"}, "repository": {"full_name": "foo/bar"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wd, ok := ev.(*WorkflowDispatchEvent); !ok || wd.GetRef() != "refs/heads/main" || wd.Inputs["env"] != "prod" {
+		t.Fatalf("Unexpected event %#v", ev)
+	}
+
+	if _, err := parseWebHook("push", pushPayload); err != nil {
+		t.Fatalf("Expected other events to be parsed by go-github but got: %s", err)
+	}
+}
+
+func TestCheckInputs(t *testing.T) {
+	specs := []*InputSpec{
+		{Name: "env", Pattern: "staging|prod", Required: true},
+		{Name: "replicas", Pattern: "[0-9]+"},
+	}
+	for _, test := range []struct {
+		inputs     map[string]string
+		violations []string
+	}{
+		{map[string]string{"env": "prod", "replicas": "3"}, []string{}},
+		{map[string]string{"env": "staging"}, []string{}},
+		{map[string]string{}, []string{"Input env is required"}},
+		{map[string]string{"env": "production"}, []string{"Input env doesn't match staging|prod"}},
+		{map[string]string{"env": "prod", "replicas": "3; rm -rf /"}, []string{"Input replicas doesn't match [0-9]+"}},
+		{map[string]string{"env": "prod", "token": "x", "debug": "1"}, []string{"Input debug is not declared", "Input token is not declared"}},
+	} {
+		if diff := cmp.Diff(test.violations, checkInputs(specs, test.inputs)); diff != "" {
+			t.Errorf("Unexpected violations for %v (-want +got):\n%s", test.inputs, diff)
+		}
+	}
+	if err := (&InputSpec{Name: "-env"}).Validate(); err == nil {
+		t.Fatal("Expected invalid name to be rejected")
+	}
+	if err := (&InputSpec{Name: "env", Pattern: "("}).Validate(); err == nil {
+		t.Fatal("Expected invalid pattern to be rejected")
+	}
+}
+
+func TestHandleDispatch(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		eventType string
+		payload   map[string]interface{}
+		status    int
+		code      ErrorCode
+		ref       string
+		action    string
+		policy    *Policy
+	}{
+		{
+			name:      "repository dispatch",
+			eventType: "repository_dispatch",
+			payload:   map[string]interface{}{"action": "deploy", "branch": "master", "client_payload": map[string]interface{}{"env": "staging"}, "repository": dispatchRepository},
+			status:    http.StatusOK,
+			ref:       "refs/heads/master",
+			action:    "deploy",
+		},
+		{
+			name:      "workflow dispatch",
+			eventType: "workflow_dispatch",
+			payload:   map[string]interface{}{"ref": "refs/heads/main", "inputs": map[string]interface{}{"env": "staging"}, "repository": dispatchRepository},
+			status:    http.StatusOK,
+			ref:       "refs/heads/main",
+		},
+		{
+			name:      "invalid input",
+			eventType: "repository_dispatch",
+			payload:   map[string]interface{}{"action": "deploy", "branch": "master", "client_payload": map[string]interface{}{"env": "prod"}, "repository": dispatchRepository},
+			status:    http.StatusBadRequest,
+			code:      CodeInvalidInputs,
+		},
+		{
+			name:      "inputs ConfigMap denied by policy",
+			eventType: "repository_dispatch",
+			payload:   map[string]interface{}{"action": "deploy", "branch": "master", "client_payload": map[string]interface{}{"env": "staging"}, "repository": dispatchRepository},
+			policy:    &Policy{AllowedKinds: []string{"argoproj.io/*/Workflow"}},
+			status:    http.StatusForbidden,
+			code:      CodePolicyDenied,
+		},
+		{
+			name:      "no ref",
+			eventType: "workflow_dispatch",
+			payload:   map[string]interface{}{"inputs": map[string]interface{}{"env": "staging"}, "repository": dispatchRepository},
+			status:    http.StatusBadRequest,
+			code:      CodeInvalidPayload,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			config := &Config{
+				Namespace: "ci",
+				Insecure:  true,
+				Rules:     []*Rule{{Name: "foo", Repo: "foo/*", Inputs: []*InputSpec{{Name: "env", Pattern: "staging"}}, Policy: test.policy}},
+			}
+			obj := workflow()
+			obj.Object["spec"] = map[string]interface{}{"environment": "{{input.env}}", "configMap": "{{inputs_configmap}}"}
+			kc := &mockKubernetesClient{}
+			handler := NewGithubHookHandler(log.NewNopLogger(), config, kc, &mockLoader{obj: obj}, newTestMetrics())
+			resolver := &mockResolver{}
+			handler.Refs = resolver
+
+			payload, err := json.Marshal(test.payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := newRequest(test.eventType, payload, "")
+			req.Header.Set("X-GitHub-Delivery", "1234")
+			req.Header.Set("Accept", "application/json")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != test.status {
+				t.Fatalf("Expected status %d but got %d: %s", test.status, w.Code, w.Body.String())
+			}
+			if test.code != "" {
+				resp := &Response{}
+				if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+					t.Fatal(err)
+				}
+				if resp.Error == nil || resp.Error.Code != test.code {
+					t.Fatalf("Expected error code %s but got %s", test.code, w.Body.String())
+				}
+				if len(kc.applied) != 0 {
+					t.Fatalf("Expected nothing to be applied but got %d objects", len(kc.applied))
+				}
+				return
+			}
+
+			if resolver.ref != test.ref {
+				t.Fatalf("Expected %s to be resolved but got %s", test.ref, resolver.ref)
+			}
+			// The inputs ConfigMap is applied with the manifest, so atomic
+			// mode rolls it back too.
+			if len(kc.applied) != 1 {
+				t.Fatalf("Expected 1 apply but got %d", len(kc.applied))
+			}
+			list := kc.applied[0].(*unstructured.UnstructuredList)
+			if len(list.Items) != 2 {
+				t.Fatalf("Expected inputs ConfigMap and manifest but got %d objects", len(list.Items))
+			}
+			cm := &list.Items[0]
+			data, _, _ := unstructured.NestedStringMap(cm.Object, "data")
+			if cm.GetKind() != "ConfigMap" || cm.GetName() != "webhook-inputs-1234" || data["env"] != "staging" {
+				t.Fatalf("Unexpected inputs ConfigMap %v", cm)
+			}
+			applied := &list.Items[1]
+			if diff := cmp.Diff(map[string]interface{}{"environment": "staging", "configMap": "webhook-inputs-1234"}, applied.Object["spec"]); diff != "" {
+				t.Fatalf("Unexpected expanded manifest (-want +got):\n%s", diff)
+			}
+			annotations := applied.GetAnnotations()
+			for k, v := range map[string]string{
+				annotationPrefix + "event_type":   test.eventType,
+				annotationPrefix + "event_action": test.action,
+				annotationPrefix + "ref":          test.ref,
+				annotationPrefix + "revision":     "abc",
+				inputAnnotationPrefix + "env":     "staging",
+			} {
+				if annotations[k] != v {
+					t.Errorf("Expected annotation %s=%s but got %v", k, v, annotations)
+				}
+			}
+		})
+	}
+}
@@ -2,6 +2,8 @@ package handler
 
 import (
 	"errors"
+	"strconv"
+	"strings"
 
 	"github.com/google/go-github/v24/github"
 )
@@ -17,11 +19,21 @@ type Event struct {
 	Revision string
 	Ref      string
 	Before   string
+	// Sender is the identity triggering manual events.
+	Sender string `json:",omitempty"`
+	// Command and Args are set for commands in pull request comments.
+	Command string   `json:",omitempty"`
+	Args    []string `json:",omitempty"`
+	// Inputs are set for dispatch events.
+	Inputs map[string]string `json:",omitempty"`
+	// Environment and DeploymentID are set for deployment events.
+	Environment  string `json:",omitempty"`
+	DeploymentID int64  `json:",omitempty"`
 	*github.Repository
 }
 
 func (e *Event) Annotations() map[string]string {
-	return map[string]string{
+	annotations := map[string]string{
 		annotationPrefix + "event_type":   e.Type,
 		annotationPrefix + "event_action": e.Action,
 		annotationPrefix + "repo_name":    *e.Repository.FullName,
@@ -31,6 +43,95 @@ func (e *Event) Annotations() map[string]string {
 		annotationPrefix + "revision":     e.Revision,
 		annotationPrefix + "before":       e.Before,
 	}
+	if e.Sender != "" {
+		annotations[annotationPrefix+"sender"] = e.Sender
+	}
+	if version := tagVersion(e.Ref); version != nil {
+		annotations[annotationPrefix+"version"] = version.String()
+		annotations[annotationPrefix+"version_major"] = strconv.FormatUint(version.Major(), 10)
+		annotations[annotationPrefix+"version_minor"] = strconv.FormatUint(version.Minor(), 10)
+		annotations[annotationPrefix+"version_patch"] = strconv.FormatUint(version.Patch(), 10)
+		annotations[annotationPrefix+"version_prerelease"] = version.Prerelease()
+	}
+	for k, v := range e.Inputs {
+		annotations[inputAnnotationPrefix+k] = v
+	}
+	if e.DeploymentID != 0 {
+		annotations[annotationPrefix+"environment"] = e.Environment
+		annotations[annotationPrefix+"deployment_id"] = strconv.FormatInt(e.DeploymentID, 10)
+	}
+	if e.Command != "" {
+		annotations[annotationPrefix+"command"] = e.Command
+		annotations[annotationPrefix+"command_args"] = strings.Join(e.Args, " ")
+	}
+	return annotations
+}
+
+// Data returns the event as plain map, e.g. for evaluating policies.
+func (e *Event) Data() map[string]interface{} {
+	return map[string]interface{}{
+		"type":        e.Type,
+		"action":      e.Action,
+		"repo":        e.GetFullName(),
+		"ref":         e.Ref,
+		"revision":    e.Revision,
+		"before":      e.Before,
+		"sender":      e.Sender,
+		"command":     e.Command,
+		"args":        e.Args,
+		"inputs":      e.Inputs,
+		"environment": e.Environment,
+	}
+}
+
+// Vars returns the variables available in templates.
+func (e *Event) Vars() map[string]string {
+	var (
+		repo  = e.GetFullName()
+		parts = strings.SplitN(repo, "/", 2)
+		name  = parts[len(parts)-1]
+	)
+	vars := map[string]string{
+		"repo":     repo,
+		"owner":    parts[0],
+		"name":     name,
+		"ref":      e.Ref,
+		"shortref": shortRef(e.Ref),
+		"revision": e.Revision,
+		"type":     e.Type,
+		"action":   e.Action,
+	}
+	if version := tagVersion(e.Ref); version != nil {
+		vars["version"] = version.String()
+		vars["major"] = strconv.FormatUint(version.Major(), 10)
+		vars["minor"] = strconv.FormatUint(version.Minor(), 10)
+		vars["patch"] = strconv.FormatUint(version.Patch(), 10)
+		vars["prerelease"] = version.Prerelease()
+	}
+	for k, v := range e.Inputs {
+		vars["input."+k] = v
+	}
+	if e.DeploymentID != 0 {
+		vars["environment"] = e.Environment
+	}
+	if e.Command != "" {
+		vars["command"] = e.Command
+		vars["args"] = strings.Join(e.Args, " ")
+		for i, arg := range e.Args {
+			vars["arg"+strconv.Itoa(i+1)] = arg
+		}
+	}
+	return vars
+}
+
+// shortRef strips refs/heads/ and refs/tags/ from ref.
+func shortRef(ref string) string {
+	for _, prefix := range []string{"refs/heads/", "refs/tags/"} {
+		if strings.HasPrefix(ref, prefix) {
+			return strings.TrimPrefix(ref, prefix)
+		}
+	}
+	return ref
 }
 
 func ParseEvent(ev interface{}) (*Event, error) {
@@ -59,6 +160,48 @@ func ParseEvent(ev interface{}) (*Event, error) {
 		event.Revision = *e.CheckSuite.AfterSHA
 		event.Before = *e.CheckSuite.BeforeSHA
 		event.Ref = branchToRef(*e.CheckSuite.HeadBranch)
+	case *ManualEvent:
+		event.Type = "manual"
+		event.Repository = e.Repository
+		event.Revision = e.Revision
+		event.Ref = e.Ref
+		event.Sender = e.Sender
+	case *CommandEvent:
+		event.Type = "issue_comment"
+		event.Action = e.Command
+		event.Repository = e.Repository
+		event.Revision = e.Revision
+		event.Ref = pullRequestRef(e.Number)
+		event.Sender = e.Sender
+		event.Command = e.Command
+		event.Args = e.Args
+	case *TagEvent:
+		event.Type = e.Type
+		event.Action = e.Action
+		event.Repository = e.Repository
+		event.Revision = e.Revision
+		event.Ref = tagPrefix + e.Tag
+	case *DispatchEvent:
+		event.Type = e.Type
+		event.Action = e.Action
+		event.Repository = e.Repository
+		event.Revision = e.Revision
+		event.Ref = e.Ref
+		event.Inputs = inputValues(e.Inputs)
+	case *github.DeploymentEvent:
+		event.Type = "deployment"
+		event.Action = e.GetDeployment().GetTask()
+		event.Repository = e.GetRepo()
+		event.Revision = e.GetDeployment().GetSHA()
+		event.Ref = e.GetDeployment().GetRef()
+		event.Environment = e.GetDeployment().GetEnvironment()
+		event.DeploymentID = e.GetDeployment().GetID()
+	case *ScheduleEvent:
+		event.Type = "schedule"
+		event.Action = e.Schedule
+		event.Repository = e.Repository
+		event.Revision = e.Revision
+		event.Ref = e.Ref
 	}
 
 	return event, nil
@@ -193,3 +193,15 @@ func TestAnnotations(t *testing.T) {
 		}
 	}
 }
+
+func TestShortRef(t *testing.T) {
+	for ref, short := range map[string]string{
+		"refs/heads/feature/foo": "feature/foo",
+		"refs/tags/v1.0.0":       "v1.0.0",
+		"refs/pull/1/head":       "refs/pull/1/head",
+	} {
+		if got := shortRef(ref); got != short {
+			t.Fatalf("Expected %s for %s but got %s", short, ref, got)
+		}
+	}
+}
@@ -3,15 +3,27 @@ module github.com/airbnb/k8s-webhook-handler
 go 1.12
 
 require (
+	github.com/Masterminds/semver/v3 v3.1.1
 	github.com/VividCortex/gohistogram v1.0.0 // indirect
 	github.com/go-kit/kit v0.8.0
 	github.com/go-logfmt/logfmt v0.4.0 // indirect
 	github.com/go-stack/stack v1.8.0 // indirect
-	github.com/google/go-cmp v0.3.1
+	github.com/golang/protobuf v1.5.2
+	github.com/google/cel-go v0.4.1
+	github.com/google/go-cmp v0.5.7
 	github.com/google/go-github/v24 v24.0.2-0.20190318223051-a627c9f2b45b
 	github.com/googleapis/gnostic v0.2.0 // indirect
 	github.com/imdario/mergo v0.3.7 // indirect
-	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45
+	github.com/open-policy-agent/opa v0.17.3
+	github.com/prometheus/client_golang v0.0.0-20181025174421-f30f42803563
+	github.com/robfig/cron/v3 v3.0.1
+	go.opentelemetry.io/otel v1.7.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.7.0
+	go.opentelemetry.io/otel/sdk v1.7.0
+	go.opentelemetry.io/otel/trace v1.7.0
+	golang.org/x/oauth2 v0.0.0-20211104180415-d3ed0bb246c8
+	k8s.io/api v0.17.2
 	k8s.io/apimachinery v0.17.2
 	k8s.io/client-go v0.17.2
+	sigs.k8s.io/yaml v1.1.0
 )
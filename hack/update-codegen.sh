@@ -0,0 +1,15 @@
+#!/bin/bash
+# Regenerates the deepcopy functions of the API types.
+set -euo pipefail
+cd "$(dirname "$0")/.."
+
+PKG=github.com/airbnb/k8s-webhook-handler/api/v1alpha1
+tmp=$(mktemp -d)
+trap 'rm -rf "$tmp"' EXIT
+
+go run k8s.io/code-generator/cmd/deepcopy-gen@v0.17.2 \
+  --input-dirs "$PKG" \
+  --output-file-base zz_generated.deepcopy \
+  --output-base "$tmp" \
+  --go-header-file /dev/null
+cp "$tmp/$PKG/zz_generated.deepcopy.go" api/v1alpha1/
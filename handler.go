@@ -1,18 +1,28 @@
 package handler
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
-	"github.com/go-kit/kit/metrics"
-	"github.com/go-kit/kit/metrics/statsd"
 	"github.com/google/go-github/v24/github"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 )
 
 const annotationPrefix = "k8s-webhook-handler.io/"
@@ -21,9 +31,46 @@ type Config struct {
 	Namespace           string
 	ResourcePath        string
 	HandlerLivenessPath string
-	Secret              []byte
-	IgnoreRefRegex      *regexp.Regexp
-	DryRun              bool
+	// HandlerReadinessPath reports readiness and, with leader election,
+	// whether this replica is the leader.
+	HandlerReadinessPath string
+	Secret               []byte
+	Insecure             bool
+	IgnoreRefRegex       *regexp.Regexp
+	DryRun               bool
+	Rules                []*Rule
+	Policy               Policy
+	// Impersonate is a template of the identity to apply objects as, e.g.
+	// system:serviceaccount:ci:repo-{{name}}. If empty, objects are applied
+	// with the handler's identity.
+	Impersonate string
+	// NamespaceTemplate, if set, is used instead of Namespace to apply
+	// objects to a namespace per repository and ref, e.g. ci-{{name}}-{{shortref}}.
+	// The namespace is created if needed and deleted on delete events.
+	NamespaceTemplate string
+	// NamespaceSeed is applied to namespaces created for NamespaceTemplate.
+	NamespaceSeed runtime.Object
+	// ApplyMode defines how failures to apply one of multiple objects are
+	// handled.
+	ApplyMode ApplyMode
+	// RunAnchor, if set, creates an object per delivery owning all objects
+	// applied for it.
+	RunAnchor RunAnchor
+	// Commands are the slash commands handled in pull request comments.
+	Commands []*CommandRule
+	// TagConstraint, if set, skips events for tags which aren't semantic
+	// versions matching it.
+	TagConstraint TagConstraint
+	// SkipDirectives, if set, are commit message directives like skip ci
+	// skipping pushes with [skip ci] in their head commit message. Pushes
+	// with [skip <manifest>] skip the manifest of that name then as well.
+	SkipDirectives []string
+	// SkipAllCommits checks the messages of all commits of a push for skip
+	// directives instead of only the head commit's.
+	SkipAllCommits bool
+	// ReleaseActions are the actions of release events to handle. Defaults
+	// to DefaultReleaseActions.
+	ReleaseActions []string
 }
 
 type Handler struct {
@@ -31,39 +78,97 @@ type Handler struct {
 	Config *Config
 	Loader
 	KubernetesClient
+	// Secrets is consulted for per repository secrets if set.
+	Secrets SecretStore
+	// SourceFilter rejects requests from disallowed addresses if set.
+	SourceFilter *SourceFilter
+	// AdmissionPolicies are evaluated for each object before applying it.
+	AdmissionPolicies []AdmissionPolicy
+	// Runs records each handled delivery if set.
+	Runs RunRecorder
+	// Deliveries stores validated payloads for replaying them if set.
+	Deliveries DeliveryStore
+	// Leader reports whether this replica runs the background controllers
+	// if leader election is enabled.
+	Leader interface{ IsLeader() bool }
+	// Comments is used to handle commands in pull request comments.
+	Comments CommentClient
+	// Refs resolves the tags of create and release events.
+	Refs RefResolver
+	// Deployments handles deployment events and reports their state if set.
+	Deployments *DeploymentTracker
+	// Changes lists the files changed by truncated pushes for path filters.
+	Changes ChangeLister
 
-	requestCounter metrics.Counter
-	errorCounter   metrics.Counter
-	callDuration   metrics.Histogram
+	metrics *Metrics
 }
 
-func NewGithubHookHandler(logger log.Logger, config *Config, kubernetesClient KubernetesClient, loader Loader, statsdClient *statsd.Statsd) *Handler {
+func NewGithubHookHandler(logger log.Logger, config *Config, kubernetesClient KubernetesClient, loader Loader, metrics *Metrics) *Handler {
 	return &Handler{
 		Logger:           logger,
 		Config:           config,
 		Loader:           loader,
 		KubernetesClient: kubernetesClient,
-		requestCounter:   statsdClient.NewCounter("requests", 1.0),
-		errorCounter:     statsdClient.NewCounter("errors", 1.0),
-		callDuration:     statsdClient.NewTiming("duration", 1.0),
+		metrics:          metrics,
 	}
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	defer func(begin time.Time) { h.callDuration.Observe(time.Since(begin).Seconds()) }(time.Now())
+	var (
+		status = http.StatusOK
+		event  *Event
+		err    error
+	)
+	defer func(begin time.Time) { h.metrics.observeRequest(event, status, err, time.Since(begin)) }(time.Now())
 	logger := log.With(h.Logger, "client", r.RemoteAddr)
-	h.requestCounter.Add(1)
 
 	if r.URL.Path == h.Config.HandlerLivenessPath {
 		http.Error(w, "OK", http.StatusOK)
 		return
 	}
-	hr, err := h.handle(w, r)
+	if h.Config.HandlerReadinessPath != "" && r.URL.Path == h.Config.HandlerReadinessPath {
+		// Followers are ready too since all replicas handle webhooks.
+		switch {
+		case h.Leader == nil:
+			http.Error(w, "OK", http.StatusOK)
+		case h.Leader.IsLeader():
+			http.Error(w, "OK, leader", http.StatusOK)
+		default:
+			http.Error(w, "OK, follower", http.StatusOK)
+		}
+		return
+	}
+
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := startSpan(ctx, "ServeHTTP",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(semconv.HTTPServerAttributesFromHTTPRequest("", r.URL.Path, r)...),
+		trace.WithAttributes(attrDelivery.String(github.DeliveryID(r))),
+	)
+	defer func() {
+		if event != nil {
+			span.SetAttributes(eventAttributes(event, github.DeliveryID(r))...)
+		}
+		span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(status)...)
+		endSpan(span, err)
+	}()
+	if h.SourceFilter != nil {
+		ip, ipErr := h.SourceFilter.ClientIP(r)
+		if ipErr != nil || !h.SourceFilter.Allowed(ip) {
+			h.metrics.sourceRejected.Add(1)
+			level.Warn(logger).Log("msg", "Rejecting request from disallowed source", "source", ip, "err", ipErr)
+			status, err = http.StatusForbidden, errors.New("Source not allowed")
+			hr := &handlerResponse{status: status, code: CodeSourceNotAllowed, message: "Source not allowed"}
+			hr.write(w, r, github.DeliveryID(r), nil, err)
+			return
+		}
+		logger = log.With(logger, "source", ip)
+	}
+	hr, err := h.handle(w, r.WithContext(withHandledEvent(ctx, &event)))
 	if hr == nil {
 		hr = &handlerResponse{}
 	}
 	if err != nil {
-		h.errorCounter.Add(1)
 		level.Error(logger).Log("msg", err)
 		if hr.status == 0 {
 			hr.status = http.StatusInternalServerError
@@ -79,61 +184,532 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			hr.message = "Webhook handled successfully"
 		}
 	}
-	http.Error(w, hr.message, hr.status)
+	status = hr.status
+	if werr := hr.write(w, r, github.DeliveryID(r), event, err); werr != nil {
+		level.Error(logger).Log("msg", "Couldn't write response", "err", werr)
+	}
 }
 
-func (h *Handler) handle(w http.ResponseWriter, r *http.Request) (*handlerResponse, error) {
+func (h *Handler) handle(w http.ResponseWriter, r *http.Request) (hr *handlerResponse, err error) {
+	ctx := withStageObserver(WithDeliveryID(r.Context(), github.DeliveryID(r)), h.observeStage)
+	if h.Runs != nil {
+		// The run is recorded here, so requests rejected before they're
+		// handled as event are recorded too.
+		run := newWebhookRun(github.DeliveryID(r), github.WebHookType(r))
+		ctx = withRun(ctx, run)
+		defer func() { h.recordRun(run, hr, err) }()
+	}
 	if r.Method != http.MethodPost {
-		return &handlerResponse{http.StatusBadRequest, "Method not supported"}, nil
+		return &handlerResponse{status: http.StatusBadRequest, code: CodeMethodNotAllowed, message: "Method not supported"}, errors.New("Method not supported")
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return &handlerResponse{status: http.StatusBadRequest, code: CodeInvalidBody, message: "Couldn't read body"}, err
+	}
+
+	// We need to know the repository to find the secret, so extract it from
+	// the unverified payload first and verify the signature afterwards.
+	done := stage(ctx, "validate")
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	unverified, err := github.ValidatePayload(r, nil)
+	if err != nil {
+		return &handlerResponse{status: http.StatusBadRequest, code: CodeInvalidPayload, message: "Invalid payload"}, err
+	}
+	secret, err := h.secret(peekRepository(unverified))
+	if err != nil {
+		return &handlerResponse{status: http.StatusInternalServerError, code: CodeSecretUnavailable, message: "Couldn't get secret"}, err
 	}
-	payload, err := github.ValidatePayload(r, h.Config.Secret)
+	if len(secret) == 0 && !h.Config.Insecure {
+		return &handlerResponse{status: http.StatusForbidden, code: CodeNoSecret, message: "No secret for repository"}, errors.New("No secret found and insecure mode not enabled")
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	payload, err := github.ValidatePayload(r, secret)
 	if err != nil {
-		return &handlerResponse{http.StatusBadRequest, "Invalid payload"}, err
+		return &handlerResponse{status: http.StatusBadRequest, code: CodeInvalidSignature, message: "Invalid signature"}, err
+	}
+	if run := contextRun(ctx); run != nil {
+		run.Spec.Repo = peekRepository(payload)
 	}
-	defer r.Body.Close()
-	event, err := github.ParseWebHook(github.WebHookType(r), payload)
+	event, err := parseWebHook(github.WebHookType(r), payload)
 	if err != nil {
-		return &handlerResponse{http.StatusBadRequest, "Couldn't parse webhook"}, err
+		return &handlerResponse{status: http.StatusBadRequest, code: CodeUnsupportedEvent, message: "Couldn't parse webhook"}, err
+	}
+	done()
+	if h.Deliveries != nil && DeliveryID(ctx) != "" {
+		if err := h.Deliveries.Put(&Delivery{
+			ID:        DeliveryID(ctx),
+			EventType: github.WebHookType(r),
+			Received:  time.Now(),
+			Payload:   payload,
+		}); err != nil {
+			level.Error(h.Logger).Log("msg", "Couldn't store delivery", "delivery", DeliveryID(ctx), "err", err)
+		}
+	}
+	return h.HandleEvent(ctx, event)
+}
+
+func (h *Handler) observeStage(name string, duration time.Duration) {
+	h.metrics.stageDuration.With("stage", name).Observe(duration.Seconds())
+}
+
+// secret returns the secret to validate webhooks for repo with. Secrets from
+// the SecretStore take precedence over the repo's rule and the global secret.
+func (h *Handler) secret(repo string) ([]byte, error) {
+	if repo != "" {
+		if h.Secrets != nil {
+			secret, err := h.Secrets.Secret(repo)
+			if err != nil || secret != nil {
+				return secret, err
+			}
+		}
+		if rule := h.Config.Rule(repo); rule != nil && rule.Secret != "" {
+			return []byte(rule.Secret), nil
+		}
+	}
+	return h.Config.Secret, nil
+}
+
+// peekRepository returns the repository's full name from a payload which
+// hasn't been validated yet. It must not be trusted for anything but
+// looking up the secret.
+func peekRepository(payload []byte) string {
+	p := struct {
+		Repository struct {
+			FullName string `json:"full_name"`
+		} `json:"repository"`
+	}{}
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return ""
 	}
-	return h.HandleEvent(r.Context(), event)
+	return p.Repository.FullName
 }
 
 // Handler handles a webhook.
 // We have to use interface{} because of https://github.com/google/go-github/issues/1154.
-func (h *Handler) HandleEvent(ctx context.Context, ev interface{}) (*handlerResponse, error) {
+func (h *Handler) HandleEvent(ctx context.Context, ev interface{}) (hr *handlerResponse, err error) {
+	// Events not handled for a webhook request record their own run.
+	run := contextRun(ctx)
+	if run == nil {
+		run = newWebhookRun(DeliveryID(ctx), "")
+		if h.Runs != nil {
+			defer func() { h.recordRun(run, hr, err) }()
+		}
+	}
+	if e, ok := ev.(*github.IssueCommentEvent); ok {
+		command, rule, hr, err := h.commandEvent(ctx, h.Logger, e)
+		if command == nil {
+			return hr, err
+		}
+		ev, ctx = command, withResourcePath(ctx, rule.ResourcePath)
+	}
+	switch e := ev.(type) {
+	case *github.CreateEvent, *github.ReleaseEvent:
+		tag, hr, err := h.tagEvent(ctx, ev)
+		if tag == nil {
+			return hr, err
+		}
+		ev = tag
+	case *RepositoryDispatchEvent, *WorkflowDispatchEvent:
+		dispatch, hr, err := h.dispatchEvent(ctx, ev)
+		if dispatch == nil {
+			return hr, err
+		}
+		ev = dispatch
+	case *github.DeploymentEvent:
+		if h.Deployments == nil {
+			return &handlerResponse{outcome: ResponseIgnored, message: "Deployments not enabled, skipping"}, nil
+		}
+		if env := e.GetDeployment().GetEnvironment(); !environmentRegex.MatchString(env) {
+			return &handlerResponse{status: http.StatusBadRequest, code: CodeInvalidPayload, message: "Invalid environment"}, fmt.Errorf("Invalid environment %q", env)
+		}
+	}
 	event, err := ParseEvent(ev)
 	if err != nil {
-		return &handlerResponse{http.StatusBadRequest, "Invalid/unsupported event"}, err
+		return &handlerResponse{status: http.StatusBadRequest, code: CodeUnsupportedEvent, message: "Invalid/unsupported event"}, err
+	}
+	replay := replayOptions(ctx)
+	if replay.Revision != "" {
+		event.Revision = replay.Revision
 	}
+	dryRun := h.Config.DryRun || replay.DryRun
 	logger := log.With(h.Logger, "revision", event.Revision, "ref", event.Ref)
+	ctx, span := startSpan(ctx, "HandleEvent", trace.WithAttributes(eventAttributes(event, DeliveryID(ctx))...))
+	defer func() { endSpan(span, err) }()
+	setRunEvent(run, event)
+	ctx = withStageObserver(ctx, func(name string, duration time.Duration) {
+		h.observeStage(name, duration)
+		observeStage(run, name, duration)
+	})
+	if p, ok := ctx.Value(handledEventKey{}).(**Event); ok {
+		*p = event
+	}
+	if event.DeploymentID != 0 {
+		if path := h.Deployments.resourcePath(event); path != "" {
+			ctx = withResourcePath(ctx, path)
+		}
+		// Deployments which couldn't be handled are errors, including the
+		// findings of denying admission policies. The tracker reports the
+		// state of applied ones. Redeliveries of handled deployments leave
+		// the state as is.
+		defer func() {
+			if err != nil && hr != nil && hr.code != CodeAlreadyHandled {
+				description := err.Error()
+				if !strings.HasPrefix(description, hr.message) {
+					description = hr.message + ": " + description
+				}
+				if len(hr.findings) > 0 {
+					description += ": " + strings.Join(hr.findings, ", ")
+				}
+				h.Deployments.SetStatus(context.Background(), event, DeploymentError, description, "")
+			}
+		}()
+	}
+	defer func() {
+		if hr != nil {
+			hr.rule, hr.namespace = run.Spec.Rule, run.Spec.Namespace
+		}
+	}()
 
 	if h.Config.IgnoreRefRegex != nil && h.Config.IgnoreRefRegex.MatchString(event.Ref) {
 		level.Debug(logger).Log("msg", "Ref is ignored, skipping", "regex", h.Config.IgnoreRefRegex)
-		return &handlerResponse{message: "Ref is ignored, skipping"}, nil
+		return &handlerResponse{outcome: ResponseIgnored, message: "Ref is ignored, skipping"}, nil
+	}
+
+	namespace := h.Config.Namespace
+	if h.Config.NamespaceTemplate != "" {
+		namespace = NamespaceName(expand(h.Config.NamespaceTemplate, event.Vars()))
+		logger = log.With(logger, "namespace", namespace)
+	}
+	if event.DeploymentID != 0 && h.Deployments.namespace(event) != "" {
+		namespace = h.Deployments.namespace(event)
+		logger = log.With(logger, "namespace", namespace)
+	}
+	if replay.Namespace != "" {
+		namespace = replay.Namespace
+		logger = log.With(logger, "namespace", namespace)
+	}
+	run.Spec.Namespace = namespace
+	span.SetAttributes(attrNamespace.String(namespace))
+	if h.Config.NamespaceTemplate != "" && event.Type == "delete" {
+		return h.deleteNamespace(logger, namespace, event, dryRun)
+	}
+
+	var (
+		rule        = h.Config.Rule(*event.Repository.FullName)
+		policy      = &h.Config.Policy
+		impersonate = h.Config.Impersonate
+		applyMode   = h.Config.ApplyMode
+		constraint  = h.Config.TagConstraint
+	)
+	if rule != nil {
+		run.Spec.Rule = rule.Name
+		policy = policy.Merge(rule.Policy)
+		if rule.Impersonate != "" {
+			impersonate = rule.Impersonate
+		}
+		if rule.ApplyMode != "" {
+			applyMode = rule.ApplyMode
+		}
+		if rule.TagConstraint != "" {
+			constraint = rule.TagConstraint
+		}
+	}
+	if event.Inputs != nil {
+		var specs []*InputSpec
+		if rule != nil {
+			specs = rule.Inputs
+		}
+		if violations := checkInputs(specs, event.Inputs); len(violations) > 0 {
+			return &handlerResponse{status: http.StatusBadRequest, code: CodeInvalidInputs, message: "Invalid inputs", details: violations}, fmt.Errorf("Invalid inputs: %s", strings.Join(violations, ", "))
+		}
+	}
+	if !constraint.Allows(event.Ref) {
+		level.Debug(logger).Log("msg", "Tag doesn't match constraint, skipping", "constraint", constraint)
+		return &handlerResponse{outcome: ResponseIgnored, message: "Tag doesn't match constraint, skipping"}, nil
+	}
+	manifest := resourcePath(ctx, h.Config.ResourcePath)
+	if push, ok := ev.(*github.PushEvent); ok && len(h.Config.SkipDirectives) > 0 {
+		if directive := skipDirective(commitMessages(push, h.Config.SkipAllCommits), h.Config.SkipDirectives, manifestName(manifest)); directive != "" {
+			level.Debug(logger).Log("msg", "Commit message has skip directive, skipping", "directive", directive)
+			h.metrics.observeSkip(event, directive)
+			return &handlerResponse{outcome: ResponseIgnored, message: "Commit message contains [" + directive + "], skipping", skipReason: directive}, nil
+		}
+	}
+	if push, ok := ev.(*github.PushEvent); ok && rule.hasPathFilter() {
+		files, err := h.changedFiles(ctx, push)
+		if err != nil {
+			return &handlerResponse{status: http.StatusBadGateway, code: CodeCompareFailed, message: "Couldn't list changed files"}, err
+		}
+		// Pushes whose files can't be determined are handled.
+		if files != nil && !rule.MatchesPaths(files) {
+			level.Debug(logger).Log("msg", "No matching paths, skipping", "files", len(files))
+			return &handlerResponse{outcome: ResponseIgnored, message: "No matching paths, skipping"}, nil
+		}
 	}
 
-	obj, err := h.Loader.Load(ctx, *event.Repository.FullName, h.Config.ResourcePath, event.Revision)
+	obj, err := h.Loader.Load(ctx, *event.Repository.FullName, manifest, event.Revision)
 	if err != nil {
-		return &handlerResponse{message: "Couldn't downlaod manifest"}, err
+		return &handlerResponse{code: loadErrorCode(err), message: "Couldn't download manifest"}, err
+	}
+	vars := event.Vars()
+	if event.Inputs != nil {
+		vars["inputs_configmap"] = inputsConfigMapName(DeliveryID(ctx))
+	}
+	if err := expandObject(obj, vars); err != nil {
+		return &handlerResponse{code: CodeDecodeFailed, message: "Couldn't expand manifest"}, err
 	}
 
 	annotations := event.Annotations()
 	if err := meta.NewAccessor().SetAnnotations(obj, annotations); err != nil {
 		level.Error(logger).Log("msg", "Couldn't set annotations", "err", err)
 	}
+	labels, _ := namespaceLabels(event)
+	if err := setLabels(obj, labels); err != nil {
+		level.Error(logger).Log("msg", "Couldn't set labels", "err", err)
+	}
+	if event.Inputs != nil {
+		// The ConfigMap is checked and applied with the manifest, so the
+		// policies apply to it and it's rolled back in atomic mode.
+		obj, err = withInputsConfigMap(obj, event, DeliveryID(ctx))
+		if err != nil {
+			return &handlerResponse{code: CodeInputsFailed, message: "Couldn't create inputs ConfigMap"}, err
+		}
+	}
+
+	done := stage(ctx, "policy")
+	violations, err := policy.Check(obj, namespace, h.KubernetesClient)
+	done()
+	if err != nil {
+		return &handlerResponse{code: CodePolicyFailed, message: "Couldn't check policy"}, err
+	}
+	if len(violations) > 0 {
+		return &handlerResponse{status: http.StatusForbidden, code: CodePolicyDenied, message: "Manifest violates policy", details: violations}, fmt.Errorf("Manifest violates policy: %s", strings.Join(violations, ", "))
+	}
+
+	done = stage(ctx, "admission")
+	findings, err := Admit(ctx, h.AdmissionPolicies, event, obj)
+	done()
+	if err != nil {
+		return &handlerResponse{code: CodeAdmissionFailed, message: "Couldn't evaluate admission policies"}, err
+	}
+	var findingLines []string
+	if len(findings) > 0 {
+		findingLines = make([]string, len(findings))
+		for i, f := range findings {
+			findingLines[i] = f.String()
+		}
+		level.Info(logger).Log("msg", "Admission findings", "findings", strings.Join(findingLines, ", "))
+	}
+	if Denied(findings) {
+		return &handlerResponse{status: http.StatusForbidden, code: CodeAdmissionDenied, message: "Manifest denied by admission policy", findings: findingLines}, errors.New("Manifest denied by admission policy")
+	}
+
 	level.Info(logger).Log("msg", "Downloaded manifest succesfully")
-	if h.Config.DryRun {
+	if dryRun {
 		level.Info(logger).Log("msg", "Dry run enabled, skipping apply", "obj", fmt.Sprintf("%s", obj))
-		return nil, nil
+		return &handlerResponse{outcome: ResponseSkipped, message: "Dry run, skipped applying", findings: findingLines}, nil
+	}
+	if h.Config.NamespaceTemplate != "" {
+		done = stage(ctx, "namespace")
+		err := h.ensureNamespace(ctx, logger, namespace, event)
+		done()
+		if err != nil {
+			return &handlerResponse{code: CodeNamespaceFailed, message: "Couldn't create namespace"}, err
+		}
+	}
+
+	client := h.KubernetesClient
+	var user string
+	if impersonate != "" {
+		user = expand(impersonate, event.Vars())
+		logger = log.With(logger, "user", user)
+		client, err = client.Impersonate(user)
+		if err != nil {
+			return &handlerResponse{code: CodeImpersonationFailed, message: "Couldn't create client"}, err
+		}
+	}
+	opts := policy.ApplyOptions(namespace)
+	opts.Mode = applyMode
+	var runName string
+	if h.Config.RunAnchor != RunAnchorNone {
+		var anchor *AppliedObject
+		anchor, err = h.createRunAnchor(ctx, event, namespace)
+		if err != nil {
+			if apierrors.IsAlreadyExists(err) {
+				if tagAnchorName(ctx, event) != "" {
+					level.Debug(logger).Log("msg", "Tag already handled, skipping", "err", err)
+					return &handlerResponse{outcome: ResponseIgnored, message: "Tag already handled, skipping"}, nil
+				}
+				return &handlerResponse{status: http.StatusConflict, code: CodeAlreadyHandled, message: "Delivery already handled"}, err
+			}
+			return &handlerResponse{code: CodeRunAnchorFailed, message: "Couldn't create run anchor"}, err
+		}
+		logger = log.With(logger, "anchor", anchor)
+		opts.Owner = ownerReference(anchor)
+		runName = anchor.String()
+		// Delete the anchor and the objects it owns if handling fails, so
+		// a redelivery isn't rejected as already handled.
+		defer func() {
+			if err == nil {
+				return
+			}
+			if derr := h.KubernetesClient.Delete(ctx, anchor); derr != nil {
+				level.Error(logger).Log("msg", "Couldn't delete run anchor", "err", derr)
+			}
+		}()
+	}
+	if event.DeploymentID != 0 {
+		description := "Applying manifest"
+		if len(findingLines) > 0 {
+			description += ", admission findings: " + strings.Join(findingLines, ", ")
+		}
+		h.Deployments.SetStatus(ctx, event, DeploymentInProgress, description, "")
+	}
+	done = stage(ctx, "apply")
+	applied, err := client.Apply(ctx, obj, opts)
+	done()
+	run.Status.Objects = runObjects(applied)
+	hr = &handlerResponse{objects: applied, run: runName, findings: findingLines}
+	if err != nil {
+		switch {
+		case isForbidden(err) && user != "":
+			hr.status, hr.code, hr.message = http.StatusForbidden, CodeApplyForbidden, fmt.Sprintf("Not allowed to apply resource as %s: %s", user, err)
+		case isConflict(err):
+			hr.status, hr.code, hr.message = http.StatusConflict, CodeApplyConflict, "Couldn't apply resource"
+		default:
+			hr.code, hr.message = CodeApplyFailed, "Couldn't apply resource"
+		}
+		return hr, err
+	}
+	for _, a := range applied {
+		level.Info(logger).Log("msg", "Applied object", "object", a, "outcome", a.Outcome)
+	}
+	if event.DeploymentID != 0 {
+		h.Deployments.Track(event, applied)
+	}
+
+	hr.outcome, hr.message = ResponseCreated, "Webhook handled successfully"
+	return hr, nil
+}
+
+// createRunAnchor creates the object owning all objects applied for event.
+// It's created with the handler's identity, so impersonated users don't
+// need permissions for it.
+func (h *Handler) createRunAnchor(ctx context.Context, event *Event, namespace string) (*AppliedObject, error) {
+	anchor, err := runAnchor(h.Config.RunAnchor, event, DeliveryID(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if name := tagAnchorName(ctx, event); name != "" {
+		anchor.SetGenerateName("")
+		anchor.SetName(name)
+	}
+	applied, err := h.KubernetesClient.Apply(ctx, anchor, &ApplyOptions{Namespace: namespace, NamespaceMode: NamespaceForce})
+	if err != nil {
+		return nil, err
+	}
+	return applied[0], nil
+}
+
+func formatApplied(applied []*AppliedObject) string {
+	if len(applied) == 0 {
+		return ""
+	}
+	lines := make([]string, len(applied))
+	for i, a := range applied {
+		lines[i] = a.String() + ": " + a.Outcome
+		if a.Error != "" {
+			lines[i] += ": " + a.Error
+		}
+	}
+	return "\nObjects:\n- " + strings.Join(lines, "\n- ")
+}
+
+// isForbidden returns true if err or, for aggregated errors, any of them is
+// a Forbidden error.
+func isForbidden(err error) bool {
+	return anyError(err, apierrors.IsForbidden)
+}
+
+// isConflict returns true if err or, for aggregated errors, any of them is
+// an AlreadyExists or Conflict error.
+func isConflict(err error) bool {
+	return anyError(err, func(err error) bool {
+		return apierrors.IsAlreadyExists(err) || apierrors.IsConflict(err)
+	})
+}
+
+func anyError(err error, fn func(error) bool) bool {
+	if agg, ok := err.(utilerrors.Aggregate); ok {
+		for _, err := range agg.Errors() {
+			if fn(err) {
+				return true
+			}
+		}
+		return false
+	}
+	return fn(err)
+}
+
+// loadErrorCode returns the code for an error returned by a Loader.
+func loadErrorCode(err error) ErrorCode {
+	switch err.(type) {
+	case *NotFoundError:
+		return CodeManifestNotFound
+	case *DecodeError:
+		return CodeDecodeFailed
+	}
+	return CodeLoadFailed
+}
+
+// ensureNamespace creates the namespace for event and seeds it with
+// NamespaceSeed if it doesn't exist yet.
+func (h *Handler) ensureNamespace(ctx context.Context, logger log.Logger, namespace string, event *Event) error {
+	labels, annotations := namespaceLabels(event)
+	created, err := h.KubernetesClient.EnsureNamespace(namespace, labels, annotations)
+	if err != nil || !created {
+		return err
 	}
-	if err := h.KubernetesClient.Apply(obj, h.Config.Namespace); err != nil {
-		return &handlerResponse{message: "Couldn't apply resource"}, err
+	level.Info(logger).Log("msg", "Created namespace")
+	if h.Config.NamespaceSeed == nil {
+		return nil
 	}
+	seed := h.Config.NamespaceSeed.DeepCopyObject()
+	if err := expandObject(seed, event.Vars()); err != nil {
+		return err
+	}
+	if _, err := h.KubernetesClient.Apply(ctx, seed, &ApplyOptions{Namespace: namespace, NamespaceMode: NamespaceForce}); err != nil {
+		// Delete the namespace, so it gets seeded on the next attempt.
+		if derr := h.KubernetesClient.DeleteNamespace(namespace, labels); derr != nil {
+			level.Error(logger).Log("msg", "Couldn't delete namespace after failing to seed it", "err", derr)
+		}
+		return fmt.Errorf("Couldn't seed namespace: %s", err)
+	}
+	return nil
+}
 
-	return nil, nil
+// deleteNamespace deletes the namespace created for event.
+func (h *Handler) deleteNamespace(logger log.Logger, namespace string, event *Event, dryRun bool) (*handlerResponse, error) {
+	if dryRun {
+		level.Info(logger).Log("msg", "Dry run enabled, skipping namespace deletion")
+		return &handlerResponse{outcome: ResponseSkipped, message: "Dry run, skipped deleting namespace " + namespace}, nil
+	}
+	labels, _ := namespaceLabels(event)
+	if err := h.KubernetesClient.DeleteNamespace(namespace, labels); err != nil {
+		if apierrors.IsNotFound(err) {
+			return &handlerResponse{outcome: ResponseIgnored, message: "Namespace " + namespace + " doesn't exist"}, nil
+		}
+		return &handlerResponse{code: CodeNamespaceFailed, message: "Couldn't delete namespace"}, err
+	}
+	level.Info(logger).Log("msg", "Deleted namespace")
+	return &handlerResponse{outcome: ResponseDeleted, message: "Deleted namespace " + namespace}, nil
 }
 
-type handlerResponse struct {
-	status  int
-	message string
+type handledEventKey struct{}
+
+// withHandledEvent returns a context in which HandleEvent stores the parsed
+// event in event.
+func withHandledEvent(ctx context.Context, event **Event) context.Context {
+	return context.WithValue(ctx, handledEventKey{}, event)
 }
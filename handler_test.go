@@ -1,37 +1,157 @@
 package handler
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/metrics/statsd"
+	"github.com/google/go-cmp/cmp"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/airbnb/k8s-webhook-handler/api/v1alpha1"
 )
 
 type mockKubernetesClient struct {
-	obj       runtime.Object
-	namespace string
+	obj        runtime.Object
+	namespace  string
+	opts       *ApplyOptions
+	user       string
+	err        error
+	applied    []runtime.Object
+	namespaces map[string]map[string]string
+	deleted    []string
+	// deletedObjects are the objects passed to Delete.
+	deletedObjects []string
 }
 
-func (k *mockKubernetesClient) Apply(obj runtime.Object, namespace string) error {
+func (k *mockKubernetesClient) Apply(ctx context.Context, obj runtime.Object, opts *ApplyOptions) ([]*AppliedObject, error) {
+	if k.err != nil {
+		return nil, k.err
+	}
 	k.obj = obj
-	k.namespace = namespace
+	k.namespace = opts.Namespace
+	k.opts = opts
+	k.applied = append(k.applied, obj)
+	applied := []*AppliedObject{}
+	err := eachObject(obj, func(o *unstructured.Unstructured) error {
+		name := o.GetName()
+		if name == "" {
+			name = o.GetGenerateName() + "abcde"
+		}
+		applied = append(applied, &AppliedObject{APIVersion: o.GetAPIVersion(), Kind: o.GetKind(), Namespace: opts.Namespace, Name: name, UID: types.UID("uid-" + name), Outcome: OutcomeCreated})
+		return nil
+	})
+	return applied, err
+}
+
+func (k *mockKubernetesClient) EnsureNamespace(name string, labels, annotations map[string]string) (bool, error) {
+	if k.namespaces == nil {
+		k.namespaces = map[string]map[string]string{}
+	}
+	if _, ok := k.namespaces[name]; ok {
+		return false, nil
+	}
+	k.namespaces[name] = labels
+	return true, nil
+}
+
+func (k *mockKubernetesClient) DeleteNamespace(name string, labels map[string]string) error {
+	if _, ok := k.namespaces[name]; !ok {
+		return apierrors.NewNotFound(namespaceResource.GroupResource(), name)
+	}
+	delete(k.namespaces, name)
+	k.deleted = append(k.deleted, name)
+	return nil
+}
+
+func (k *mockKubernetesClient) Delete(ctx context.Context, obj *AppliedObject) error {
+	k.deletedObjects = append(k.deletedObjects, obj.String())
+	return nil
+}
+
+func (k *mockKubernetesClient) Impersonate(user string) (KubernetesClient, error) {
+	k.user = user
+	return k, nil
+}
+
+func (k *mockKubernetesClient) RESTMapping(gk schema.GroupKind, versions ...string) (*meta.RESTMapping, error) {
+	scope := meta.RESTScopeNamespace
+	if strings.HasPrefix(gk.Kind, "Cluster") || gk.Kind == "Namespace" {
+		scope = meta.RESTScopeRoot
+	}
+	return &meta.RESTMapping{Scope: scope}, nil
+}
+
+func newTestMetrics() *Metrics {
+	return NewMetrics(NewStatsdProvider(statsd.New("", log.NewNopLogger())), 100)
+}
+
+type mockRunRecorder struct {
+	runs []*v1alpha1.WebhookRun
+}
+
+func (r *mockRunRecorder) Record(run *v1alpha1.WebhookRun) error {
+	r.runs = append(r.runs, run)
 	return nil
 }
 
 type mockLoader struct {
-	obj runtime.Object
+	obj  runtime.Object
+	err  error
+	path string
 }
 
 func (l *mockLoader) Load(ctx context.Context, repo, path, ref string) (runtime.Object, error) {
+	l.path = path
+	if l.err != nil {
+		return nil, l.err
+	}
+	if l.obj == nil {
+		return workflow(), nil
+	}
 	return l.obj, nil
 }
 
+func workflow() *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{"apiVersion": "argoproj.io/v1alpha1", "kind": "Workflow", "metadata": map[string]interface{}{"generateName": "hello-world-"}}}
+}
+
+var (
+	deletePayload = []byte(`{"ref": "feature-123", "ref_type": "branch", "repository": {"full_name": "foo/bar", "git_url": "git://example.com/foo/bar.git", "ssh_url": "git@example.com:foo/bar.git"}}`)
+	pushPayload   = []byte(`{"ref": "refs/heads/feature-123", "before": "def", "after": "abc", "repository": {"full_name": "foo/bar", "git_url": "git://example.com/foo/bar.git", "ssh_url": "git@example.com:foo/bar.git"}}`)
+)
+
+func newRequest(eventType string, payload []byte, secret string) *http.Request {
+	req := httptest.NewRequest("POST", "http://example.com/", bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-GitHub-Event", eventType)
+	req.Header.Set("X-Hub-Signature", sign(payload, []byte(secret)))
+	req.Header.Set("Accept", "text/plain")
+	return req
+}
+
+func newDeleteRequest(secret string) *http.Request {
+	return newRequest("delete", deletePayload, secret)
+}
+
 func TestHandle(t *testing.T) {
 	var (
 		config = &Config{Namespace: "namespace", ResourcePath: "foo/bar.yaml", Secret: []byte("foobar")}
@@ -43,7 +163,7 @@ func TestHandle(t *testing.T) {
 		config,
 		&mockKubernetesClient{},
 		&mockLoader{},
-		statsd.New("k8s-ci-purger.", logger),
+		newTestMetrics(),
 	)
 
 	req := httptest.NewRequest("POST", "http://example.com/", nil)
@@ -61,3 +181,375 @@ func TestHandle(t *testing.T) {
 	fmt.Println(resp.Header.Get("Content-Type"))
 	fmt.Println(string(body))
 }
+
+func sign(payload, secret []byte) string {
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(payload)
+	return "sha1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+type mockSecretStore map[string][]byte
+
+func (s mockSecretStore) Secret(repo string) ([]byte, error) {
+	return s[repo], nil
+}
+
+func TestHandleSecrets(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		global   string
+		insecure bool
+		rules    []*Rule
+		store    mockSecretStore
+		signWith string
+		status   int
+	}{
+		{"global", "global", false, nil, nil, "global", http.StatusOK},
+		{"global wrong", "global", false, nil, nil, "wrong", http.StatusBadRequest},
+		{"store", "global", false, nil, mockSecretStore{"foo/bar": []byte("repo")}, "repo", http.StatusOK},
+		{"store global", "global", false, nil, mockSecretStore{"foo/bar": []byte("repo")}, "global", http.StatusBadRequest},
+		{"store other repo", "global", false, nil, mockSecretStore{"foo/baz": []byte("repo")}, "global", http.StatusOK},
+		{"rule", "", false, []*Rule{{Repo: "foo/*", Secret: "rule"}}, nil, "rule", http.StatusOK},
+		{"store before rule", "", false, []*Rule{{Repo: "foo/*", Secret: "rule"}}, mockSecretStore{"foo/bar": []byte("repo")}, "rule", http.StatusBadRequest},
+		{"no secret", "", false, nil, nil, "", http.StatusForbidden},
+		{"insecure", "", true, nil, nil, "", http.StatusOK},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			config := &Config{Namespace: "namespace", Secret: []byte(test.global), Insecure: test.insecure, Rules: test.rules}
+			handler := NewGithubHookHandler(log.NewNopLogger(), config, &mockKubernetesClient{}, &mockLoader{}, newTestMetrics())
+			if test.store != nil {
+				handler.Secrets = test.store
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, newDeleteRequest(test.signWith))
+			if w.Code != test.status {
+				t.Fatalf("Expected status %d but got %d: %s", test.status, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestHandlePolicy(t *testing.T) {
+	config := &Config{
+		Namespace: "ci",
+		Insecure:  true,
+		Policy:    Policy{AllowedKinds: []string{"argoproj.io/*/Workflow"}},
+		Rules: []*Rule{
+			{Repo: "foo/*", Policy: &Policy{AllowedClusterKinds: []string{"rbac.authorization.k8s.io/v1/ClusterRole"}}},
+		},
+	}
+	clusterRole := &unstructured.Unstructured{Object: map[string]interface{}{"apiVersion": "rbac.authorization.k8s.io/v1", "kind": "ClusterRole", "metadata": map[string]interface{}{"name": "foo"}}}
+	clusterRoleBinding := &unstructured.Unstructured{Object: map[string]interface{}{"apiVersion": "rbac.authorization.k8s.io/v1", "kind": "ClusterRoleBinding", "metadata": map[string]interface{}{"name": "foo"}}}
+	otherNamespace := workflow()
+	otherNamespace.SetNamespace("kube-system")
+
+	for _, test := range []struct {
+		obj      runtime.Object
+		status   int
+		messages []string
+	}{
+		{workflow(), http.StatusOK, nil},
+		{clusterRole, http.StatusOK, nil},
+		{clusterRoleBinding, http.StatusForbidden, []string{"ClusterRoleBinding/foo: cluster-scoped kind rbac.authorization.k8s.io/v1/ClusterRoleBinding not allowed"}},
+		{otherNamespace, http.StatusForbidden, []string{"Workflow/hello-world-*: namespace kube-system not allowed, must be ci"}},
+		{&unstructured.UnstructuredList{Items: []unstructured.Unstructured{*workflow(), *clusterRoleBinding, *otherNamespace}}, http.StatusForbidden, []string{"ClusterRoleBinding/foo", "Workflow/hello-world-*: namespace"}},
+	} {
+		kc := &mockKubernetesClient{}
+		handler := NewGithubHookHandler(log.NewNopLogger(), config, kc, &mockLoader{obj: test.obj}, newTestMetrics())
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newDeleteRequest(""))
+		if w.Code != test.status {
+			t.Fatalf("Expected status %d but got %d: %s", test.status, w.Code, w.Body.String())
+		}
+		for _, msg := range test.messages {
+			if !strings.Contains(w.Body.String(), msg) {
+				t.Fatalf("Expected %q in response: %s", msg, w.Body.String())
+			}
+		}
+		if test.status != http.StatusOK && kc.obj != nil {
+			t.Fatalf("Expected object not to be applied")
+		}
+	}
+}
+
+func TestHandleAdmission(t *testing.T) {
+	policies, err := NewAdmissionPolicies([]*AdmissionRule{
+		{Name: "deadline", Action: ActionWarn, CEL: `has(object.spec)`, Message: "No spec"},
+		{Name: "generate-name", CEL: `object.metadata.generateName != "forbidden-"`, Message: "Forbidden name"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	forbidden := workflow()
+	forbidden.SetGenerateName("forbidden-")
+
+	for _, test := range []struct {
+		obj     runtime.Object
+		status  int
+		message string
+	}{
+		{workflow(), http.StatusOK, "Objects:\n- Workflow ci/hello-world-abcde: created\nAdmission findings:\n- warn: Workflow/hello-world-*: No spec (deadline)"},
+		{forbidden, http.StatusForbidden, "deny: Workflow/forbidden-*: Forbidden name (generate-name)"},
+	} {
+		kc := &mockKubernetesClient{}
+		handler := NewGithubHookHandler(log.NewNopLogger(), &Config{Namespace: "ci", Insecure: true}, kc, &mockLoader{obj: test.obj}, newTestMetrics())
+		handler.AdmissionPolicies = policies
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newDeleteRequest(""))
+		if w.Code != test.status {
+			t.Fatalf("Expected status %d but got %d: %s", test.status, w.Code, w.Body.String())
+		}
+		if !strings.Contains(w.Body.String(), test.message) {
+			t.Fatalf("Expected %q in response: %s", test.message, w.Body.String())
+		}
+		if (kc.obj != nil) != (test.status == http.StatusOK) {
+			t.Fatalf("Unexpected apply of %v", kc.obj)
+		}
+	}
+}
+
+func TestHandleImpersonate(t *testing.T) {
+	forbidden := apierrors.NewForbidden(schema.GroupResource{Group: "argoproj.io", Resource: "workflows"}, "", errors.New("denied"))
+	for _, test := range []struct {
+		global string
+		rules  []*Rule
+		err    error
+		user   string
+		status int
+	}{
+		{"", nil, nil, "", http.StatusOK},
+		{"system:serviceaccount:ci:repo-{{name}}", nil, nil, "system:serviceaccount:ci:repo-bar", http.StatusOK},
+		{"system:serviceaccount:ci:repo-{{name}}", []*Rule{{Repo: "foo/*", Impersonate: "system:serviceaccount:{{owner}}:ci"}}, nil, "system:serviceaccount:foo:ci", http.StatusOK},
+		{"system:serviceaccount:ci:repo-{{name}}", nil, forbidden, "system:serviceaccount:ci:repo-bar", http.StatusForbidden},
+	} {
+		kc := &mockKubernetesClient{err: test.err}
+		config := &Config{Namespace: "ci", Insecure: true, Impersonate: test.global, Rules: test.rules}
+		handler := NewGithubHookHandler(log.NewNopLogger(), config, kc, &mockLoader{}, newTestMetrics())
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newDeleteRequest(""))
+		if w.Code != test.status {
+			t.Fatalf("Expected status %d but got %d: %s", test.status, w.Code, w.Body.String())
+		}
+		if kc.user != test.user {
+			t.Fatalf("Expected user %q but got %q", test.user, kc.user)
+		}
+		if test.user != "" && test.status == http.StatusForbidden && !strings.Contains(w.Body.String(), test.user) {
+			t.Fatalf("Expected user in response: %s", w.Body.String())
+		}
+	}
+}
+
+func TestHandleNamespaceTemplate(t *testing.T) {
+	seed := &unstructured.Unstructured{Object: map[string]interface{}{"apiVersion": "rbac.authorization.k8s.io/v1", "kind": "RoleBinding", "metadata": map[string]interface{}{"name": "ci"}, "subjects": []interface{}{map[string]interface{}{"kind": "ServiceAccount", "name": "repo-{{name}}"}}}}
+	config := &Config{Insecure: true, NamespaceTemplate: "ci-{{name}}-{{shortref}}", NamespaceSeed: seed}
+	kc := &mockKubernetesClient{}
+	handler := NewGithubHookHandler(log.NewNopLogger(), config, kc, &mockLoader{}, newTestMetrics())
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newRequest("push", pushPayload, ""))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200 but got %d: %s", w.Code, w.Body.String())
+		}
+	}
+	labels, ok := kc.namespaces["ci-bar-feature-123"]
+	if !ok {
+		t.Fatalf("Namespace not created: %v", kc.namespaces)
+	}
+	if labels[RepoLabel] != "foo-bar" || labels[RefLabel] != "refs-heads-feature-123" {
+		t.Fatalf("Unexpected labels %v", labels)
+	}
+	if kc.namespace != "ci-bar-feature-123" {
+		t.Fatalf("Expected manifest to be applied to namespace but got %s", kc.namespace)
+	}
+	// seed, manifest, manifest
+	if len(kc.applied) != 3 {
+		t.Fatalf("Expected 3 applies but got %d", len(kc.applied))
+	}
+	subject, _, _ := unstructured.NestedSlice(kc.applied[0].(*unstructured.Unstructured).Object, "subjects")
+	if name := subject[0].(map[string]interface{})["name"]; name != "repo-bar" {
+		t.Fatalf("Expected seed to be expanded but got subject %s", name)
+	}
+	if subject, _, _ := unstructured.NestedSlice(seed.Object, "subjects"); subject[0].(map[string]interface{})["name"] != "repo-{{name}}" {
+		t.Fatalf("Seed template was modified")
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newDeleteRequest(""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 but got %d: %s", w.Code, w.Body.String())
+	}
+	if diff := cmp.Diff([]string{"ci-bar-feature-123"}, kc.deleted); diff != "" {
+		t.Fatalf("Not Equal (-want +got):\n%s", diff)
+	}
+	if len(kc.applied) != 3 {
+		t.Fatalf("Expected no apply on delete")
+	}
+}
+
+func TestHandleRunAnchor(t *testing.T) {
+	config := &Config{Namespace: "ci", Insecure: true, RunAnchor: RunAnchorConfigMap}
+	kc := &mockKubernetesClient{}
+	handler := NewGithubHookHandler(log.NewNopLogger(), config, kc, &mockLoader{}, newTestMetrics())
+
+	req := newRequest("push", pushPayload, "")
+	req.Header.Set("X-GitHub-Delivery", "4636FC67-b693-4a27-87a4-18d4021ae789")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 but got %d: %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), "Run: ConfigMap ci/webhook-run-4636fc67-b693-4a27-87a4-18d4021ae789") {
+		t.Fatalf("Expected run anchor in response but got: %s", w.Body.String())
+	}
+	// anchor, manifest
+	if len(kc.applied) != 2 {
+		t.Fatalf("Expected 2 applies but got %d", len(kc.applied))
+	}
+	anchor := kc.applied[0].(*unstructured.Unstructured)
+	if anchor.GetKind() != "ConfigMap" || anchor.GetAnnotations()[DeliveryAnnotation] != "4636FC67-b693-4a27-87a4-18d4021ae789" {
+		t.Fatalf("Unexpected anchor %v", anchor)
+	}
+	if diff := cmp.Diff(&metav1.OwnerReference{
+		APIVersion: "v1",
+		Kind:       "ConfigMap",
+		Name:       "webhook-run-4636fc67-b693-4a27-87a4-18d4021ae789",
+		UID:        "uid-webhook-run-4636fc67-b693-4a27-87a4-18d4021ae789",
+	}, kc.opts.Owner); diff != "" {
+		t.Fatalf("Not Equal (-want +got):\n%s", diff)
+	}
+}
+
+func TestHandleRunAnchorRetry(t *testing.T) {
+	config := &Config{Namespace: "ci", Insecure: true, RunAnchor: RunAnchorConfigMap}
+	kc := &anchoredClient{mockKubernetesClient: &mockKubernetesClient{}, err: errors.New("apply failed")}
+	handler := NewGithubHookHandler(log.NewNopLogger(), config, kc, &mockLoader{}, newTestMetrics())
+	deliver := func() int {
+		req := newRequest("push", pushPayload, "")
+		req.Header.Set("X-GitHub-Delivery", "1234")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := deliver(); code != http.StatusInternalServerError {
+		t.Fatalf("Expected status 500 but got %d", code)
+	}
+	if diff := cmp.Diff([]string{"ConfigMap ci/webhook-run-1234"}, kc.deletedObjects); diff != "" {
+		t.Fatalf("Unexpected deleted objects (-want +got):\n%s", diff)
+	}
+	// The failed delivery can be retried, a handled one can't.
+	kc.err = nil
+	if code := deliver(); code != http.StatusOK {
+		t.Fatalf("Expected status 200 but got %d", code)
+	}
+	if code := deliver(); code != http.StatusConflict {
+		t.Fatalf("Expected status 409 but got %d", code)
+	}
+	if len(kc.deletedObjects) != 1 {
+		t.Fatalf("Expected no further deletes but got %v", kc.deletedObjects)
+	}
+}
+
+func TestHandleRuns(t *testing.T) {
+	config := &Config{Namespace: "ci", Insecure: true, Rules: []*Rule{{Name: "foo", Repo: "foo/*"}}}
+	recorder := &mockRunRecorder{}
+	handler := NewGithubHookHandler(log.NewNopLogger(), config, &mockKubernetesClient{}, &mockLoader{}, newTestMetrics())
+	handler.Runs = recorder
+
+	req := newRequest("push", pushPayload, "")
+	req.Header.Set("X-GitHub-Delivery", "1234")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 but got %d: %s", w.Code, w.Body.String())
+	}
+	if len(recorder.runs) != 1 {
+		t.Fatalf("Expected 1 run but got %d", len(recorder.runs))
+	}
+	run := recorder.runs[0]
+	if diff := cmp.Diff(v1alpha1.WebhookRunSpec{
+		DeliveryID: "1234",
+		EventType:  "push",
+		Repo:       "foo/bar",
+		Ref:        "refs/heads/feature-123",
+		Revision:   run.Spec.Revision,
+		Rule:       "foo",
+		Namespace:  "ci",
+	}, run.Spec); diff != "" {
+		t.Fatalf("Not Equal (-want +got):\n%s", diff)
+	}
+	if run.Status.Phase != v1alpha1.RunSucceeded || len(run.Status.Objects) != 1 || run.Status.Objects[0].Outcome != OutcomeCreated {
+		t.Fatalf("Unexpected status %v", run.Status)
+	}
+	stages := []string{}
+	for _, s := range run.Status.Stages {
+		stages = append(stages, s.Name)
+	}
+	if diff := cmp.Diff([]string{"policy", "admission", "apply"}, stages); diff != "" {
+		t.Fatalf("Not Equal (-want +got):\n%s", diff)
+	}
+}
+
+func TestHandleRunsEarly(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		eventType string
+		payload   []byte
+		secret    string
+		phase     v1alpha1.RunPhase
+		repo      string
+	}{
+		// The repo of payloads with invalid signatures isn't trusted.
+		{"invalid signature", "push", pushPayload, "wrong", v1alpha1.RunRejected, ""},
+		{"ignored comment", "issue_comment", commentPayload("created", "LGTM", true), "", v1alpha1.RunSucceeded, "foo/bar"},
+		{"unsupported event", "foobar", []byte(`{"repository": {"full_name": "foo/bar"}}`), "", v1alpha1.RunRejected, "foo/bar"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			config := &Config{Namespace: "ci", Secret: []byte("secret"), Commands: []*CommandRule{{Command: "deploy"}}}
+			recorder := &mockRunRecorder{}
+			handler := NewGithubHookHandler(log.NewNopLogger(), config, &mockKubernetesClient{}, &mockLoader{}, newTestMetrics())
+			handler.Runs = recorder
+
+			secret := test.secret
+			if secret == "" {
+				secret = "secret"
+			}
+			req := newRequest(test.eventType, test.payload, secret)
+			req.Header.Set("X-GitHub-Delivery", "1234")
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+			if len(recorder.runs) != 1 {
+				t.Fatalf("Expected 1 run but got %d", len(recorder.runs))
+			}
+			run := recorder.runs[0]
+			if run.Spec.DeliveryID != "1234" || run.Spec.EventType != test.eventType || run.Spec.Repo != test.repo || run.Status.Phase != test.phase {
+				t.Fatalf("Unexpected run %v: %v", run.Spec, run.Status)
+			}
+		})
+	}
+}
+
+type mockLeader bool
+
+func (l mockLeader) IsLeader() bool { return bool(l) }
+
+func TestHandleReadiness(t *testing.T) {
+	config := &Config{HandlerReadinessPath: "/-/ready"}
+	for _, test := range []struct {
+		leader interface{ IsLeader() bool }
+		body   string
+	}{
+		{nil, "OK\n"},
+		{mockLeader(true), "OK, leader\n"},
+		{mockLeader(false), "OK, follower\n"},
+	} {
+		handler := NewGithubHookHandler(log.NewNopLogger(), config, &mockKubernetesClient{}, &mockLoader{}, newTestMetrics())
+		handler.Leader = test.leader
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/-/ready", nil))
+		if w.Code != http.StatusOK || w.Body.String() != test.body {
+			t.Fatalf("Expected 200 %q but got %d %q", test.body, w.Code, w.Body.String())
+		}
+	}
+}
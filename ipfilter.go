@@ -0,0 +1,147 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/google/go-github/v24/github"
+)
+
+// MetaClient gets GitHub's meta information, including the ranges webhooks
+// are sent from. It's implemented by *github.Client.
+type MetaClient interface {
+	APIMeta(ctx context.Context) (*github.APIMeta, *github.Response, error)
+}
+
+// SourceFilter allows requests only from configured networks and, if
+// enabled, GitHub's published hook ranges.
+type SourceFilter struct {
+	networks       []*net.IPNet
+	trustedProxies []*net.IPNet
+
+	// mu guards githubHooks, which is updated in the background.
+	mu          sync.RWMutex
+	githubHooks []*net.IPNet
+}
+
+// NewSourceFilter returns a filter allowing the given CIDRs. X-Forwarded-For
+// is only honored for requests from trustedProxies.
+func NewSourceFilter(cidrs, trustedProxies []string) (*SourceFilter, error) {
+	networks, err := parseCIDRs(cidrs)
+	if err != nil {
+		return nil, err
+	}
+	proxies, err := parseCIDRs(trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	return &SourceFilter{networks: networks, trustedProxies: proxies}, nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func contains(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed returns true if ip is in one of the allowed networks.
+func (f *SourceFilter) Allowed(ip net.IP) bool {
+	if contains(f.networks, ip) {
+		return true
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return contains(f.githubHooks, ip)
+}
+
+// ClientIP returns the address of the client which sent the request. If the
+// request comes from a trusted proxy, it's the right-most address in
+// X-Forwarded-For not belonging to a trusted proxy.
+func (f *SourceFilter) ClientIP(r *http.Request) (net.IP, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("Couldn't parse remote address %s", r.RemoteAddr)
+	}
+	if !contains(f.trustedProxies, ip) {
+		return ip, nil
+	}
+	forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if addr == "" {
+			continue
+		}
+		fip := net.ParseIP(addr)
+		if fip == nil {
+			return nil, fmt.Errorf("Couldn't parse forwarded address %s", addr)
+		}
+		ip = fip
+		if !contains(f.trustedProxies, ip) {
+			break
+		}
+	}
+	return ip, nil
+}
+
+// UpdateGithubHooks replaces the allowed GitHub hook ranges by the ones
+// currently published by GitHub.
+func (f *SourceFilter) UpdateGithubHooks(ctx context.Context, client MetaClient) error {
+	meta, _, err := client.APIMeta(ctx)
+	if err != nil {
+		return fmt.Errorf("Couldn't get GitHub meta: %s", err)
+	}
+	networks, err := parseCIDRs(meta.Hooks)
+	if err != nil {
+		return fmt.Errorf("Couldn't parse GitHub hook ranges: %s", err)
+	}
+	if len(networks) == 0 {
+		return fmt.Errorf("GitHub meta contains no hook ranges")
+	}
+	f.mu.Lock()
+	f.githubHooks = networks
+	f.mu.Unlock()
+	return nil
+}
+
+// RefreshGithubHooks updates the GitHub hook ranges every interval until
+// stopCh is closed. On errors, the previous ranges are kept.
+func (f *SourceFilter) RefreshGithubHooks(logger log.Logger, client MetaClient, interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			if err := f.UpdateGithubHooks(context.Background(), client); err != nil {
+				level.Error(logger).Log("msg", "Couldn't refresh GitHub hook ranges", "err", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-github/v24/github"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type mockMetaClient struct {
+	hooks []string
+	err   error
+}
+
+func (c *mockMetaClient) APIMeta(ctx context.Context) (*github.APIMeta, *github.Response, error) {
+	return &github.APIMeta{Hooks: c.hooks}, nil, c.err
+}
+
+func TestSourceFilterClientIP(t *testing.T) {
+	filter, err := NewSourceFilter(nil, []string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		remoteAddr string
+		forwarded  []string
+		expect     string
+	}{
+		{"192.0.2.1:1234", nil, "192.0.2.1"},
+		{"192.0.2.1:1234", []string{"198.51.100.1"}, "192.0.2.1"},
+		{"10.0.0.1:1234", nil, "10.0.0.1"},
+		{"10.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"10.0.0.1:1234", []string{"203.0.113.1, 198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"10.0.0.1:1234", []string{"203.0.113.1", "198.51.100.1"}, "198.51.100.1"},
+	} {
+		r := httptest.NewRequest("POST", "http://example.com/", nil)
+		r.RemoteAddr = test.remoteAddr
+		r.Header["X-Forwarded-For"] = test.forwarded
+		ip, err := filter.ClientIP(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ip.Equal(net.ParseIP(test.expect)) {
+			t.Fatalf("Expected %s but got %s for %v", test.expect, ip, test)
+		}
+	}
+}
+
+func TestSourceFilterAllowed(t *testing.T) {
+	filter, err := NewSourceFilter([]string{"192.0.2.0/24"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := filter.UpdateGithubHooks(context.Background(), &mockMetaClient{hooks: []string{"198.51.100.0/24"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := filter.UpdateGithubHooks(context.Background(), &mockMetaClient{err: errors.New("unavailable")}); err == nil {
+		t.Fatal("Expected error but got nil")
+	}
+	for ip, allowed := range map[string]bool{
+		"192.0.2.1":    true,
+		"198.51.100.1": true,
+		"203.0.113.1":  false,
+	} {
+		if filter.Allowed(net.ParseIP(ip)) != allowed {
+			t.Fatalf("Expected %s allowed to be %t", ip, allowed)
+		}
+	}
+}
+
+func TestHandleSourceFilter(t *testing.T) {
+	filter, err := NewSourceFilter([]string{"192.0.2.0/24"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{Namespace: "namespace", HandlerLivenessPath: "/-/alive", Insecure: true}
+	registry := prometheus.NewRegistry()
+	handler := NewGithubHookHandler(log.NewNopLogger(), config, &mockKubernetesClient{}, &mockLoader{}, NewMetrics(NewPrometheusProvider("test", registry), 10))
+	handler.SourceFilter = filter
+
+	for _, test := range []struct {
+		remoteAddr string
+		path       string
+		status     int
+	}{
+		{"203.0.113.1:1234", "/", http.StatusForbidden},
+		{"203.0.113.1:1234", "/-/alive", http.StatusOK},
+		{"192.0.2.1:1234", "/", http.StatusBadRequest},
+	} {
+		r := httptest.NewRequest("GET", "http://example.com"+test.path, nil)
+		r.RemoteAddr = test.remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Fatalf("Expected status %d but got %d for %v", test.status, w.Code, test)
+		}
+	}
+
+	// Rejected sources are counted as rejected errors.
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rejected float64
+	for _, family := range families {
+		if family.GetName() != "test_errors" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "status" && label.GetValue() == "403" {
+					rejected += metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	if rejected != 1 {
+		t.Fatalf("Expected 1 rejected request counted as error but got %v", rejected)
+	}
+}
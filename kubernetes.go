@@ -1,74 +1,523 @@
 package handler
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-kit/kit/metrics"
+	"go.opentelemetry.io/otel/trace"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
 	"k8s.io/client-go/dynamic"
-	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/restmapper"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/transport"
+)
+
+// NamespaceMode defines how the namespace set in a manifest is handled.
+type NamespaceMode string
+
+const (
+	// NamespaceReject forbids manifests setting a namespace other than the
+	// target namespace. This is the default.
+	NamespaceReject NamespaceMode = "reject"
+	// NamespaceForce applies all objects to the target namespace,
+	// regardless of the namespace set in the manifest.
+	NamespaceForce NamespaceMode = "force"
+	// NamespaceRespect applies objects to the namespace set in the manifest
+	// if the policy allows it and to the target namespace otherwise.
+	NamespaceRespect NamespaceMode = "respect"
+)
+
+// ApplyMode defines how failures to apply an object of a list are handled.
+type ApplyMode string
+
+const (
+	// ApplyFailFast stops at the first failure, leaving objects created
+	// before in place. This is the default.
+	ApplyFailFast ApplyMode = "fail-fast"
+	// ApplyAtomic stops at the first failure and deletes all objects
+	// created before.
+	ApplyAtomic ApplyMode = "atomic"
+	// ApplyBestEffort applies all objects, regardless of failures.
+	ApplyBestEffort ApplyMode = "best-effort"
 )
 
+// Validate returns an error if m is not a known mode.
+func (m ApplyMode) Validate() error {
+	switch m {
+	case "", ApplyFailFast, ApplyAtomic, ApplyBestEffort:
+		return nil
+	}
+	return fmt.Errorf("Invalid apply mode %q", m)
+}
+
+// Outcomes of applying an object.
+const (
+	OutcomeCreated        = "created"
+	OutcomeFailed         = "failed"
+	OutcomeSkipped        = "skipped"
+	OutcomeRolledBack     = "rolled-back"
+	OutcomeRollbackFailed = "rollback-failed"
+)
+
+// ApplyOptions configures how objects are applied.
+type ApplyOptions struct {
+	// Namespace is the target namespace for namespaced objects.
+	Namespace     string
+	NamespaceMode NamespaceMode
+	Mode          ApplyMode
+	// Owner, if set, is added to the ownerReferences of all objects
+	// applied to Namespace. Objects in other namespaces and cluster-scoped
+	// ones can't be owned by a namespaced object and are left alone.
+	Owner *metav1.OwnerReference
+}
+
+// AppliedObject reports the outcome of applying an object.
+type AppliedObject struct {
+	APIVersion string    `json:"apiVersion"`
+	Kind       string    `json:"kind"`
+	Namespace  string    `json:"namespace,omitempty"`
+	Name       string    `json:"name"`
+	UID        types.UID `json:"uid,omitempty"`
+	Outcome    string    `json:"outcome"`
+	Error      string    `json:"error,omitempty"`
+}
+
+func (o *AppliedObject) String() string {
+	if o.Namespace == "" {
+		return o.Kind + " " + o.Name
+	}
+	return o.Kind + " " + o.Namespace + "/" + o.Name
+}
+
 type KubernetesClient interface {
-	Apply(obj runtime.Object, namespace string) error
+	// Apply creates the objects in dependency order and returns the outcome
+	// for each of them.
+	Apply(ctx context.Context, obj runtime.Object, opts *ApplyOptions) ([]*AppliedObject, error)
+	// Impersonate returns a client acting as user.
+	Impersonate(user string) (KubernetesClient, error)
+	// EnsureNamespace creates the namespace if it doesn't exist and returns
+	// true if it was created.
+	EnsureNamespace(name string, labels, annotations map[string]string) (bool, error)
+	// DeleteNamespace deletes the namespace if it has all given labels.
+	DeleteNamespace(name string, labels map[string]string) error
+	// Delete deletes an applied object and, before it, the objects it
+	// owns.
+	Delete(ctx context.Context, obj *AppliedObject) error
+	Mapper
 }
 
+var namespaceResource = schema.GroupVersionResource{Version: "v1", Resource: "namespaces"}
+
+// discoveryResetInterval is the minimum interval between refreshes of the
+// discovery information caused by unknown kinds. Other unknown kinds are
+// left to the periodic refresh.
+const discoveryResetInterval = 30 * time.Second
+
 type kubernetesClient struct {
 	dynamic.Interface
 	meta.RESTMapper
+
+	// refreshCounter counts discovery refreshes if set.
+	refreshCounter metrics.Counter
+	// resets rate limits the refreshes caused by unknown kinds if set. It's
+	// shared with the impersonated clients.
+	resets *resetLimiter
+
+	config *rest.Config
+	// impersonated caches the clients returned by Impersonate by user.
+	impersonated map[string]*kubernetesClient
+	mu           sync.Mutex
 }
 
-func NewKubernetesClient(kubeconfig string) (*kubernetesClient, error) {
-	config, err := buildKubernetesConfig(kubeconfig)
-	if err != nil {
-		return nil, err
+// resetter is implemented by RESTMappers caching discovery information.
+type resetter interface {
+	Reset()
+}
+
+// resetLimiter allows one reset per interval.
+type resetLimiter struct {
+	interval time.Duration
+	mu       sync.Mutex
+	last     time.Time
+}
+
+// allow returns true and records the reset if the last one is at least
+// interval ago. A nil limiter allows all resets.
+func (l *resetLimiter) allow() bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if !l.last.IsZero() && now.Sub(l.last) < l.interval {
+		return false
 	}
+	l.last = now
+	return true
+}
 
+// NewKubernetesClient returns a client for config. Discovery information is
+// cached and refreshed when a kind can't be found, at most once per
+// discoveryResetInterval. The refreshes are counted in refreshCounter.
+func NewKubernetesClient(config *rest.Config, refreshCounter metrics.Counter) (*kubernetesClient, error) {
 	intf, err := dynamic.NewForConfig(config)
 	if err != nil {
 		return nil, err
 	}
-	clientset, err := kubernetes.NewForConfig(config)
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
 	if err != nil {
 		return nil, err
 	}
 
-	groupResources, err := restmapper.GetAPIGroupResources(clientset.Discovery())
-	if err != nil {
+	mapper := restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discoveryClient))
+	// Fail early if discovery doesn't work at all.
+	if _, err := mapper.RESTMapping(schema.GroupKind{Kind: "Namespace"}, "v1"); err != nil {
 		return nil, err
 	}
 	return &kubernetesClient{
-		Interface:  intf,
-		RESTMapper: restmapper.NewDiscoveryRESTMapper(groupResources),
+		Interface:      intf,
+		RESTMapper:     mapper,
+		refreshCounter: refreshCounter,
+		resets:         &resetLimiter{interval: discoveryResetInterval},
+		config:         config,
+		impersonated:   map[string]*kubernetesClient{},
 	}, nil
 }
 
-func buildKubernetesConfig(kubeconfig string) (config *rest.Config, err error) {
+// RESTMapping returns the mapping for gk. If gk isn't known, e.g. because a
+// CRD was installed after the discovery information was cached, the cache is
+// refreshed and the lookup retried once. To keep manifests with bogus kinds
+// from invalidating the cache all the time, this happens at most once per
+// discoveryResetInterval.
+func (k *kubernetesClient) RESTMapping(gk schema.GroupKind, versions ...string) (*meta.RESTMapping, error) {
+	mapping, err := k.RESTMapper.RESTMapping(gk, versions...)
+	if err == nil || !meta.IsNoMatchError(err) {
+		return mapping, err
+	}
+	if !k.resets.allow() || !k.resetDiscovery() {
+		return nil, err
+	}
+	return k.RESTMapper.RESTMapping(gk, versions...)
+}
+
+// resetDiscovery invalidates the cached discovery information. It returns
+// false if the RESTMapper doesn't support it.
+func (k *kubernetesClient) resetDiscovery() bool {
+	r, ok := k.RESTMapper.(resetter)
+	if !ok {
+		return false
+	}
+	r.Reset()
+	if k.refreshCounter != nil {
+		k.refreshCounter.Add(1)
+	}
+	return true
+}
+
+// RefreshDiscovery refreshes the discovery information every interval until
+// stopCh is closed.
+func (k *kubernetesClient) RefreshDiscovery(logger log.Logger, interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			if !k.resetDiscovery() {
+				return
+			}
+			if _, err := k.RESTMapper.RESTMapping(schema.GroupKind{Kind: "Namespace"}, "v1"); err != nil {
+				level.Error(logger).Log("msg", "Couldn't refresh discovery information", "err", err)
+			}
+		}
+	}
+}
+
+func (k *kubernetesClient) Impersonate(user string) (KubernetesClient, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if client, ok := k.impersonated[user]; ok {
+		return client, nil
+	}
+	config := rest.CopyConfig(k.config)
+	config.Impersonate = rest.ImpersonationConfig{UserName: user}
+	intf, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	client := &kubernetesClient{
+		Interface:      intf,
+		RESTMapper:     k.RESTMapper,
+		refreshCounter: k.refreshCounter,
+		resets:         k.resets,
+		config:         config,
+		impersonated:   map[string]*kubernetesClient{},
+	}
+	k.impersonated[user] = client
+	return client, nil
+}
+
+// BuildKubernetesConfig returns the config for the given kubeconfig or the
+// in-cluster config if kubeconfig is empty.
+func BuildKubernetesConfig(kubeconfig string) (config *rest.Config, err error) {
 	if kubeconfig != "" {
 		return clientcmd.BuildConfigFromFlags("", kubeconfig)
 	}
 	return rest.InClusterConfig()
 }
 
-func (k *kubernetesClient) Apply(obj runtime.Object, namespace string) error {
-	switch obj := obj.(type) {
-	case *unstructured.Unstructured:
-		gvk := obj.GroupVersionKind()
-		gk := schema.GroupKind{Group: gvk.Group, Kind: gvk.Kind}
+func (k *kubernetesClient) Apply(ctx context.Context, obj runtime.Object, opts *ApplyOptions) (results []*AppliedObject, err error) {
+	ctx, span := startSpan(ctx, "kubernetesClient.Apply", trace.WithAttributes(
+		attrDelivery.String(DeliveryID(ctx)),
+		attrNamespace.String(opts.Namespace),
+		attrApplyMode.String(string(opts.Mode)),
+	))
+	defer func() { endSpan(span, err) }()
 
-		mapping, err := k.RESTMapper.RESTMapping(gk, gvk.Version)
+	objs := []*unstructured.Unstructured{}
+	if err := eachObject(obj, func(o *unstructured.Unstructured) error {
+		objs = append(objs, o)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	sortByDependency(objs)
+	span.SetAttributes(attrObjects.Int(len(objs)))
+	intf, err := k.withContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	results = make([]*AppliedObject, len(objs))
+	var (
+		clients = make([]dynamic.ResourceInterface, len(objs))
+		errs    = []error{}
+	)
+	for i, o := range objs {
+		result := &AppliedObject{APIVersion: o.GetAPIVersion(), Kind: o.GetKind(), Namespace: o.GetNamespace(), Name: objectName(o)}
+		results[i] = result
+		if len(errs) > 0 && opts.Mode != ApplyBestEffort {
+			result.Outcome = OutcomeSkipped
+			continue
+		}
+		client, created, err := k.apply(intf, o, opts)
 		if err != nil {
-			return err
+			result.Outcome = OutcomeFailed
+			result.Error = err.Error()
+			errs = append(errs, err)
+			continue
 		}
-		if _, err := k.Interface.Resource(mapping.Resource).Namespace(namespace).Create(obj, metav1.CreateOptions{}); err != nil {
-			return err
+		result.Outcome = OutcomeCreated
+		result.Namespace = created.GetNamespace()
+		result.Name = created.GetName()
+		result.UID = created.GetUID()
+		clients[i] = client
+	}
+	if len(errs) > 0 && opts.Mode == ApplyAtomic {
+		errs = append(errs, rollback(results, clients)...)
+	}
+	switch len(errs) {
+	case 0:
+		return results, nil
+	case 1:
+		return results, errs[0]
+	}
+	return results, utilerrors.NewAggregate(errs)
+}
+
+// rollback deletes all created objects in reverse order.
+func rollback(results []*AppliedObject, clients []dynamic.ResourceInterface) []error {
+	errs := []error{}
+	propagation := metav1.DeletePropagationBackground
+	for i := len(results) - 1; i >= 0; i-- {
+		result := results[i]
+		if result.Outcome != OutcomeCreated {
+			continue
 		}
-	case *unstructured.UnstructuredList:
-		return obj.EachListItem(func(o runtime.Object) error { return k.Apply(o, namespace) })
+		if err := clients[i].Delete(result.Name, &metav1.DeleteOptions{PropagationPolicy: &propagation}); err != nil && !apierrors.IsNotFound(err) {
+			result.Outcome = OutcomeRollbackFailed
+			result.Error = err.Error()
+			errs = append(errs, fmt.Errorf("Couldn't roll back %s: %s", result, err))
+			continue
+		}
+		result.Outcome = OutcomeRolledBack
+	}
+	return errs
+}
+
+// objectName returns the name of obj or, if it's not set yet, its
+// generateName suffixed by '*'.
+func objectName(obj *unstructured.Unstructured) string {
+	if name := obj.GetName(); name != "" {
+		return name
+	}
+	if generateName := obj.GetGenerateName(); generateName != "" {
+		return generateName + "*"
+	}
+	return ""
+}
+
+// dependencyOrder defines the order in which kinds are applied. Kinds not
+// listed are applied last.
+var dependencyOrder = map[string]int{
+	"Namespace":                0,
+	"CustomResourceDefinition": 1,
+	"ServiceAccount":           2,
+	"ClusterRole":              3,
+	"Role":                     3,
+	"ClusterRoleBinding":       4,
+	"RoleBinding":              4,
+	"ConfigMap":                5,
+	"Secret":                   5,
+}
+
+func dependencyRank(obj *unstructured.Unstructured) int {
+	if rank, ok := dependencyOrder[obj.GetKind()]; ok {
+		return rank
+	}
+	return len(dependencyOrder)
+}
+
+// sortByDependency sorts objs so that objects others may depend on come
+// first. The order of objects of the same rank is preserved.
+func sortByDependency(objs []*unstructured.Unstructured) {
+	sort.SliceStable(objs, func(i, j int) bool {
+		return dependencyRank(objs[i]) < dependencyRank(objs[j])
+	})
+}
+
+// withContext returns a dynamic client sending its requests with the span
+// of ctx. The dynamic client doesn't take a context per call, so a client
+// sharing the underlying transport is built for each ctx. The cancellation
+// of ctx isn't propagated, so applies aren't aborted halfway, e.g. when
+// GitHub drops a slow delivery, and atomic rollbacks still work. Without a
+// config, as in tests, the client is returned as is.
+func (k *kubernetesClient) withContext(ctx context.Context) (dynamic.Interface, error) {
+	if k.config == nil {
+		return k.Interface, nil
+	}
+	ctx = trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx))
+	config := rest.CopyConfig(k.config)
+	config.WrapTransport = transport.Wrappers(config.WrapTransport, func(rt http.RoundTripper) http.RoundTripper {
+		return &contextTransport{ctx: ctx, rt: rt}
+	})
+	return dynamic.NewForConfig(config)
+}
+
+func (k *kubernetesClient) apply(intf dynamic.Interface, obj *unstructured.Unstructured, opts *ApplyOptions) (dynamic.ResourceInterface, *unstructured.Unstructured, error) {
+	gvk := obj.GroupVersionKind()
+	gk := schema.GroupKind{Group: gvk.Group, Kind: gvk.Kind}
+
+	mapping, err := k.RESTMapping(gk, gvk.Version)
+	if err != nil {
+		return nil, nil, err
+	}
+	var client dynamic.ResourceInterface = intf.Resource(mapping.Resource)
+	if isClusterScoped(mapping) {
+		obj.SetNamespace("")
+	} else {
+		namespace := opts.Namespace
+		if opts.NamespaceMode == NamespaceRespect && obj.GetNamespace() != "" {
+			namespace = obj.GetNamespace()
+		}
+		obj.SetNamespace(namespace)
+		if opts.Owner != nil && namespace == opts.Namespace {
+			obj.SetOwnerReferences(append(obj.GetOwnerReferences(), *opts.Owner))
+		}
+		client = intf.Resource(mapping.Resource).Namespace(namespace)
+	}
+	created, err := client.Create(obj, metav1.CreateOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, created, nil
+}
+
+func isClusterScoped(mapping *meta.RESTMapping) bool {
+	return mapping.Scope != nil && mapping.Scope.Name() == meta.RESTScopeNameRoot
+}
+
+func (k *kubernetesClient) EnsureNamespace(name string, labels, annotations map[string]string) (bool, error) {
+	client := k.Interface.Resource(namespaceResource)
+	if _, err := client.Get(name, metav1.GetOptions{}); err == nil {
+		return false, nil
+	} else if !apierrors.IsNotFound(err) {
+		return false, err
+	}
+	ns := &unstructured.Unstructured{}
+	ns.SetAPIVersion("v1")
+	ns.SetKind("Namespace")
+	ns.SetName(name)
+	ns.SetLabels(labels)
+	ns.SetAnnotations(annotations)
+	if _, err := client.Create(ns, metav1.CreateOptions{}); err != nil {
+		if apierrors.IsAlreadyExists(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (k *kubernetesClient) Delete(ctx context.Context, obj *AppliedObject) error {
+	gv, err := schema.ParseGroupVersion(obj.APIVersion)
+	if err != nil {
+		return err
+	}
+	mapping, err := k.RESTMapping(gv.WithKind(obj.Kind).GroupKind(), gv.Version)
+	if err != nil {
+		return err
+	}
+	intf, err := k.withContext(ctx)
+	if err != nil {
+		return err
+	}
+	var client dynamic.ResourceInterface = intf.Resource(mapping.Resource)
+	if !isClusterScoped(mapping) {
+		client = intf.Resource(mapping.Resource).Namespace(obj.Namespace)
+	}
+	propagation := metav1.DeletePropagationForeground
+	opts := &metav1.DeleteOptions{PropagationPolicy: &propagation}
+	if obj.UID != "" {
+		opts.Preconditions = &metav1.Preconditions{UID: &obj.UID}
+	}
+	if err := client.Delete(obj.Name, opts); err != nil && !apierrors.IsNotFound(err) {
+		return err
 	}
 	return nil
 }
+
+func (k *kubernetesClient) DeleteNamespace(name string, labels map[string]string) error {
+	client := k.Interface.Resource(namespaceResource)
+	ns, err := client.Get(name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	nsLabels := ns.GetLabels()
+	for key, value := range labels {
+		if nsLabels[key] != value {
+			return fmt.Errorf("Refusing to delete namespace %s, label %s is %q instead of %q", name, key, nsLabels[key], value)
+		}
+	}
+	return client.Delete(name, &metav1.DeleteOptions{})
+}
@@ -1,19 +1,37 @@
 package handler
 
 import (
+	"context"
+	"errors"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/go-kit/kit/metrics/generic"
 	"github.com/google/go-cmp/cmp"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
 )
 
 type fakeRESTMapper struct {
 	schema.GroupKind
+	// stale makes RESTMapping fail with a NoKindMatchError until Reset is
+	// called, like a cached mapper missing a newly installed CRD.
+	stale  bool
+	resets int
+}
+
+func (m *fakeRESTMapper) Reset() {
+	m.stale = false
+	m.resets++
 }
 
 func (m *fakeRESTMapper) KindFor(resource schema.GroupVersionResource) (schema.GroupVersionKind, error) {
@@ -31,8 +49,15 @@ func (m *fakeRESTMapper) ResourcesFor(input schema.GroupVersionResource) ([]sche
 }
 
 func (m *fakeRESTMapper) RESTMapping(gk schema.GroupKind, versions ...string) (*meta.RESTMapping, error) {
+	if m.stale || gk.Kind == "Unknown" {
+		return nil, &meta.NoKindMatchError{GroupKind: gk, SearchedVersions: versions}
+	}
 	m.GroupKind = gk
-	return &meta.RESTMapping{Resource: schema.GroupVersionResource{Group: gk.Group}}, nil
+	mapping := &meta.RESTMapping{Resource: schema.GroupVersionResource{Group: gk.Group, Resource: strings.ToLower(gk.Kind) + "s"}}
+	if strings.HasPrefix(gk.Kind, "Cluster") {
+		mapping.Scope = meta.RESTScopeRoot
+	}
+	return mapping, nil
 }
 
 func (m *fakeRESTMapper) RESTMappings(gk schema.GroupKind, versions ...string) ([]*meta.RESTMapping, error) {
@@ -51,9 +76,13 @@ func TestApply(t *testing.T) {
 		RESTMapper: &fakeRESTMapper{},
 		Interface:  fake.NewSimpleDynamicClient(scheme),
 	}
-	if err := client.Apply(obj, "default"); err != nil {
+	applied, err := client.Apply(context.Background(), obj, &ApplyOptions{Namespace: "default"})
+	if err != nil {
 		t.Fatal(err)
 	}
+	if diff := cmp.Diff([]*AppliedObject{{APIVersion: "argoproj.io/v1alpha1", Kind: "Workflow", Namespace: "default", Outcome: OutcomeCreated}}, applied); diff != "" {
+		t.Fatalf("Not Equal (-want +got):\n%s", diff)
+	}
 
 	gvk := obj.GroupVersionKind()
 	gk := schema.GroupKind{Group: gvk.Group, Kind: gvk.Kind}
@@ -68,3 +97,276 @@ func TestApply(t *testing.T) {
 		t.Fatalf("Not Equal (-want +got):\n%s", diff)
 	}
 }
+
+func TestImpersonate(t *testing.T) {
+	client := &kubernetesClient{
+		RESTMapper:   &fakeRESTMapper{},
+		config:       &rest.Config{Host: "https://example.com"},
+		impersonated: map[string]*kubernetesClient{},
+	}
+	ic, err := client.Impersonate("system:serviceaccount:ci:foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	impersonated := ic.(*kubernetesClient)
+	if impersonated.config.Impersonate.UserName != "system:serviceaccount:ci:foo" {
+		t.Fatalf("Unexpected impersonation config %v", impersonated.config.Impersonate)
+	}
+	if client.config.Impersonate.UserName != "" {
+		t.Fatalf("Original config was modified")
+	}
+	if impersonated.RESTMapper != client.RESTMapper {
+		t.Fatalf("Expected RESTMapper to be shared")
+	}
+	again, err := client.Impersonate("system:serviceaccount:ci:foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != ic {
+		t.Fatalf("Expected client to be cached")
+	}
+}
+
+func TestNamespaceLifecycle(t *testing.T) {
+	client := &kubernetesClient{
+		RESTMapper: &fakeRESTMapper{},
+		Interface:  fake.NewSimpleDynamicClient(runtime.NewScheme()),
+	}
+	labels := map[string]string{RepoLabel: "foo-bar"}
+	for i, expect := range []bool{true, false} {
+		created, err := client.EnsureNamespace("ci-foo", labels, map[string]string{"foo": "bar"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if created != expect {
+			t.Fatalf("Expected created to be %t on attempt %d", expect, i)
+		}
+	}
+	ns, err := client.Interface.Resource(namespaceResource).Get("ci-foo", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(labels, ns.GetLabels()); diff != "" {
+		t.Fatalf("Not Equal (-want +got):\n%s", diff)
+	}
+
+	if err := client.DeleteNamespace("ci-foo", map[string]string{RepoLabel: "other"}); err == nil {
+		t.Fatal("Expected error deleting namespace with other labels")
+	}
+	if err := client.DeleteNamespace("ci-foo", labels); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Interface.Resource(namespaceResource).Get("ci-foo", metav1.GetOptions{}); err == nil {
+		t.Fatal("Expected namespace to be deleted")
+	}
+}
+
+func TestRESTMappingRetry(t *testing.T) {
+	for _, test := range []struct {
+		stale       bool
+		kind        string
+		resets      int
+		expectError bool
+	}{
+		{false, "Workflow", 0, false},
+		{true, "Workflow", 1, false},
+		{false, "Unknown", 1, true},
+	} {
+		mapper := &fakeRESTMapper{stale: test.stale}
+		counter := generic.NewCounter("discovery_refreshes")
+		client := &kubernetesClient{
+			RESTMapper:     mapper,
+			Interface:      fake.NewSimpleDynamicClient(runtime.NewScheme()),
+			refreshCounter: counter,
+		}
+		obj := &unstructured.Unstructured{Object: map[string]interface{}{"apiVersion": "argoproj.io/v1alpha1", "kind": test.kind, "metadata": map[string]interface{}{"name": "foo"}}}
+		_, err := client.Apply(context.Background(), obj, &ApplyOptions{Namespace: "default"})
+		if test.expectError {
+			if !meta.IsNoMatchError(err) {
+				t.Fatalf("Expected NoKindMatchError but got %v", err)
+			}
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if mapper.resets != test.resets || int(counter.Value()) != test.resets {
+			t.Fatalf("Expected %d resets but got %d (counter %f)", test.resets, mapper.resets, counter.Value())
+		}
+	}
+}
+
+func TestRESTMappingResetLimit(t *testing.T) {
+	mapper := &fakeRESTMapper{}
+	client := &kubernetesClient{
+		RESTMapper: mapper,
+		Interface:  fake.NewSimpleDynamicClient(runtime.NewScheme()),
+		resets:     &resetLimiter{interval: time.Hour},
+	}
+	gk := schema.GroupKind{Group: "argoproj.io", Kind: "Unknown"}
+	for i := 0; i < 3; i++ {
+		if _, err := client.RESTMapping(gk); !meta.IsNoMatchError(err) {
+			t.Fatalf("Expected NoKindMatchError but got %v", err)
+		}
+	}
+	if mapper.resets != 1 {
+		t.Fatalf("Expected 1 reset but got %d", mapper.resets)
+	}
+
+	// A stale cache is refreshed again once the interval passed.
+	client.resets.last = time.Now().Add(-time.Hour)
+	mapper.stale = true
+	if _, err := client.RESTMapping(schema.GroupKind{Group: "argoproj.io", Kind: "Workflow"}); err != nil {
+		t.Fatal(err)
+	}
+	if mapper.resets != 2 {
+		t.Fatalf("Expected 2 resets but got %d", mapper.resets)
+	}
+}
+
+func TestApplyScope(t *testing.T) {
+	var (
+		workflowResource    = schema.GroupVersionResource{Group: "argoproj.io", Resource: "workflows"}
+		clusterRoleResource = schema.GroupVersionResource{Group: "rbac.authorization.k8s.io", Resource: "clusterroles"}
+	)
+	for _, test := range []struct {
+		mode      NamespaceMode
+		kind      string
+		namespace string
+		resource  schema.GroupVersionResource
+		expectNS  string
+	}{
+		{NamespaceReject, "Workflow", "", workflowResource, "ci"},
+		{NamespaceForce, "Workflow", "other", workflowResource, "ci"},
+		{NamespaceRespect, "Workflow", "other", workflowResource, "other"},
+		{NamespaceRespect, "Workflow", "", workflowResource, "ci"},
+		{NamespaceRespect, "ClusterRole", "other", clusterRoleResource, ""},
+	} {
+		client := &kubernetesClient{
+			RESTMapper: &fakeRESTMapper{},
+			Interface:  fake.NewSimpleDynamicClient(runtime.NewScheme()),
+		}
+		obj := &unstructured.Unstructured{Object: map[string]interface{}{"apiVersion": test.resource.Group + "/v1", "kind": test.kind, "metadata": map[string]interface{}{"name": "foo"}}}
+		if test.namespace != "" {
+			obj.SetNamespace(test.namespace)
+		}
+		applied, err := client.Apply(context.Background(), obj, &ApplyOptions{Namespace: "ci", NamespaceMode: test.mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(applied) != 1 || applied[0].Namespace != test.expectNS || applied[0].Name != "foo" {
+			t.Fatalf("Unexpected applied objects %v for %v", applied, test)
+		}
+		var rc dynamic.ResourceInterface = client.Interface.Resource(test.resource)
+		if test.expectNS != "" {
+			rc = client.Interface.Resource(test.resource).Namespace(test.expectNS)
+		}
+		if _, err := rc.Get("foo", metav1.GetOptions{}); err != nil {
+			t.Fatalf("Couldn't get object for %v: %s", test, err)
+		}
+	}
+}
+
+func TestApplyModes(t *testing.T) {
+	newObj := func(apiVersion, kind, name string) unstructured.Unstructured {
+		return unstructured.Unstructured{Object: map[string]interface{}{"apiVersion": apiVersion, "kind": kind, "metadata": map[string]interface{}{"name": name}}}
+	}
+	outcomes := func(applied []*AppliedObject) []string {
+		o := make([]string, len(applied))
+		for i, a := range applied {
+			o[i] = a.Kind + "/" + a.Name + ": " + a.Outcome
+		}
+		return o
+	}
+
+	for _, test := range []struct {
+		mode     ApplyMode
+		outcomes []string
+		exist    []string
+	}{
+		{ApplyFailFast, []string{"ServiceAccount/sa: created", "ConfigMap/cm: failed", "Workflow/a: skipped", "Workflow/b: skipped"}, []string{"serviceaccounts/sa"}},
+		{ApplyAtomic, []string{"ServiceAccount/sa: rolled-back", "ConfigMap/cm: failed", "Workflow/a: skipped", "Workflow/b: skipped"}, []string{}},
+		{ApplyBestEffort, []string{"ServiceAccount/sa: created", "ConfigMap/cm: failed", "Workflow/a: created", "Workflow/b: created"}, []string{"serviceaccounts/sa", "workflows/a", "workflows/b"}},
+	} {
+		dc := fake.NewSimpleDynamicClient(runtime.NewScheme())
+		dc.PrependReactor("create", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			return true, nil, errors.New("boom")
+		})
+		client := &kubernetesClient{RESTMapper: &fakeRESTMapper{}, Interface: dc}
+		list := &unstructured.UnstructuredList{Items: []unstructured.Unstructured{
+			newObj("argoproj.io/v1alpha1", "Workflow", "a"),
+			newObj("v1", "ServiceAccount", "sa"),
+			newObj("argoproj.io/v1alpha1", "Workflow", "b"),
+			newObj("v1", "ConfigMap", "cm"),
+		}}
+
+		applied, err := client.Apply(context.Background(), list, &ApplyOptions{Namespace: "ci", Mode: test.mode})
+		if err == nil {
+			t.Fatalf("Expected error for mode %s", test.mode)
+		}
+		if diff := cmp.Diff(test.outcomes, outcomes(applied)); diff != "" {
+			t.Fatalf("Not Equal for mode %s (-want +got):\n%s", test.mode, diff)
+		}
+		exist := []string{}
+		for _, gvr := range []schema.GroupVersionResource{{Resource: "serviceaccounts"}, {Resource: "configmaps"}, {Group: "argoproj.io", Resource: "workflows"}} {
+			for _, name := range []string{"sa", "cm", "a", "b"} {
+				if _, err := dc.Resource(gvr).Namespace("ci").Get(name, metav1.GetOptions{}); err == nil {
+					exist = append(exist, gvr.Resource+"/"+name)
+				}
+			}
+		}
+		if diff := cmp.Diff(test.exist, exist); diff != "" {
+			t.Fatalf("Not Equal for mode %s (-want +got):\n%s", test.mode, diff)
+		}
+	}
+}
+
+func TestApplyOwner(t *testing.T) {
+	dc := fake.NewSimpleDynamicClient(runtime.NewScheme())
+	client := &kubernetesClient{RESTMapper: &fakeRESTMapper{}, Interface: dc}
+	owner := &metav1.OwnerReference{APIVersion: "v1", Kind: "ConfigMap", Name: "webhook-run-1234", UID: "1234"}
+	list := &unstructured.UnstructuredList{Items: []unstructured.Unstructured{
+		{Object: map[string]interface{}{"apiVersion": "v1", "kind": "ConfigMap", "metadata": map[string]interface{}{"name": "same"}}},
+		{Object: map[string]interface{}{"apiVersion": "v1", "kind": "ConfigMap", "metadata": map[string]interface{}{"name": "other", "namespace": "other"}}},
+		{Object: map[string]interface{}{"apiVersion": "rbac.authorization.k8s.io/v1", "kind": "ClusterRole", "metadata": map[string]interface{}{"name": "cluster"}}},
+	}}
+	if _, err := client.Apply(context.Background(), list, &ApplyOptions{Namespace: "ci", NamespaceMode: NamespaceRespect, Owner: owner}); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		gvr       schema.GroupVersionResource
+		namespace string
+		name      string
+		owned     bool
+	}{
+		{schema.GroupVersionResource{Resource: "configmaps"}, "ci", "same", true},
+		{schema.GroupVersionResource{Resource: "configmaps"}, "other", "other", false},
+		{schema.GroupVersionResource{Group: "rbac.authorization.k8s.io", Resource: "clusterroles"}, "", "cluster", false},
+	} {
+		obj, err := dc.Resource(test.gvr).Namespace(test.namespace).Get(test.name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if owned := len(obj.GetOwnerReferences()) > 0; owned != test.owned {
+			t.Fatalf("Expected %s owned to be %t but got %v", test.name, test.owned, obj.GetOwnerReferences())
+		}
+	}
+}
+
+func TestDelete(t *testing.T) {
+	client := &kubernetesClient{RESTMapper: &fakeRESTMapper{}, Interface: fake.NewSimpleDynamicClient(runtime.NewScheme())}
+	anchor := &unstructured.Unstructured{Object: map[string]interface{}{"apiVersion": "v1", "kind": "ConfigMap", "metadata": map[string]interface{}{"name": "webhook-run-1234"}}}
+	applied, err := client.Apply(context.Background(), anchor, &ApplyOptions{Namespace: "ci", NamespaceMode: NamespaceForce})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Delete(context.Background(), applied[0]); err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Interface.Resource(schema.GroupVersionResource{Resource: "configmaps"}).Namespace("ci").Get("webhook-run-1234", metav1.GetOptions{})
+	if !apierrors.IsNotFound(err) {
+		t.Fatalf("Expected NotFound but got %v", err)
+	}
+	// Deleting objects which are gone already succeeds.
+	if err := client.Delete(context.Background(), applied[0]); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,122 @@
+package handler
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-kit/kit/metrics"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// Controller runs in the background until stopCh is closed.
+type Controller func(stopCh <-chan struct{})
+
+// LeaderElectionConfig configures the Lease used for leader election.
+type LeaderElectionConfig struct {
+	Namespace     string
+	Name          string
+	Identity      string
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+}
+
+// LeaderElector runs controllers only while holding a Lease, so they are
+// run by one replica at a time.
+type LeaderElector struct {
+	log.Logger
+	config leaderelection.LeaderElectionConfig
+	leader int32
+
+	leaderGauge        metrics.Gauge
+	transitionsCounter metrics.Counter
+}
+
+// NewLeaderElector returns an elector for the Lease described by config.
+// leaderGauge is 1 while leading and 0 otherwise, transitionsCounter counts
+// changes of the leader.
+func NewLeaderElector(logger log.Logger, client kubernetes.Interface, config *LeaderElectionConfig, leaderGauge metrics.Gauge, transitionsCounter metrics.Counter) *LeaderElector {
+	e := &LeaderElector{
+		Logger:             log.With(logger, "identity", config.Identity),
+		leaderGauge:        leaderGauge,
+		transitionsCounter: transitionsCounter,
+	}
+	e.config = leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta:  metav1.ObjectMeta{Namespace: config.Namespace, Name: config.Name},
+			Client:     client.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: config.Identity},
+		},
+		LeaseDuration:   config.LeaseDuration,
+		RenewDeadline:   config.RenewDeadline,
+		RetryPeriod:     config.RetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            config.Name,
+	}
+	leaderGauge.Set(0)
+	return e
+}
+
+// IsLeader returns true while the elector holds the Lease.
+func (e *LeaderElector) IsLeader() bool {
+	return atomic.LoadInt32(&e.leader) == 1
+}
+
+// Run campaigns for the Lease until ctx is done. While leading, all
+// controllers are running. They are stopped when the Lease is lost and
+// started again once it's reacquired.
+func (e *LeaderElector) Run(ctx context.Context, controllers ...Controller) error {
+	config := e.config
+	config.Callbacks = leaderelection.LeaderCallbacks{
+		OnStartedLeading: func(ctx context.Context) {
+			level.Info(e.Logger).Log("msg", "Started leading")
+			e.setLeader(true)
+			var wg sync.WaitGroup
+			for _, controller := range controllers {
+				wg.Add(1)
+				go func(controller Controller) {
+					defer wg.Done()
+					controller(ctx.Done())
+				}(controller)
+			}
+			wg.Wait()
+		},
+		OnStoppedLeading: func() {
+			level.Info(e.Logger).Log("msg", "Stopped leading")
+			e.setLeader(false)
+		},
+		OnNewLeader: func(identity string) {
+			level.Info(e.Logger).Log("msg", "New leader elected", "leader", identity)
+			e.transitionsCounter.Add(1)
+		},
+	}
+	elector, err := leaderelection.NewLeaderElector(config)
+	if err != nil {
+		return err
+	}
+	for {
+		elector.Run(ctx)
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+	}
+}
+
+func (e *LeaderElector) setLeader(leader bool) {
+	var v int32
+	if leader {
+		v = 1
+	}
+	atomic.StoreInt32(&e.leader, v)
+	e.leaderGauge.Set(float64(v))
+}
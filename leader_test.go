@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics/generic"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestLeaderElector(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	gauge := generic.NewGauge("leader")
+	elector := NewLeaderElector(log.NewNopLogger(), client, &LeaderElectionConfig{
+		Namespace:     "ci",
+		Name:          "k8s-webhook-handler",
+		Identity:      "replica-1",
+		LeaseDuration: time.Second,
+		RenewDeadline: 500 * time.Millisecond,
+		RetryPeriod:   100 * time.Millisecond,
+	}, gauge, generic.NewCounter("transitions"))
+	if elector.IsLeader() {
+		t.Fatal("Expected not to be leader before running")
+	}
+
+	var (
+		ctx, cancel = context.WithCancel(context.Background())
+		started     = make(chan struct{})
+		stopped     = make(chan struct{})
+		done        = make(chan error)
+	)
+	go func() {
+		done <- elector.Run(ctx, func(stopCh <-chan struct{}) {
+			close(started)
+			<-stopCh
+			close(stopped)
+		})
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Controller wasn't started")
+	}
+	if !elector.IsLeader() || gauge.Value() != 1 {
+		t.Fatalf("Expected to be leader, gauge is %f", gauge.Value())
+	}
+	lease, err := client.CoordinationV1().Leases("ci").Get("k8s-webhook-handler", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if holder := *lease.Spec.HolderIdentity; holder != "replica-1" {
+		t.Fatalf("Expected lease to be held by replica-1 but got %s", holder)
+	}
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Controller wasn't stopped")
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if elector.IsLeader() || gauge.Value() != 0 {
+		t.Fatalf("Expected not to be leader anymore, gauge is %f", gauge.Value())
+	}
+}
@@ -1,15 +1,18 @@
 package handler
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"net/url"
 	"os"
 	"strings"
 
 	"github.com/google/go-github/v24/github"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/oauth2"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -20,12 +23,23 @@ type Loader interface {
 	Load(ctx context.Context, repo, path, ref string) (runtime.Object, error)
 }
 
+// NotFoundError is returned by Load if the manifest doesn't exist.
+type NotFoundError struct {
+	error
+}
+
+// DecodeError is returned if a manifest can't be decoded.
+type DecodeError struct {
+	error
+}
+
 type GithubLoader struct {
 	*github.Client
 }
 
 func NewGithubLoader(token, baseURL, uploadURL string) (*GithubLoader, error) {
-	ctx := context.Background()
+	// Requests are traced and propagate the trace to GitHub.
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: TracingTransport(nil)})
 	ts := oauth2.StaticTokenSource(
 		&oauth2.Token{AccessToken: os.Getenv("GITHUB_TOKEN")},
 	)
@@ -51,7 +65,14 @@ func NewGithubLoader(token, baseURL, uploadURL string) (*GithubLoader, error) {
 
 // Apply downloads a manifest from repo specified by owner and name at given
 // ref. Ref and path can be a SHA, branch, or tag.
-func (l *GithubLoader) Load(ctx context.Context, repo, path, ref string) (runtime.Object, error) {
+func (l *GithubLoader) Load(ctx context.Context, repo, path, ref string) (obj runtime.Object, err error) {
+	ctx, span := startSpan(ctx, "GithubLoader.Load", trace.WithAttributes(
+		attrDelivery.String(DeliveryID(ctx)),
+		attrRepo.String(repo),
+		attrPath.String(path),
+		attrRevision.String(ref),
+	))
+	defer func() { endSpan(span, err) }()
 	var (
 		parts = strings.SplitN(repo, "/", 2)
 		owner = parts[0]
@@ -64,12 +85,33 @@ func (l *GithubLoader) Load(ctx context.Context, repo, path, ref string) (runtim
 		}
 	}
 
+	done := stage(ctx, "load")
 	file, err := l.Client.Repositories.DownloadContents(ctx, owner, name, path, options)
 	if err != nil {
-		return nil, fmt.Errorf("Couldn't get file %s from %s/%s at %s: %s", path, owner, name, ref, err)
+		notFound := isNotFound(err)
+		err = fmt.Errorf("Couldn't get file %s from %s/%s at %s: %s", path, owner, name, ref, err)
+		if notFound {
+			return nil, &NotFoundError{err}
+		}
+		return nil, err
+	}
+	content, err := ioutil.ReadAll(file)
+	file.Close()
+	done()
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read file %s from %s/%s at %s: %s", path, owner, name, ref, err)
+	}
+	defer stage(ctx, "decode")()
+	return Decode(bytes.NewReader(content))
+}
+
+// isNotFound returns true if DownloadContents failed because the file or its
+// directory doesn't exist. The former is only reported as plain error.
+func isNotFound(err error) bool {
+	if resp, ok := err.(*github.ErrorResponse); ok {
+		return resp.Response != nil && resp.Response.StatusCode == http.StatusNotFound
 	}
-	defer file.Close()
-	return Decode(file)
+	return strings.HasPrefix(err.Error(), "No file named ")
 }
 
 // Decode reads a reader and parses the stream as runtime.Object.
@@ -81,11 +123,11 @@ func Decode(r io.Reader) (runtime.Object, error) {
 
 	jcontent, err := yaml.ToJSON(content)
 	if err != nil {
-		return nil, fmt.Errorf("Couldn't translate yaml to json: %s", err)
+		return nil, &DecodeError{fmt.Errorf("Couldn't translate yaml to json: %s", err)}
 	}
 	obj, _, err := unstructured.UnstructuredJSONScheme.Decode(jcontent, nil, nil)
 	if err != nil {
-		return nil, fmt.Errorf("Couldn't decode manifest: %s", err)
+		return nil, &DecodeError{fmt.Errorf("Couldn't decode manifest: %s", err)}
 	}
 	return obj, nil
 }
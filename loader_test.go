@@ -1,9 +1,14 @@
 package handler
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 )
@@ -81,3 +86,70 @@ spec:
 		}
 	}
 }
+
+func TestLoadStages(t *testing.T) {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/repos/airbnb/foo/contents/.ci", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `[{"type": "file", "name": "workflow.yaml", "download_url": "%s/raw"}]`, server.URL)
+	})
+	mux.HandleFunc("/raw", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: foo\n")
+	})
+
+	l, err := NewGithubLoader("", server.URL+"/", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stages := []string{}
+	ctx := withStageObserver(context.Background(), func(name string, duration time.Duration) {
+		stages = append(stages, name)
+	})
+	obj, err := l.Load(ctx, "airbnb/foo", ".ci/workflow.yaml", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := obj.(*unstructured.Unstructured).GetName(); name != "foo" {
+		t.Fatalf("Expected object foo but got %s", name)
+	}
+	if !reflect.DeepEqual(stages, []string{"load", "decode"}) {
+		t.Fatalf("Unexpected stages %v", stages)
+	}
+}
+
+func TestLoadNotFound(t *testing.T) {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/repos/airbnb/foo/contents/.ci", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"type": "file", "name": "other.yaml"}]`)
+	})
+	mux.HandleFunc("/repos/airbnb/foo/contents/.github", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message": "Not Found"}`, http.StatusNotFound)
+	})
+	mux.HandleFunc("/repos/airbnb/foo/contents/.broken", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message": "Server Error"}`, http.StatusInternalServerError)
+	})
+
+	l, err := NewGithubLoader("", server.URL+"/", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		path     string
+		notFound bool
+	}{
+		{".ci/workflow.yaml", true},
+		{".github/workflow.yaml", true},
+		{".broken/workflow.yaml", false},
+	} {
+		_, err := l.Load(context.Background(), "airbnb/foo", test.path, "master")
+		if err == nil {
+			t.Fatalf("Expected error for %s", test.path)
+		}
+		if _, ok := err.(*NotFoundError); ok != test.notFound {
+			t.Fatalf("Expected NotFoundError to be %v for %s but got %#v", test.notFound, test.path, err)
+		}
+	}
+}
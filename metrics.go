@@ -0,0 +1,239 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/multi"
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	"github.com/go-kit/kit/metrics/statsd"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MetricsProvider creates metrics in a sink. Sinks not supporting labels
+// ignore them.
+type MetricsProvider interface {
+	NewCounter(name, help string, labels ...string) metrics.Counter
+	NewGauge(name, help string, labels ...string) metrics.Gauge
+	NewHistogram(name, help string, labels ...string) metrics.Histogram
+}
+
+// statsdNameLabels are the labels whose values statsd histograms append to
+// their name, e.g. stage_duration.apply, since statsd doesn't support
+// labels. Only labels with few values qualify.
+var statsdNameLabels = map[string]bool{"stage": true}
+
+// StatsdProvider creates statsd metrics. Labels are not supported, except
+// for statsdNameLabels of histograms.
+type StatsdProvider struct {
+	*statsd.Statsd
+}
+
+func NewStatsdProvider(s *statsd.Statsd) *StatsdProvider {
+	return &StatsdProvider{s}
+}
+
+func (p *StatsdProvider) NewCounter(name, help string, labels ...string) metrics.Counter {
+	return p.Statsd.NewCounter(name, 1.0)
+}
+
+func (p *StatsdProvider) NewGauge(name, help string, labels ...string) metrics.Gauge {
+	return p.Statsd.NewGauge(name)
+}
+
+func (p *StatsdProvider) NewHistogram(name, help string, labels ...string) metrics.Histogram {
+	return &statsdHistogram{statsd: p.Statsd, name: name}
+}
+
+// statsdHistogram is a statsd timing named after the histogram and the
+// values of its statsdNameLabels.
+type statsdHistogram struct {
+	statsd *statsd.Statsd
+	name   string
+}
+
+func (h *statsdHistogram) With(labelValues ...string) metrics.Histogram {
+	name := h.name
+	for i := 0; i+1 < len(labelValues); i += 2 {
+		if statsdNameLabels[labelValues[i]] && labelValues[i+1] != "" {
+			name += "." + labelValues[i+1]
+		}
+	}
+	return &statsdHistogram{statsd: h.statsd, name: name}
+}
+
+func (h *statsdHistogram) Observe(value float64) {
+	h.statsd.NewTiming(h.name, 1.0).Observe(value)
+}
+
+// PrometheusProvider creates Prometheus metrics registered with a
+// Registerer.
+type PrometheusProvider struct {
+	namespace  string
+	registerer prometheus.Registerer
+}
+
+// NewPrometheusProvider returns a provider prefixing all metric names with
+// namespace.
+func NewPrometheusProvider(namespace string, registerer prometheus.Registerer) *PrometheusProvider {
+	return &PrometheusProvider{namespace: namespace, registerer: registerer}
+}
+
+func (p *PrometheusProvider) NewCounter(name, help string, labels ...string) metrics.Counter {
+	cv := prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: p.namespace, Name: name, Help: help}, labels)
+	p.registerer.MustRegister(cv)
+	return kitprometheus.NewCounter(cv)
+}
+
+func (p *PrometheusProvider) NewGauge(name, help string, labels ...string) metrics.Gauge {
+	gv := prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: p.namespace, Name: name, Help: help}, labels)
+	p.registerer.MustRegister(gv)
+	return kitprometheus.NewGauge(gv)
+}
+
+func (p *PrometheusProvider) NewHistogram(name, help string, labels ...string) metrics.Histogram {
+	hv := prometheus.NewHistogramVec(prometheus.HistogramOpts{Namespace: p.namespace, Name: name, Help: help, Buckets: prometheus.DefBuckets}, labels)
+	p.registerer.MustRegister(hv)
+	return kitprometheus.NewHistogram(hv)
+}
+
+// MultiProvider creates metrics in all of its providers.
+type MultiProvider []MetricsProvider
+
+func (m MultiProvider) NewCounter(name, help string, labels ...string) metrics.Counter {
+	counters := make([]metrics.Counter, len(m))
+	for i, p := range m {
+		counters[i] = p.NewCounter(name, help, labels...)
+	}
+	return multi.NewCounter(counters...)
+}
+
+func (m MultiProvider) NewGauge(name, help string, labels ...string) metrics.Gauge {
+	gauges := make([]metrics.Gauge, len(m))
+	for i, p := range m {
+		gauges[i] = p.NewGauge(name, help, labels...)
+	}
+	return multi.NewGauge(gauges...)
+}
+
+func (m MultiProvider) NewHistogram(name, help string, labels ...string) metrics.Histogram {
+	histograms := make([]metrics.Histogram, len(m))
+	for i, p := range m {
+		histograms[i] = p.NewHistogram(name, help, labels...)
+	}
+	return multi.NewHistogram(histograms...)
+}
+
+// requestLabels are the labels of the request metrics.
+var requestLabels = []string{"event_type", "action", "repo", "outcome", "status"}
+
+// Metrics are the metrics reported by the Handler.
+type Metrics struct {
+	requests       metrics.Counter
+	errors         metrics.Counter
+	sourceRejected metrics.Counter
+	skipped        metrics.Counter
+	duration       metrics.Histogram
+	stageDuration  metrics.Histogram
+	repos          *repoLimiter
+}
+
+// NewMetrics creates the handler's metrics with provider. To limit the
+// cardinality, only the first maxRepos repositories are used as label, all
+// others are reported as "other".
+func NewMetrics(provider MetricsProvider, maxRepos int) *Metrics {
+	return &Metrics{
+		requests:       provider.NewCounter("requests", "Number of handled requests.", requestLabels...),
+		errors:         provider.NewCounter("errors", "Number of requests failed with an error.", requestLabels...),
+		sourceRejected: provider.NewCounter("source_rejected", "Number of requests rejected by the source filter."),
+		skipped:        provider.NewCounter("skipped", "Number of events skipped by commit message directives.", "repo", "directive"),
+		duration:       provider.NewHistogram("duration", "Duration of handling requests in seconds.", requestLabels...),
+		stageDuration:  provider.NewHistogram("stage_duration", "Duration of the stages of handling a request in seconds.", "stage"),
+		repos:          &repoLimiter{max: maxRepos, repos: map[string]struct{}{}},
+	}
+}
+
+// observeRequest records a handled request. event is nil if the request
+// wasn't handled as event.
+func (m *Metrics) observeRequest(event *Event, status int, err error, duration time.Duration) {
+	var eventType, action, repo string
+	if event != nil {
+		eventType, action, repo = event.Type, event.Action, m.repos.label(event.GetFullName())
+	}
+	labels := []string{
+		"event_type", eventType,
+		"action", action,
+		"repo", repo,
+		"outcome", requestOutcome(status, err),
+		"status", strconv.Itoa(status),
+	}
+	m.requests.With(labels...).Add(1)
+	if err != nil {
+		m.errors.With(labels...).Add(1)
+	}
+	m.duration.With(labels...).Observe(duration.Seconds())
+}
+
+// observeSkip records an event skipped by a commit message directive.
+func (m *Metrics) observeSkip(event *Event, directive string) {
+	m.skipped.With("repo", m.repos.label(event.GetFullName()), "directive", directive).Add(1)
+}
+
+// requestOutcome returns "succeeded" if err is nil, "rejected" for client
+// errors and "failed" otherwise.
+func requestOutcome(status int, err error) string {
+	switch {
+	case err == nil:
+		return "succeeded"
+	case status >= http.StatusBadRequest && status < http.StatusInternalServerError:
+		return "rejected"
+	}
+	return "failed"
+}
+
+// repoLimiter passes the first max repositories and replaces all others by
+// "other".
+type repoLimiter struct {
+	mu    sync.Mutex
+	max   int
+	repos map[string]struct{}
+}
+
+func (l *repoLimiter) label(repo string) string {
+	if repo == "" {
+		return ""
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.repos[repo]; ok {
+		return repo
+	}
+	if len(l.repos) >= l.max {
+		return "other"
+	}
+	l.repos[repo] = struct{}{}
+	return repo
+}
+
+type stageObserverKey struct{}
+
+// withStageObserver returns a context in which stage reports the durations
+// of stages to fn.
+func withStageObserver(ctx context.Context, fn func(stage string, duration time.Duration)) context.Context {
+	return context.WithValue(ctx, stageObserverKey{}, fn)
+}
+
+// stage reports the time until the returned function is called as duration
+// of the named stage to the observer in ctx, if any.
+func stage(ctx context.Context, name string) func() {
+	begin := time.Now()
+	return func() {
+		if fn, ok := ctx.Value(stageObserverKey{}).(func(string, time.Duration)); ok {
+			fn(name, time.Since(begin))
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics/statsd"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-github/v24/github"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestMetricsPrometheus(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m := NewMetrics(NewPrometheusProvider("test", registry), 1)
+
+	newEvent := func(repo string) *Event {
+		return &Event{Type: "push", Repository: &github.Repository{FullName: github.String(repo)}}
+	}
+	m.observeRequest(newEvent("airbnb/foo"), http.StatusOK, nil, time.Second)
+	m.observeRequest(newEvent("airbnb/bar"), http.StatusForbidden, errors.New("denied"), time.Second)
+	m.observeRequest(nil, http.StatusOK, nil, time.Second)
+	m.stageDuration.With("stage", "load").Observe(1)
+	m.observeSkip(newEvent("airbnb/foo"), "skip ci")
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string][]string{}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			labels := ""
+			for _, label := range metric.GetLabel() {
+				labels += label.GetName() + "=" + label.GetValue() + ","
+			}
+			got[family.GetName()] = append(got[family.GetName()], labels)
+		}
+		sort.Strings(got[family.GetName()])
+	}
+	requests := []string{
+		"action=,event_type=,outcome=succeeded,repo=,status=200,",
+		"action=,event_type=push,outcome=rejected,repo=other,status=403,",
+		"action=,event_type=push,outcome=succeeded,repo=airbnb/foo,status=200,",
+	}
+	if diff := cmp.Diff(map[string][]string{
+		"test_requests":       requests,
+		"test_duration":       requests,
+		"test_errors":         {"action=,event_type=push,outcome=rejected,repo=other,status=403,"},
+		"test_stage_duration": {"stage=load,"},
+		"test_skipped":        {"directive=skip ci,repo=airbnb/foo,"},
+	}, got); diff != "" {
+		t.Fatalf("Not Equal (-want +got):\n%s", diff)
+	}
+}
+
+func TestMetricsStatsd(t *testing.T) {
+	s := statsd.New("", log.NewNopLogger())
+	m := NewMetrics(NewStatsdProvider(s), 10)
+	m.stageDuration.With("stage", "apply").Observe(1)
+	m.stageDuration.With("stage", "load").Observe(2)
+	m.duration.With("event_type", "push", "repo", "foo/bar").Observe(3)
+
+	buf := &bytes.Buffer{}
+	if _, err := s.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	sort.Strings(lines)
+	if diff := cmp.Diff([]string{"duration:3.000000|ms", "stage_duration.apply:1.000000|ms", "stage_duration.load:2.000000|ms"}, lines); diff != "" {
+		t.Fatalf("Unexpected statsd metrics (-want +got):\n%s", diff)
+	}
+}
+
+func TestRequestOutcome(t *testing.T) {
+	for _, test := range []struct {
+		status int
+		err    error
+		expect string
+	}{
+		{http.StatusOK, nil, "succeeded"},
+		{http.StatusForbidden, errors.New("denied"), "rejected"},
+		{http.StatusInternalServerError, errors.New("failed"), "failed"},
+		{0, errors.New("failed"), "failed"},
+	} {
+		if outcome := requestOutcome(test.status, test.err); outcome != test.expect {
+			t.Fatalf("Expected %s for %d/%v but got %s", test.expect, test.status, test.err, outcome)
+		}
+	}
+}
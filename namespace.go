@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	// RepoLabel and RefLabel link objects to the repository and ref they
+	// were created for. Since label values are restricted, the values are
+	// sanitized. The full values are in the repo_name and ref annotations.
+	RepoLabel = annotationPrefix + "repo"
+	RefLabel  = annotationPrefix + "ref"
+
+	maxNameLength = 63
+	hashLength    = 8
+)
+
+var (
+	invalidNameChars  = regexp.MustCompile(`[^a-z0-9-]+`)
+	invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+)
+
+// NamespaceName turns name into a valid DNS-1123 label. Names exceeding 63
+// characters are truncated and suffixed by a hash of the full name to keep
+// them unique.
+func NamespaceName(name string) string {
+	sanitized := invalidNameChars.ReplaceAllString(strings.ToLower(name), "-")
+	return truncate(strings.Trim(sanitized, "-"), name, "-")
+}
+
+// LabelValue turns value into a valid label value, truncating and hashing
+// it like NamespaceName if needed.
+func LabelValue(value string) string {
+	sanitized := invalidLabelChars.ReplaceAllString(value, "-")
+	return truncate(strings.Trim(sanitized, "-_."), value, "-")
+}
+
+func truncate(s, orig, sep string) string {
+	if len(s) <= maxNameLength {
+		return s
+	}
+	sum := sha256.Sum256([]byte(orig))
+	prefix := strings.TrimRight(s[:maxNameLength-hashLength-len(sep)], "-_.")
+	return prefix + sep + hex.EncodeToString(sum[:])[:hashLength]
+}
+
+// namespaceLabels returns the labels and annotations for a namespace created
+// for event.
+func namespaceLabels(event *Event) (labels, annotations map[string]string) {
+	labels = map[string]string{
+		RepoLabel: LabelValue(event.GetFullName()),
+		RefLabel:  LabelValue(event.Ref),
+	}
+	annotations = map[string]string{
+		annotationPrefix + "repo_name": event.GetFullName(),
+		annotationPrefix + "ref":       event.Ref,
+	}
+	return labels, annotations
+}
+
+// setLabels adds labels to each object in obj.
+func setLabels(obj runtime.Object, labels map[string]string) error {
+	return eachObject(obj, func(o *unstructured.Unstructured) error {
+		merged := o.GetLabels()
+		if merged == nil {
+			merged = map[string]string{}
+		}
+		for key, value := range labels {
+			merged[key] = value
+		}
+		o.SetLabels(merged)
+		return nil
+	})
+}
@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestNamespaceName(t *testing.T) {
+	long := "ci-airbnb-k8s-webhook-handler-refs-heads-feature-with-a-very-long-branch-name"
+	for in, out := range map[string]string{
+		"ci-foo-master":            "ci-foo-master",
+		"ci-Foo_Bar-feature/ABC.1": "ci-foo-bar-feature-abc-1",
+		"-ci--foo-":                "ci--foo",
+		long:                       "ci-airbnb-k8s-webhook-handler-refs-heads-feature-with-f9c2497e",
+		strings.Replace(long, "with-", "withx", 1): "ci-airbnb-k8s-webhook-handler-refs-heads-feature-withx-7b02ff12",
+	} {
+		got := NamespaceName(in)
+		if len(got) > 63 {
+			t.Fatalf("Name %s longer than 63 characters", got)
+		}
+		if got != out {
+			t.Fatalf("Expected %q for %q but got %q", out, in, got)
+		}
+	}
+}
+
+func TestLabelValue(t *testing.T) {
+	for in, out := range map[string]string{
+		"airbnb/k8s-webhook-handler": "airbnb-k8s-webhook-handler",
+		"refs/heads/Feature_1.2":     "refs-heads-Feature_1.2",
+		"/foo/":                      "foo",
+	} {
+		if got := LabelValue(in); got != out {
+			t.Fatalf("Expected %q for %q but got %q", out, in, got)
+		}
+	}
+}
+
+func TestSetLabels(t *testing.T) {
+	obj := &unstructured.UnstructuredList{Items: []unstructured.Unstructured{
+		{Object: map[string]interface{}{"metadata": map[string]interface{}{"name": "a", "labels": map[string]interface{}{"app": "a", RepoLabel: "other"}}}},
+		{Object: map[string]interface{}{"metadata": map[string]interface{}{"name": "b"}}},
+	}}
+	if err := setLabels(obj, map[string]string{RepoLabel: "airbnb-foo"}); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(map[string]string{"app": "a", RepoLabel: "airbnb-foo"}, obj.Items[0].GetLabels()); diff != "" {
+		t.Fatalf("Not Equal (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(map[string]string{RepoLabel: "airbnb-foo"}, obj.Items[1].GetLabels()); diff != "" {
+		t.Fatalf("Not Equal (-want +got):\n%s", diff)
+	}
+}
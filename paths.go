@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/google/go-github/v24/github"
+)
+
+const (
+	// maxPushCommits is the number of commits push payloads include at
+	// most. Pushes with more commits are truncated.
+	maxPushCommits = 20
+	// maxCompareFiles is the number of files the compare API returns at
+	// most.
+	maxCompareFiles = 300
+
+	nullRevision = "0000000000000000000000000000000000000000"
+)
+
+// ChangeLister lists the files changed between two commits.
+type ChangeLister interface {
+	// ChangedFiles returns the files changed between base and head.
+	ChangedFiles(ctx context.Context, repo, base, head string) ([]string, error)
+}
+
+// ChangedFiles returns the files changed between base and head, including
+// the previous names of renamed files.
+func (l *GithubLoader) ChangedFiles(ctx context.Context, repo, base, head string) ([]string, error) {
+	parts := strings.SplitN(repo, "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Invalid repository %q", repo)
+	}
+	comparison, _, err := l.Client.Repositories.CompareCommits(ctx, parts[0], parts[1], base, head)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, f := range comparison.Files {
+		files = append(files, f.GetFilename())
+		if f.GetPreviousFilename() != "" {
+			files = append(files, f.GetPreviousFilename())
+		}
+	}
+	return files, nil
+}
+
+// validatePathPattern returns an error if pattern isn't a valid glob.
+func validatePathPattern(pattern string) error {
+	if pattern == "" {
+		return fmt.Errorf("Empty path pattern")
+	}
+	for _, segment := range strings.Split(pattern, "/") {
+		if _, err := path.Match(segment, ""); err != nil {
+			return fmt.Errorf("Invalid path pattern %q: %s", pattern, err)
+		}
+	}
+	return nil
+}
+
+// matchPath returns true if name matches pattern. Segments are matched with
+// path.Match, a "**" segment matches any number of segments, so "docs/**"
+// matches all files below docs and "**/*.md" all Markdown files.
+func matchPath(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+func matchAnyPath(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matchPath(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchesPaths returns true if any of files matches the rule's paths and
+// doesn't match its ignored paths. Rules without path filters match all
+// files.
+func (r *Rule) MatchesPaths(files []string) bool {
+	if !r.hasPathFilter() {
+		return true
+	}
+	for _, file := range files {
+		if (len(r.Paths) == 0 || matchAnyPath(r.Paths, file)) && !matchAnyPath(r.PathsIgnore, file) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) hasPathFilter() bool {
+	return r != nil && (len(r.Paths) > 0 || len(r.PathsIgnore) > 0)
+}
+
+// pushedFiles returns the files added, modified or removed by the commits
+// of a push or false if the payload was truncated or has no commits.
+func pushedFiles(e *github.PushEvent) ([]string, bool) {
+	if len(e.Commits) == 0 || len(e.Commits) >= maxPushCommits || e.GetSize() > len(e.Commits) {
+		return nil, false
+	}
+	files := []string{}
+	for _, c := range e.Commits {
+		files = append(files, c.Added...)
+		files = append(files, c.Modified...)
+		files = append(files, c.Removed...)
+	}
+	return files, true
+}
+
+// changedFiles returns the files changed by a push. Truncated payloads are
+// completed with the compare API. If the files can't be determined, e.g.
+// for new branches, nil is returned.
+func (h *Handler) changedFiles(ctx context.Context, e *github.PushEvent) ([]string, error) {
+	if files, ok := pushedFiles(e); ok {
+		return files, nil
+	}
+	if h.Changes == nil || e.GetBefore() == "" || e.GetBefore() == nullRevision {
+		return nil, nil
+	}
+	files, err := h.Changes.ChangedFiles(ctx, e.GetRepo().GetFullName(), e.GetBefore(), e.GetAfter())
+	if err != nil {
+		return nil, err
+	}
+	if len(files) >= maxCompareFiles {
+		return nil, nil
+	}
+	return files, nil
+}
@@ -0,0 +1,142 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-github/v24/github"
+)
+
+type mockChangeLister struct {
+	files []string
+	err   error
+	base  string
+}
+
+func (c *mockChangeLister) ChangedFiles(ctx context.Context, repo, base, head string) ([]string, error) {
+	c.base = base
+	return c.files, c.err
+}
+
+func TestMatchPath(t *testing.T) {
+	for _, test := range []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"docs/**", "docs/index.md", true},
+		{"docs/**", "docs/api/v1/index.md", true},
+		{"docs/**", "src/docs/index.md", false},
+		{"**/*.md", "README.md", true},
+		{"**/*.md", "docs/api/index.md", true},
+		{"**/*.md", "main.go", false},
+		{"*.md", "docs/index.md", false},
+		{"services/*/Dockerfile", "services/api/Dockerfile", true},
+		{"services/*/Dockerfile", "services/api/v1/Dockerfile", false},
+		{"services/**/Dockerfile", "services/api/v1/Dockerfile", true},
+		{"go.mod", "go.mod", true},
+	} {
+		if match := matchPath(test.pattern, test.name); match != test.match {
+			t.Errorf("Expected %s matching %s to be %t", test.pattern, test.name, test.match)
+		}
+	}
+	if err := validatePathPattern("docs/[a-"); err == nil {
+		t.Fatal("Expected invalid pattern to be rejected")
+	}
+}
+
+func TestRuleMatchesPaths(t *testing.T) {
+	rule := &Rule{Paths: []string{"services/api/**"}, PathsIgnore: []string{"**/*.md"}}
+	for _, test := range []struct {
+		files []string
+		match bool
+	}{
+		{[]string{"services/api/main.go"}, true},
+		{[]string{"services/api/README.md"}, false},
+		{[]string{"services/api/README.md", "services/api/main.go"}, true},
+		{[]string{"services/web/main.go"}, false},
+		{[]string{}, false},
+	} {
+		if match := rule.MatchesPaths(test.files); match != test.match {
+			t.Errorf("Expected %v matching to be %t", test.files, test.match)
+		}
+	}
+	if !(&Rule{}).MatchesPaths(nil) {
+		t.Fatal("Expected rules without filters to match")
+	}
+}
+
+func TestHandlePathFilters(t *testing.T) {
+	commits := func(files ...string) []github.PushEventCommit {
+		return []github.PushEventCommit{{Modified: files}}
+	}
+	for _, test := range []struct {
+		name    string
+		before  string
+		commits []github.PushEventCommit
+		size    int
+		changes *mockChangeLister
+		outcome string
+		code    ErrorCode
+		base    string
+	}{
+		{name: "matching", commits: commits("services/api/main.go"), outcome: ResponseCreated},
+		{name: "only docs", commits: commits("docs/index.md", "services/api/README.md"), outcome: ResponseIgnored},
+		{name: "truncated matching", commits: commits("docs/index.md"), size: 25, changes: &mockChangeLister{files: []string{"services/api/main.go"}}, outcome: ResponseCreated, base: "def"},
+		{name: "truncated only docs", commits: commits("docs/index.md"), size: 25, changes: &mockChangeLister{files: []string{"docs/api.md"}}, outcome: ResponseIgnored, base: "def"},
+		{name: "compare failed", commits: commits("docs/index.md"), size: 25, changes: &mockChangeLister{err: errors.New("rate limited")}, code: CodeCompareFailed, base: "def"},
+		{name: "new branch", before: nullRevision, outcome: ResponseCreated},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			config := &Config{
+				Namespace: "ci",
+				Rules:     []*Rule{{Name: "api", Repo: "foo/*", Paths: []string{"services/api/**"}, PathsIgnore: []string{"**/*.md"}}},
+			}
+			kc := &mockKubernetesClient{}
+			handler := NewGithubHookHandler(log.NewNopLogger(), config, kc, &mockLoader{}, newTestMetrics())
+			changes := test.changes
+			if changes == nil {
+				changes = &mockChangeLister{}
+			}
+			handler.Changes = changes
+			before := test.before
+			if before == "" {
+				before = "def"
+			}
+			size := test.size
+			if size == 0 {
+				size = len(test.commits)
+			}
+			event := &github.PushEvent{
+				Ref:     github.String("refs/heads/master"),
+				Before:  github.String(before),
+				After:   github.String("abc"),
+				Size:    github.Int(size),
+				Commits: test.commits,
+				Repo:    &github.PushEventRepository{FullName: github.String("foo/bar"), GitURL: github.String("git://github.com/foo/bar.git"), SSHURL: github.String("git@github.com:foo/bar.git")},
+			}
+
+			hr, err := handler.HandleEvent(context.Background(), event)
+			if changes.base != test.base {
+				t.Fatalf("Expected compare base %q but got %q", test.base, changes.base)
+			}
+			if test.code != "" {
+				if err == nil || hr.code != test.code {
+					t.Fatalf("Expected %s but got %v: %v", test.code, hr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hr.outcome != test.outcome {
+				t.Fatalf("Expected outcome %s but got %s: %s", test.outcome, hr.outcome, hr.message)
+			}
+			if test.outcome == ResponseIgnored && hr.message != "No matching paths, skipping" {
+				t.Fatalf("Unexpected message %s", hr.message)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package handler
+
+import (
+	"fmt"
+	"path"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// Mapper maps kinds to resources. It's implemented by meta.RESTMapper.
+type Mapper interface {
+	RESTMapping(gk schema.GroupKind, versions ...string) (*meta.RESTMapping, error)
+}
+
+// Policy restricts which objects may be applied. Kinds are given as
+// patterns matched against "apiVersion/Kind" with path.Match, e.g.
+// "argoproj.io/*/Workflow" or "v1/ConfigMap".
+type Policy struct {
+	// AllowedKinds limits the namespaced kinds which may be applied. If
+	// unset, all namespaced kinds are allowed. Setting it to an empty list
+	// is rejected by Validate since it would allow all kinds too.
+	AllowedKinds []string `json:"allowedKinds,omitempty"`
+	// AllowedClusterKinds lists the cluster-scoped kinds which may be
+	// applied. All others are forbidden.
+	AllowedClusterKinds []string `json:"allowedClusterKinds,omitempty"`
+	// NamespaceMode defines how namespaces set in manifests are handled.
+	// Defaults to NamespaceReject.
+	NamespaceMode NamespaceMode `json:"namespaceMode,omitempty"`
+	// AllowedNamespaces are patterns of namespaces manifests may set in
+	// addition to the target namespace if NamespaceMode is NamespaceRespect.
+	AllowedNamespaces []string `json:"allowedNamespaces,omitempty"`
+}
+
+// Validate returns an error if any of the patterns is invalid or
+// AllowedKinds is set but empty.
+func (p *Policy) Validate() error {
+	if p.AllowedKinds != nil && len(p.AllowedKinds) == 0 {
+		return fmt.Errorf("Empty allowed kinds, unset it to allow all namespaced kinds")
+	}
+	for _, pattern := range append(append([]string{}, p.AllowedKinds...), p.AllowedClusterKinds...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid kind pattern %q: %s", pattern, err)
+		}
+	}
+	for _, pattern := range p.AllowedNamespaces {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid namespace pattern %q: %s", pattern, err)
+		}
+	}
+	switch p.NamespaceMode {
+	case "", NamespaceReject, NamespaceForce, NamespaceRespect:
+	default:
+		return fmt.Errorf("Invalid namespace mode %q", p.NamespaceMode)
+	}
+	return nil
+}
+
+// ApplyOptions returns the options to apply objects allowed by the policy to
+// namespace with.
+func (p *Policy) ApplyOptions(namespace string) *ApplyOptions {
+	mode := p.NamespaceMode
+	if mode == "" {
+		mode = NamespaceReject
+	}
+	return &ApplyOptions{Namespace: namespace, NamespaceMode: mode}
+}
+
+// Merge returns a policy with all fields set in override replacing the
+// ones in p.
+func (p *Policy) Merge(override *Policy) *Policy {
+	merged := *p
+	if override == nil {
+		return &merged
+	}
+	if override.AllowedKinds != nil {
+		merged.AllowedKinds = override.AllowedKinds
+	}
+	if override.AllowedClusterKinds != nil {
+		merged.AllowedClusterKinds = override.AllowedClusterKinds
+	}
+	if override.NamespaceMode != "" {
+		merged.NamespaceMode = override.NamespaceMode
+	}
+	if override.AllowedNamespaces != nil {
+		merged.AllowedNamespaces = override.AllowedNamespaces
+	}
+	return &merged
+}
+
+// Check returns a violation for each object in obj not allowed by the
+// policy when applied to namespace.
+func (p *Policy) Check(obj runtime.Object, namespace string, mapper Mapper) ([]string, error) {
+	violations := []string{}
+	err := eachObject(obj, func(o *unstructured.Unstructured) error {
+		gvk := o.GroupVersionKind()
+		kind := gvk.GroupVersion().String() + "/" + gvk.Kind
+		id := objectID(o)
+
+		mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		if err != nil {
+			if meta.IsNoMatchError(err) {
+				violations = append(violations, fmt.Sprintf("%s: unknown kind %s", id, kind))
+				return nil
+			}
+			return err
+		}
+		if isClusterScoped(mapping) {
+			if !matchAny(p.AllowedClusterKinds, kind) {
+				violations = append(violations, fmt.Sprintf("%s: cluster-scoped kind %s not allowed", id, kind))
+			}
+			return nil
+		}
+		if len(p.AllowedKinds) > 0 && !matchAny(p.AllowedKinds, kind) {
+			violations = append(violations, fmt.Sprintf("%s: kind %s not allowed", id, kind))
+		}
+		ns := o.GetNamespace()
+		if ns == "" || ns == namespace {
+			return nil
+		}
+		switch p.NamespaceMode {
+		case NamespaceForce:
+		case NamespaceRespect:
+			if !matchAny(p.AllowedNamespaces, ns) {
+				violations = append(violations, fmt.Sprintf("%s: namespace %s not allowed", id, ns))
+			}
+		default:
+			violations = append(violations, fmt.Sprintf("%s: namespace %s not allowed, must be %s", id, ns, namespace))
+		}
+		return nil
+	})
+	return violations, err
+}
+
+func matchAny(patterns []string, s string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// eachObject calls fn for obj or, if obj is a list, for each of its items.
+func eachObject(obj runtime.Object, fn func(*unstructured.Unstructured) error) error {
+	switch obj := obj.(type) {
+	case *unstructured.Unstructured:
+		return fn(obj)
+	case *unstructured.UnstructuredList:
+		return obj.EachListItem(func(o runtime.Object) error { return eachObject(o, fn) })
+	}
+	return fmt.Errorf("Unsupported object type %T", obj)
+}
+
+// objectID returns a human readable identifier of obj for messages.
+func objectID(obj *unstructured.Unstructured) string {
+	return obj.GetKind() + "/" + objectName(obj)
+}
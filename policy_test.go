@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestPolicyCheck(t *testing.T) {
+	configMap := &unstructured.Unstructured{Object: map[string]interface{}{"apiVersion": "v1", "kind": "ConfigMap", "metadata": map[string]interface{}{"name": "foo", "namespace": "ci"}}}
+	namespace := &unstructured.Unstructured{Object: map[string]interface{}{"apiVersion": "v1", "kind": "Namespace", "metadata": map[string]interface{}{"name": "foo"}}}
+	otherNamespace := configMap.DeepCopy()
+	otherNamespace.SetNamespace("other")
+
+	for _, test := range []struct {
+		policy     *Policy
+		obj        *unstructured.Unstructured
+		violations []string
+	}{
+		{&Policy{}, workflow(), []string{}},
+		{&Policy{}, configMap, []string{}},
+		{&Policy{AllowedKinds: []string{"v1/*"}}, workflow(), []string{"Workflow/hello-world-*: kind argoproj.io/v1alpha1/Workflow not allowed"}},
+		{&Policy{AllowedKinds: []string{"v1/*"}}, configMap, []string{}},
+		{&Policy{}, namespace, []string{"Namespace/foo: cluster-scoped kind v1/Namespace not allowed"}},
+		{&Policy{AllowedKinds: []string{"argoproj.io/*/*"}, AllowedClusterKinds: []string{"v1/Namespace"}}, namespace, []string{}},
+		{&Policy{}, otherNamespace, []string{"ConfigMap/foo: namespace other not allowed, must be ci"}},
+		{&Policy{NamespaceMode: NamespaceForce}, otherNamespace, []string{}},
+		{&Policy{NamespaceMode: NamespaceRespect}, otherNamespace, []string{"ConfigMap/foo: namespace other not allowed"}},
+		{&Policy{NamespaceMode: NamespaceRespect, AllowedNamespaces: []string{"oth*"}}, otherNamespace, []string{}},
+	} {
+		violations, err := test.policy.Check(test.obj, "ci", &mockKubernetesClient{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(test.violations, violations); diff != "" {
+			t.Fatalf("Not Equal (-want +got):\n%s", diff)
+		}
+	}
+}
+
+func TestPolicyMerge(t *testing.T) {
+	global := &Policy{AllowedKinds: []string{"v1/*"}, AllowedClusterKinds: []string{"v1/Namespace"}}
+	merged := global.Merge(&Policy{AllowedKinds: []string{"argoproj.io/*/Workflow"}})
+	if diff := cmp.Diff(&Policy{AllowedKinds: []string{"argoproj.io/*/Workflow"}, AllowedClusterKinds: []string{"v1/Namespace"}}, merged); diff != "" {
+		t.Fatalf("Not Equal (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(global, global.Merge(nil)); diff != "" {
+		t.Fatalf("Not Equal (-want +got):\n%s", diff)
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	if err := (&Policy{AllowedKinds: []string{"v1/*"}}).Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Policy{AllowedClusterKinds: []string{"[v1"}}).Validate(); err == nil {
+		t.Fatal("Expected error but got nil")
+	}
+	if err := (&Policy{NamespaceMode: "ignore"}).Validate(); err == nil {
+		t.Fatal("Expected error but got nil")
+	}
+	// An empty list would allow all kinds like an unset one.
+	if err := (&Policy{AllowedKinds: []string{}}).Validate(); err == nil {
+		t.Fatal("Expected error but got nil")
+	}
+}
@@ -0,0 +1,224 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-kit/kit/metrics"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/util/jsonpath"
+)
+
+// PruneRule selects objects of a kind created by the handler to delete.
+// Objects are pruned if they are older than TTL or not among the Keep most
+// recent ones of their repository and ref.
+type PruneRule struct {
+	Name       string `json:"name"`
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	// Namespaces to prune in. All namespaces if empty.
+	Namespaces []string        `json:"namespaces,omitempty"`
+	TTL        metav1.Duration `json:"ttl,omitempty"`
+	Keep       int             `json:"keep,omitempty"`
+	// FinishedPath, if set, is a JSONPath like {.status.phase}. Only
+	// objects it yields a result for are pruned. If FinishedValues is set,
+	// the result needs to be one of them.
+	FinishedPath   string   `json:"finishedPath,omitempty"`
+	FinishedValues []string `json:"finishedValues,omitempty"`
+}
+
+// Validate returns an error if the rule is incomplete or its JSONPath is
+// invalid.
+func (r *PruneRule) Validate() error {
+	if r.APIVersion == "" || r.Kind == "" {
+		return fmt.Errorf("Prune rule %s needs apiVersion and kind", r.Name)
+	}
+	if r.TTL.Duration <= 0 && r.Keep <= 0 {
+		return fmt.Errorf("Prune rule %s needs ttl or keep", r.Name)
+	}
+	if _, err := r.finishedPath(); err != nil {
+		return fmt.Errorf("Prune rule %s has invalid finishedPath: %s", r.Name, err)
+	}
+	return nil
+}
+
+func (r *PruneRule) finishedPath() (*jsonpath.JSONPath, error) {
+	if r.FinishedPath == "" {
+		return nil, nil
+	}
+	jp := jsonpath.New(r.Name).AllowMissingKeys(true)
+	if err := jp.Parse(r.FinishedPath); err != nil {
+		return nil, err
+	}
+	return jp, nil
+}
+
+// Pruner deletes objects created by the handler according to PruneRules.
+type Pruner struct {
+	log.Logger
+	client dynamic.Interface
+	mapper Mapper
+	rules  []*PruneRule
+	paths  []*jsonpath.JSONPath
+	dryRun bool
+
+	prunedCounter metrics.Counter
+	errorCounter  metrics.Counter
+}
+
+// NewPruner returns a pruner for rules. In dry run mode, objects are only
+// logged and counted instead of deleted.
+func NewPruner(logger log.Logger, client dynamic.Interface, mapper Mapper, rules []*PruneRule, dryRun bool, prunedCounter, errorCounter metrics.Counter) (*Pruner, error) {
+	paths := make([]*jsonpath.JSONPath, len(rules))
+	for i, rule := range rules {
+		if err := rule.Validate(); err != nil {
+			return nil, err
+		}
+		paths[i], _ = rule.finishedPath()
+	}
+	return &Pruner{
+		Logger:        logger,
+		client:        client,
+		mapper:        mapper,
+		rules:         rules,
+		paths:         paths,
+		dryRun:        dryRun,
+		prunedCounter: prunedCounter,
+		errorCounter:  errorCounter,
+	}, nil
+}
+
+// Run prunes every interval until stopCh is closed.
+func (p *Pruner) Run(interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			if err := p.Prune(time.Now()); err != nil {
+				level.Error(p.Logger).Log("msg", "Couldn't prune objects", "err", err)
+			}
+		}
+	}
+}
+
+// Prune applies all rules once.
+func (p *Pruner) Prune(now time.Time) error {
+	errs := []error{}
+	for i, rule := range p.rules {
+		if err := p.prune(rule, p.paths[i], now); err != nil {
+			errs = append(errs, fmt.Errorf("Prune rule %s: %s", rule.Name, err))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+func (p *Pruner) prune(rule *PruneRule, finished *jsonpath.JSONPath, now time.Time) error {
+	gv, err := schema.ParseGroupVersion(rule.APIVersion)
+	if err != nil {
+		return err
+	}
+	mapping, err := p.mapper.RESTMapping(gv.WithKind(rule.Kind).GroupKind(), gv.Version)
+	if err != nil {
+		return err
+	}
+	namespaces := rule.Namespaces
+	if len(namespaces) == 0 || isClusterScoped(mapping) {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+
+	errs := []error{}
+	for _, namespace := range namespaces {
+		client := p.client.Resource(mapping.Resource).Namespace(namespace)
+		list, err := client.List(metav1.ListOptions{LabelSelector: RepoLabel})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, obj := range pruneCandidates(rule, finished, list.Items, now) {
+			logger := log.With(p.Logger, "rule", rule.Name, "object", objectID(obj), "namespace", obj.GetNamespace())
+			if p.dryRun {
+				level.Info(logger).Log("msg", "Dry run, skipped pruning object")
+				p.prunedCounter.Add(1)
+				continue
+			}
+			propagation := metav1.DeletePropagationBackground
+			client := p.client.Resource(mapping.Resource).Namespace(obj.GetNamespace())
+			if err := client.Delete(obj.GetName(), &metav1.DeleteOptions{PropagationPolicy: &propagation}); err != nil && !apierrors.IsNotFound(err) {
+				p.errorCounter.Add(1)
+				errs = append(errs, err)
+				continue
+			}
+			level.Info(logger).Log("msg", "Pruned object")
+			p.prunedCounter.Add(1)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// pruneCandidates returns the objs to prune by rule.
+func pruneCandidates(rule *PruneRule, finished *jsonpath.JSONPath, objs []unstructured.Unstructured, now time.Time) []*unstructured.Unstructured {
+	groups := map[string][]*unstructured.Unstructured{}
+	for i := range objs {
+		obj := &objs[i]
+		labels := obj.GetLabels()
+		key := obj.GetNamespace() + "/" + labels[RepoLabel] + "/" + labels[RefLabel]
+		groups[key] = append(groups[key], obj)
+	}
+
+	candidates := []*unstructured.Unstructured{}
+	for _, group := range groups {
+		sort.SliceStable(group, func(i, j int) bool {
+			return group[i].GetCreationTimestamp().Time.After(group[j].GetCreationTimestamp().Time)
+		})
+		for i, obj := range group {
+			expired := rule.TTL.Duration > 0 && now.Sub(obj.GetCreationTimestamp().Time) > rule.TTL.Duration
+			surplus := rule.Keep > 0 && i >= rule.Keep
+			if !expired && !surplus {
+				continue
+			}
+			if finished != nil && !isFinished(finished, rule.FinishedValues, obj) {
+				continue
+			}
+			candidates = append(candidates, obj)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].GetNamespace()+"/"+candidates[i].GetName() < candidates[j].GetNamespace()+"/"+candidates[j].GetName()
+	})
+	return candidates
+}
+
+// isFinished returns true if path yields a result for obj which, if values
+// are given, is one of them.
+func isFinished(path *jsonpath.JSONPath, values []string, obj *unstructured.Unstructured) bool {
+	buf := &bytes.Buffer{}
+	if err := path.Execute(buf, obj.Object); err != nil {
+		return false
+	}
+	result := buf.String()
+	if result == "" {
+		return false
+	}
+	if len(values) == 0 {
+		return true
+	}
+	for _, value := range values {
+		if result == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics/generic"
+	"github.com/google/go-cmp/cmp"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+)
+
+var pruneNow = time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func pruneObject(name, ref string, age time.Duration, phase string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{"apiVersion": "argoproj.io/v1alpha1", "kind": "Workflow"}}
+	obj.SetNamespace("ci")
+	obj.SetName(name)
+	obj.SetCreationTimestamp(metav1.NewTime(pruneNow.Add(-age)))
+	obj.SetLabels(map[string]string{RepoLabel: "airbnb-foo", RefLabel: ref})
+	if phase != "" {
+		unstructured.SetNestedField(obj.Object, phase, "status", "phase")
+	}
+	return obj
+}
+
+func TestPruneCandidates(t *testing.T) {
+	objs := []unstructured.Unstructured{
+		*pruneObject("master-1", "master", 3*time.Hour, "Succeeded"),
+		*pruneObject("master-2", "master", 2*time.Hour, "Running"),
+		*pruneObject("master-3", "master", time.Hour, "Failed"),
+		*pruneObject("master-4", "master", time.Minute, ""),
+		*pruneObject("feature-1", "feature", 5*time.Hour, ""),
+	}
+	for _, test := range []struct {
+		rule   *PruneRule
+		expect []string
+	}{
+		{&PruneRule{TTL: metav1.Duration{Duration: 90 * time.Minute}}, []string{"feature-1", "master-1", "master-2"}},
+		{&PruneRule{Keep: 2}, []string{"master-1", "master-2"}},
+		{&PruneRule{TTL: metav1.Duration{Duration: 90 * time.Minute}, FinishedPath: "{.status.phase}"}, []string{"master-1", "master-2"}},
+		{&PruneRule{Keep: 1, FinishedPath: "{.status.phase}", FinishedValues: []string{"Succeeded"}}, []string{"master-1"}},
+	} {
+		finished, err := test.rule.finishedPath()
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := []string{}
+		for _, obj := range pruneCandidates(test.rule, finished, objs, pruneNow) {
+			names = append(names, obj.GetName())
+		}
+		if diff := cmp.Diff(test.expect, names); diff != "" {
+			t.Fatalf("Not Equal for %v (-want +got):\n%s", test.rule, diff)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	unmanaged := pruneObject("unmanaged", "", 5*time.Hour, "")
+	unmanaged.SetLabels(nil)
+	rules := []*PruneRule{{Name: "workflows", APIVersion: "argoproj.io/v1alpha1", Kind: "Workflow", Keep: 1}}
+	gvk := schema.GroupVersionKind{Group: "argoproj.io", Version: "v1alpha1", Kind: "Workflow"}
+	gvr := schema.GroupVersionResource{Group: "argoproj.io", Version: "v1alpha1", Resource: "workflows"}
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(gvk, meta.RESTScopeNamespace)
+
+	for _, dryRun := range []bool{true, false} {
+		dc := fake.NewSimpleDynamicClient(runtime.NewScheme(),
+			pruneObject("master-1", "master", 2*time.Hour, ""),
+			pruneObject("master-2", "master", time.Hour, ""),
+			unmanaged,
+		)
+		pruned := generic.NewCounter("pruned")
+		pruner, err := NewPruner(log.NewNopLogger(), dc, mapper, rules, dryRun, pruned, generic.NewCounter("errors"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pruner.Prune(pruneNow); err != nil {
+			t.Fatal(err)
+		}
+		if pruned.Value() != 1 {
+			t.Fatalf("Expected 1 pruned object but got %f", pruned.Value())
+		}
+		list, err := dc.Resource(gvr).Namespace("ci").List(metav1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect := 2
+		if dryRun {
+			expect = 3
+		}
+		if len(list.Items) != expect {
+			t.Fatalf("Expected %d objects left with dry run %t but got %d", expect, dryRun, len(list.Items))
+		}
+	}
+}
+
+func TestPruneRuleValidate(t *testing.T) {
+	for _, rule := range []*PruneRule{
+		{Name: "no kind", APIVersion: "v1", Keep: 1},
+		{Name: "no limit", APIVersion: "v1", Kind: "Pod"},
+		{Name: "invalid path", APIVersion: "v1", Kind: "Pod", Keep: 1, FinishedPath: "{.status"},
+	} {
+		if err := rule.Validate(); err == nil {
+			t.Fatalf("Expected error for %s", rule.Name)
+		}
+	}
+	if err := (&PruneRule{Name: "valid", APIVersion: "v1", Kind: "Pod", Keep: 1, FinishedPath: "{.status.phase}"}).Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
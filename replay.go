@@ -0,0 +1,177 @@
+package handler
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ReplayOptions override parts of a replayed delivery.
+type ReplayOptions struct {
+	// Revision, if set, is loaded and applied instead of the delivery's.
+	Revision string
+	// Namespace, if set, is applied to instead of the configured one.
+	Namespace string
+	// DryRun skips applying, even if the handler isn't in dry run mode.
+	DryRun bool
+}
+
+type replayKey struct{}
+
+// withReplayOptions returns a context in which HandleEvent applies opts.
+func withReplayOptions(ctx context.Context, opts *ReplayOptions) context.Context {
+	return context.WithValue(ctx, replayKey{}, opts)
+}
+
+// isReplay returns true if ctx is of a replayed delivery.
+func isReplay(ctx context.Context) bool {
+	return ctx.Value(replayKey{}) != nil
+}
+
+// replayOptions returns the options stored in ctx or empty ones.
+func replayOptions(ctx context.Context) *ReplayOptions {
+	if opts, ok := ctx.Value(replayKey{}).(*ReplayOptions); ok {
+		return opts
+	}
+	return &ReplayOptions{}
+}
+
+// replayDeliveryID returns the delivery ID a replay of id is handled as. It
+// differs from id, so run anchors of earlier attempts don't conflict.
+func replayDeliveryID(id string, now time.Time) string {
+	return id + "-replay-" + now.UTC().Format("20060102150405")
+}
+
+// replay handles the stored delivery id again as delivery.
+func (h *Handler) replay(ctx context.Context, id, delivery string, opts *ReplayOptions) (hr *handlerResponse, event *Event, err error) {
+	stored, err := h.Deliveries.Get(id)
+	if err != nil {
+		if err == ErrDeliveryNotFound {
+			return &handlerResponse{status: http.StatusNotFound, code: CodeDeliveryNotFound, message: "Delivery not found"}, nil, err
+		}
+		return &handlerResponse{status: http.StatusInternalServerError, code: CodeInternal, message: "Couldn't get delivery"}, nil, err
+	}
+	ev, err := parseWebHook(stored.EventType, stored.Payload)
+	if err != nil {
+		return &handlerResponse{status: http.StatusBadRequest, code: CodeUnsupportedEvent, message: "Couldn't parse webhook"}, nil, err
+	}
+	ctx = WithDeliveryID(ctx, delivery)
+	ctx = withReplayOptions(withHandledEvent(ctx, &event), opts)
+	ctx = withStageObserver(ctx, h.observeStage)
+	ctx, span := startSpan(ctx, "Replay", trace.WithAttributes(attrDelivery.String(DeliveryID(ctx))))
+	defer func() { endSpan(span, err) }()
+	hr, err = h.HandleEvent(ctx, ev)
+	return hr, event, err
+}
+
+// AdminHandler serves administrative endpoints below its prefix,
+// authenticated by a bearer token:
+//
+//	GET  <prefix>deliveries/<id>         returns a stored delivery
+//	POST <prefix>deliveries/<id>/replay  handles it again
+//
+// Replays take the revision, namespace and dry query parameters to override
+// the corresponding ReplayOptions.
+type AdminHandler struct {
+	log.Logger
+	handler *Handler
+	prefix  string
+	token   []byte
+}
+
+// NewAdminHandler returns an AdminHandler for handler's deliveries serving
+// below prefix, e.g. /-/admin/.
+func NewAdminHandler(logger log.Logger, handler *Handler, prefix string, token []byte) *AdminHandler {
+	return &AdminHandler{Logger: logger, handler: handler, prefix: prefix, token: token}
+}
+
+func (a *AdminHandler) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if len(a.token) == 0 || !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), a.token) == 1
+}
+
+func (a *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := log.With(a.Logger, "client", r.RemoteAddr, "path", r.URL.Path)
+	if !a.authorized(r) {
+		level.Warn(logger).Log("msg", "Rejecting unauthorized admin request")
+		hr := &handlerResponse{status: http.StatusUnauthorized, code: CodeUnauthorized, message: "Unauthorized"}
+		hr.write(w, r, "", nil, errors.New("Unauthorized"))
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, a.prefix), "/")
+	switch {
+	case len(parts) == 2 && parts[0] == "deliveries" && r.Method == http.MethodGet:
+		a.getDelivery(w, parts[1])
+	case len(parts) == 3 && parts[0] == "deliveries" && parts[2] == "replay" && r.Method == http.MethodPost:
+		a.replay(logger, w, r, parts[1])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (a *AdminHandler) getDelivery(w http.ResponseWriter, id string) {
+	delivery, err := a.handler.Deliveries.Get(id)
+	if err == ErrDeliveryNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(delivery)
+}
+
+func (a *AdminHandler) replay(logger log.Logger, w http.ResponseWriter, r *http.Request, id string) {
+	query := r.URL.Query()
+	opts := &ReplayOptions{
+		Revision:  query.Get("revision"),
+		Namespace: query.Get("namespace"),
+	}
+	if dry := query.Get("dry"); dry != "" {
+		var err error
+		if opts.DryRun, err = strconv.ParseBool(dry); err != nil {
+			hr := &handlerResponse{status: http.StatusBadRequest, code: CodeInvalidParameter, message: "Invalid dry parameter"}
+			hr.write(w, r, "", nil, err)
+			return
+		}
+	}
+	if opts.Namespace != "" && NamespaceName(opts.Namespace) != opts.Namespace {
+		hr := &handlerResponse{status: http.StatusBadRequest, code: CodeInvalidParameter, message: "Invalid namespace parameter"}
+		hr.write(w, r, "", nil, errors.New("Invalid namespace "+opts.Namespace))
+		return
+	}
+
+	delivery := replayDeliveryID(id, time.Now())
+	logger = log.With(logger, "delivery", id, "replay", delivery)
+	level.Info(logger).Log("msg", "Replaying delivery", "revision", opts.Revision, "namespace", opts.Namespace, "dry", opts.DryRun)
+	hr, event, err := a.handler.replay(r.Context(), id, delivery, opts)
+	if hr == nil {
+		hr = &handlerResponse{}
+	}
+	if hr.status == 0 {
+		hr.status = http.StatusOK
+		if err != nil {
+			hr.status = http.StatusInternalServerError
+		}
+	}
+	if err != nil {
+		level.Error(logger).Log("msg", "Couldn't replay delivery", "err", err)
+	}
+	if werr := hr.write(w, r, delivery, event, err); werr != nil {
+		level.Error(logger).Log("msg", "Couldn't write response", "err", werr)
+	}
+}
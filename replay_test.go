@@ -0,0 +1,99 @@
+package handler
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestReplayDeliveryID(t *testing.T) {
+	id := replayDeliveryID("1234", time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	if id != "1234-replay-20200102030405" {
+		t.Fatalf("Unexpected delivery ID %s", id)
+	}
+}
+
+func TestAdminReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deliveries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewDirectoryDeliveryStore(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kc := &mockKubernetesClient{}
+	handler := NewGithubHookHandler(log.NewNopLogger(), &Config{Namespace: "ci", Insecure: true}, kc, &mockLoader{}, newTestMetrics())
+	handler.Deliveries = store
+	admin := NewAdminHandler(log.NewNopLogger(), handler, "/-/admin/", []byte("secret"))
+
+	// Handling a webhook stores it.
+	req := newRequest("push", pushPayload, "")
+	req.Header.Set("X-GitHub-Delivery", "1234")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 but got %d: %s", w.Code, w.Body.String())
+	}
+	kc.applied = nil
+
+	for _, test := range []struct {
+		name      string
+		method    string
+		path      string
+		token     string
+		status    int
+		applied   int
+		namespace string
+		revision  string
+	}{
+		{name: "unauthorized", method: "POST", path: "/-/admin/deliveries/1234/replay", token: "wrong", status: http.StatusUnauthorized},
+		{name: "not found", method: "POST", path: "/-/admin/deliveries/5678/replay", token: "secret", status: http.StatusNotFound},
+		{name: "unknown", method: "GET", path: "/-/admin/foo", token: "secret", status: http.StatusNotFound},
+		{name: "get", method: "GET", path: "/-/admin/deliveries/1234", token: "secret", status: http.StatusOK},
+		{name: "replay", method: "POST", path: "/-/admin/deliveries/1234/replay", token: "secret", status: http.StatusOK, applied: 1, namespace: "ci", revision: "abc"},
+		{name: "overrides", method: "POST", path: "/-/admin/deliveries/1234/replay?revision=def&namespace=other", token: "secret", status: http.StatusOK, applied: 1, namespace: "other", revision: "def"},
+		{name: "dry", method: "POST", path: "/-/admin/deliveries/1234/replay?dry=true", token: "secret", status: http.StatusOK},
+		{name: "invalid", method: "POST", path: "/-/admin/deliveries/1234/replay?namespace=Foo_Bar", token: "secret", status: http.StatusBadRequest},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			kc.applied = nil
+			req := httptest.NewRequest(test.method, "http://example.com"+test.path, nil)
+			req.Header.Set("Authorization", "Bearer "+test.token)
+			w := httptest.NewRecorder()
+			admin.ServeHTTP(w, req)
+			if w.Code != test.status {
+				t.Fatalf("Expected status %d but got %d: %s", test.status, w.Code, w.Body.String())
+			}
+			if len(kc.applied) != test.applied {
+				t.Fatalf("Expected %d applies but got %d", test.applied, len(kc.applied))
+			}
+			if test.applied == 0 {
+				return
+			}
+			if kc.namespace != test.namespace {
+				t.Fatalf("Expected namespace %s but got %s", test.namespace, kc.namespace)
+			}
+			annotations := kc.obj.(*unstructured.Unstructured).GetAnnotations()
+			if revision := annotations[annotationPrefix+"revision"]; revision != test.revision {
+				t.Fatalf("Expected revision %s but got %s", test.revision, revision)
+			}
+			resp := &Response{}
+			if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(resp.DeliveryID, "1234-replay-") || resp.Outcome != ResponseCreated {
+				t.Fatalf("Unexpected response %s", w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package handler
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ErrorCode identifies why a webhook couldn't be handled. Codes are stable,
+// so tools can act on them.
+type ErrorCode string
+
+const (
+	CodeInternal            ErrorCode = "INTERNAL"
+	CodeMethodNotAllowed    ErrorCode = "METHOD_NOT_ALLOWED"
+	CodeSourceNotAllowed    ErrorCode = "SOURCE_NOT_ALLOWED"
+	CodeInvalidBody         ErrorCode = "INVALID_BODY"
+	CodeInvalidPayload      ErrorCode = "INVALID_PAYLOAD"
+	CodeInvalidSignature    ErrorCode = "INVALID_SIGNATURE"
+	CodeSecretUnavailable   ErrorCode = "SECRET_UNAVAILABLE"
+	CodeNoSecret            ErrorCode = "NO_SECRET"
+	CodeUnsupportedEvent    ErrorCode = "UNSUPPORTED_EVENT"
+	CodeManifestNotFound    ErrorCode = "MANIFEST_NOT_FOUND"
+	CodeLoadFailed          ErrorCode = "LOAD_FAILED"
+	CodeDecodeFailed        ErrorCode = "DECODE_FAILED"
+	CodePolicyFailed        ErrorCode = "POLICY_FAILED"
+	CodePolicyDenied        ErrorCode = "POLICY_DENIED"
+	CodeAdmissionFailed     ErrorCode = "ADMISSION_FAILED"
+	CodeAdmissionDenied     ErrorCode = "ADMISSION_DENIED"
+	CodeNamespaceFailed     ErrorCode = "NAMESPACE_FAILED"
+	CodeImpersonationFailed ErrorCode = "IMPERSONATION_FAILED"
+	CodeRunAnchorFailed     ErrorCode = "RUN_ANCHOR_FAILED"
+	CodeAlreadyHandled      ErrorCode = "ALREADY_HANDLED"
+	CodeApplyForbidden      ErrorCode = "APPLY_FORBIDDEN"
+	CodeApplyConflict       ErrorCode = "APPLY_CONFLICT"
+	CodeApplyFailed         ErrorCode = "APPLY_FAILED"
+	CodeUnauthorized        ErrorCode = "UNAUTHORIZED"
+	CodeInvalidParameter    ErrorCode = "INVALID_PARAMETER"
+	CodeDeliveryNotFound    ErrorCode = "DELIVERY_NOT_FOUND"
+	CodeRefNotFound         ErrorCode = "REF_NOT_FOUND"
+	CodeResolveFailed       ErrorCode = "RESOLVE_FAILED"
+	CodePermissionFailed    ErrorCode = "PERMISSION_FAILED"
+	CodeCommandForbidden    ErrorCode = "COMMAND_FORBIDDEN"
+	CodeInvalidInputs       ErrorCode = "INVALID_INPUTS"
+	CodeInputsFailed        ErrorCode = "INPUTS_FAILED"
+	CodeCompareFailed       ErrorCode = "COMPARE_FAILED"
+)
+
+// Outcomes of handling a webhook.
+const (
+	ResponseCreated = "created"
+	// ResponseSkipped is returned in dry run mode.
+	ResponseSkipped = "skipped"
+	// ResponseIgnored is returned for events there is nothing to do for.
+	ResponseIgnored = "ignored"
+	ResponseDeleted = "deleted"
+	ResponseFailed  = "failed"
+)
+
+// Response is the JSON body ServeHTTP answers webhooks with.
+type Response struct {
+	DeliveryID string           `json:"deliveryID,omitempty"`
+	Event      *EventSummary    `json:"event,omitempty"`
+	Rule       string           `json:"rule,omitempty"`
+	Namespace  string           `json:"namespace,omitempty"`
+	Outcome    string           `json:"outcome"`
+	Message    string           `json:"message"`
+	Objects    []*AppliedObject `json:"objects,omitempty"`
+	// Run is the run anchor owning the objects.
+	Run      string   `json:"run,omitempty"`
+	Findings []string `json:"findings,omitempty"`
+	// SkipReason is the commit message directive like "skip ci" the event
+	// was skipped by.
+	SkipReason string         `json:"skipReason,omitempty"`
+	Error      *ResponseError `json:"error,omitempty"`
+}
+
+// EventSummary describes the event a webhook was parsed as.
+type EventSummary struct {
+	Type     string `json:"type"`
+	Action   string `json:"action,omitempty"`
+	Repo     string `json:"repo"`
+	Ref      string `json:"ref,omitempty"`
+	Revision string `json:"revision,omitempty"`
+}
+
+// ResponseError describes why a webhook couldn't be handled.
+type ResponseError struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+	Details []string  `json:"details,omitempty"`
+}
+
+type handlerResponse struct {
+	status  int
+	code    ErrorCode
+	outcome string
+	message string
+	// details are listed below the message, e.g. policy violations.
+	details   []string
+	rule      string
+	namespace string
+	objects   []*AppliedObject
+	run       string
+	findings  []string
+	// skipReason is the commit message directive an event was skipped by.
+	skipReason string
+}
+
+// text returns the plain text form of the response.
+func (hr *handlerResponse) text() string {
+	text := hr.message
+	if len(hr.details) > 0 {
+		text += ":\n- " + strings.Join(hr.details, "\n- ")
+	}
+	text += formatApplied(hr.objects)
+	if hr.run != "" {
+		text += "\nRun: " + hr.run
+	}
+	if len(hr.findings) > 0 {
+		text += "\nAdmission findings:\n- " + strings.Join(hr.findings, "\n- ")
+	}
+	return text
+}
+
+// response returns the JSON form of the response. event is nil if the
+// request couldn't be parsed as event.
+func (hr *handlerResponse) response(delivery string, event *Event, err error) *Response {
+	resp := &Response{
+		DeliveryID: delivery,
+		Rule:       hr.rule,
+		Namespace:  hr.namespace,
+		Outcome:    hr.outcome,
+		Message:    hr.message,
+		Objects:    hr.objects,
+		Run:        hr.run,
+		Findings:   hr.findings,
+		SkipReason: hr.skipReason,
+	}
+	if event != nil {
+		resp.Event = &EventSummary{
+			Type:     event.Type,
+			Action:   event.Action,
+			Repo:     event.GetFullName(),
+			Ref:      event.Ref,
+			Revision: event.Revision,
+		}
+	}
+	// Responses with an error code or status are failures even without an
+	// error.
+	if err != nil || hr.code != "" || hr.status >= http.StatusBadRequest {
+		code, message := hr.code, hr.message
+		if code == "" {
+			code = CodeInternal
+		}
+		if err != nil {
+			message = err.Error()
+		}
+		resp.Outcome = ResponseFailed
+		resp.Error = &ResponseError{Code: code, Message: message, Details: hr.details}
+	}
+	return resp
+}
+
+// write writes the response as JSON or, if the client prefers it by its
+// Accept header, as plain text.
+func (hr *handlerResponse) write(w http.ResponseWriter, r *http.Request, delivery string, event *Event, err error) error {
+	if prefersText(r.Header.Get("Accept")) {
+		http.Error(w, hr.text(), hr.status)
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(hr.status)
+	return json.NewEncoder(w).Encode(hr.response(delivery, event, err))
+}
+
+// prefersText returns true if the Accept header ranks text/plain above
+// application/json. JSON is preferred on ties and if accept is empty.
+func prefersText(accept string) bool {
+	var textQ, jsonQ float64
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		switch mediaType {
+		case "text/plain", "text/*":
+			if q > textQ {
+				textQ = q
+			}
+		case "application/json", "application/*":
+			if q > jsonQ {
+				jsonQ = q
+			}
+		}
+	}
+	return textQ > jsonQ
+}
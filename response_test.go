@@ -0,0 +1,165 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestPrefersText(t *testing.T) {
+	for _, test := range []struct {
+		accept string
+		text   bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"application/json", false},
+		{"text/plain", true},
+		{"text/*", true},
+		{"text/plain, application/json", false},
+		{"text/plain, application/json;q=0.5", true},
+		{"application/json;q=0.1, text/plain;q=0.9", true},
+		{"text/html", false},
+	} {
+		if text := prefersText(test.accept); text != test.text {
+			t.Errorf("Expected prefersText(%q) to be %v", test.accept, test.text)
+		}
+	}
+}
+
+func TestHandleJSON(t *testing.T) {
+	clusterRoleBinding := &unstructured.Unstructured{Object: map[string]interface{}{"apiVersion": "rbac.authorization.k8s.io/v1", "kind": "ClusterRoleBinding", "metadata": map[string]interface{}{"name": "foo"}}}
+	config := &Config{Namespace: "ci", Insecure: true, Rules: []*Rule{{Name: "foo", Repo: "foo/*"}}}
+	event := &EventSummary{Type: "push", Repo: "foo/bar", Ref: "refs/heads/feature-123", Revision: "abc"}
+
+	for _, test := range []struct {
+		name     string
+		loader   *mockLoader
+		kc       *mockKubernetesClient
+		status   int
+		response *Response
+	}{
+		{
+			name:   "created",
+			loader: &mockLoader{},
+			kc:     &mockKubernetesClient{},
+			status: http.StatusOK,
+			response: &Response{Outcome: ResponseCreated, Message: "Webhook handled successfully", Objects: []*AppliedObject{
+				{APIVersion: "argoproj.io/v1alpha1", Kind: "Workflow", Namespace: "ci", Name: "hello-world-abcde", UID: "uid-hello-world-abcde", Outcome: OutcomeCreated},
+			}},
+		},
+		{
+			name:   "not found",
+			loader: &mockLoader{err: &NotFoundError{errors.New("not found")}},
+			kc:     &mockKubernetesClient{},
+			status: http.StatusInternalServerError,
+			response: &Response{Outcome: ResponseFailed, Message: "Couldn't download manifest", Error: &ResponseError{
+				Code: CodeManifestNotFound, Message: "not found",
+			}},
+		},
+		{
+			name:   "decode",
+			loader: &mockLoader{err: &DecodeError{errors.New("invalid")}},
+			kc:     &mockKubernetesClient{},
+			status: http.StatusInternalServerError,
+			response: &Response{Outcome: ResponseFailed, Message: "Couldn't download manifest", Error: &ResponseError{
+				Code: CodeDecodeFailed, Message: "invalid",
+			}},
+		},
+		{
+			name:   "policy",
+			loader: &mockLoader{obj: clusterRoleBinding},
+			kc:     &mockKubernetesClient{},
+			status: http.StatusForbidden,
+			response: &Response{Outcome: ResponseFailed, Message: "Manifest violates policy", Error: &ResponseError{
+				Code:    CodePolicyDenied,
+				Message: "Manifest violates policy: ClusterRoleBinding/foo: cluster-scoped kind rbac.authorization.k8s.io/v1/ClusterRoleBinding not allowed",
+				Details: []string{"ClusterRoleBinding/foo: cluster-scoped kind rbac.authorization.k8s.io/v1/ClusterRoleBinding not allowed"},
+			}},
+		},
+		{
+			name:   "conflict",
+			loader: &mockLoader{},
+			kc:     &mockKubernetesClient{err: apierrors.NewAlreadyExists(schema.GroupResource{Group: "argoproj.io", Resource: "workflows"}, "foo")},
+			status: http.StatusConflict,
+			response: &Response{Outcome: ResponseFailed, Message: "Couldn't apply resource", Error: &ResponseError{
+				Code: CodeApplyConflict, Message: `workflows.argoproj.io "foo" already exists`,
+			}},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			handler := NewGithubHookHandler(log.NewNopLogger(), config, test.kc, test.loader, newTestMetrics())
+			req := newRequest("push", pushPayload, "")
+			req.Header.Set("Accept", "application/json, text/plain;q=0.5")
+			req.Header.Set("X-GitHub-Delivery", "1234")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != test.status {
+				t.Fatalf("Expected status %d but got %d: %s", test.status, w.Code, w.Body.String())
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Fatalf("Expected JSON but got %s", ct)
+			}
+			resp := &Response{}
+			if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+				t.Fatal(err)
+			}
+			test.response.DeliveryID = "1234"
+			test.response.Event = event
+			test.response.Rule = "foo"
+			test.response.Namespace = "ci"
+			if diff := cmp.Diff(test.response, resp); diff != "" {
+				t.Fatalf("Not Equal (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestHandleJSONMethod(t *testing.T) {
+	handler := NewGithubHookHandler(log.NewNopLogger(), &Config{Insecure: true}, &mockKubernetesClient{}, &mockLoader{}, newTestMetrics())
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	resp := &Response{}
+	if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusBadRequest || resp.Outcome != ResponseFailed || resp.Error == nil || resp.Error.Code != CodeMethodNotAllowed {
+		t.Fatalf("Unexpected response %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestResponseWithoutError(t *testing.T) {
+	hr := &handlerResponse{status: http.StatusForbidden, code: CodeCommandForbidden, message: "Not allowed"}
+	resp := hr.response("1234", nil, nil)
+	if resp.Outcome != ResponseFailed || resp.Error == nil || resp.Error.Code != CodeCommandForbidden || resp.Error.Message != "Not allowed" {
+		t.Fatalf("Unexpected response %#v", resp)
+	}
+	if resp := (&handlerResponse{outcome: ResponseIgnored, message: "Skipping"}).response("1234", nil, nil); resp.Outcome != ResponseIgnored || resp.Error != nil {
+		t.Fatalf("Unexpected response %#v", resp)
+	}
+}
+
+func TestHandleJSONInvalid(t *testing.T) {
+	handler := NewGithubHookHandler(log.NewNopLogger(), &Config{Secret: []byte("foo")}, &mockKubernetesClient{}, &mockLoader{}, newTestMetrics())
+	req := newRequest("push", pushPayload, "bar")
+	req.Header.Del("Accept")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	resp := &Response{}
+	if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusBadRequest || resp.Event != nil || resp.Error == nil || resp.Error.Code != CodeInvalidSignature {
+		t.Fatalf("Unexpected response %d: %s", w.Code, w.Body.String())
+	}
+}
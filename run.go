@@ -0,0 +1,291 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/dynamic"
+
+	"github.com/airbnb/k8s-webhook-handler/api/v1alpha1"
+)
+
+// RunAnchor selects the object created per delivery to own all objects
+// applied for it. Deleting the anchor deletes these objects by garbage
+// collection.
+type RunAnchor string
+
+const (
+	// RunAnchorNone disables run anchors. This is the default.
+	RunAnchorNone RunAnchor = ""
+	// RunAnchorConfigMap creates a ConfigMap per delivery.
+	RunAnchorConfigMap RunAnchor = "configmap"
+)
+
+const (
+	// AnchorLabel marks run anchors.
+	AnchorLabel = annotationPrefix + "anchor"
+	// DeliveryAnnotation holds the delivery ID of the webhook an object was
+	// created for.
+	DeliveryAnnotation = annotationPrefix + "delivery"
+
+	anchorPrefix = "webhook-run-"
+)
+
+// Validate returns an error if a is not a known anchor.
+func (a RunAnchor) Validate() error {
+	switch a {
+	case RunAnchorNone, RunAnchorConfigMap:
+		return nil
+	}
+	return fmt.Errorf("Invalid run anchor %q", a)
+}
+
+type deliveryKey struct{}
+
+// WithDeliveryID returns a context carrying the webhook's delivery ID.
+func WithDeliveryID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, deliveryKey{}, id)
+}
+
+// DeliveryID returns the delivery ID stored in ctx or an empty string.
+func DeliveryID(ctx context.Context) string {
+	id, _ := ctx.Value(deliveryKey{}).(string)
+	return id
+}
+
+// runAnchor returns the anchor of kind for event. It's named after the
+// delivery ID if there is one.
+func runAnchor(kind RunAnchor, event *Event, delivery string) (*unstructured.Unstructured, error) {
+	if kind != RunAnchorConfigMap {
+		return nil, fmt.Errorf("Unsupported run anchor %q", kind)
+	}
+	content, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	labels, _ := namespaceLabels(event)
+	labels[AnchorLabel] = "true"
+	annotations := event.Annotations()
+	annotations[DeliveryAnnotation] = delivery
+
+	anchor := &unstructured.Unstructured{}
+	anchor.SetAPIVersion("v1")
+	anchor.SetKind("ConfigMap")
+	if delivery != "" {
+		anchor.SetName(NamespaceName(anchorPrefix + delivery))
+	} else {
+		anchor.SetGenerateName(anchorPrefix)
+	}
+	anchor.SetLabels(labels)
+	anchor.SetAnnotations(annotations)
+	if err := unstructured.SetNestedStringMap(anchor.Object, map[string]string{
+		"delivery": delivery,
+		"event":    string(content),
+	}, "data"); err != nil {
+		return nil, err
+	}
+	return anchor, nil
+}
+
+// ownerReference returns a reference to the created anchor.
+func ownerReference(anchor *AppliedObject) *metav1.OwnerReference {
+	return &metav1.OwnerReference{
+		APIVersion: anchor.APIVersion,
+		Kind:       anchor.Kind,
+		Name:       anchor.Name,
+		UID:        anchor.UID,
+	}
+}
+
+// RunRecorder records how deliveries were handled.
+type RunRecorder interface {
+	Record(run *v1alpha1.WebhookRun) error
+}
+
+// KubernetesRunRecorder records deliveries as WebhookRuns in a namespace.
+type KubernetesRunRecorder struct {
+	client    dynamic.Interface
+	namespace string
+}
+
+// NewKubernetesRunRecorder returns a recorder creating WebhookRuns in
+// namespace.
+func NewKubernetesRunRecorder(client dynamic.Interface, namespace string) *KubernetesRunRecorder {
+	return &KubernetesRunRecorder{client: client, namespace: namespace}
+}
+
+// Record creates run including its status.
+func (r *KubernetesRunRecorder) Record(run *v1alpha1.WebhookRun) error {
+	run = run.DeepCopy()
+	run.SetGroupVersionKind(v1alpha1.SchemeGroupVersion.WithKind("WebhookRun"))
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(run)
+	if err != nil {
+		return err
+	}
+	client := r.client.Resource(v1alpha1.WebhookRunResource).Namespace(r.namespace)
+	created, err := client.Create(&unstructured.Unstructured{Object: content}, metav1.CreateOptions{})
+	if err != nil {
+		return err
+	}
+	// The status subresource is ignored on creation, so set it separately.
+	created.Object["status"] = content["status"]
+	_, err = client.UpdateStatus(created, metav1.UpdateOptions{})
+	return err
+}
+
+// Prune deletes all WebhookRuns created more than ttl before now and returns
+// how many were deleted.
+func (r *KubernetesRunRecorder) Prune(ttl time.Duration, now time.Time) (int, error) {
+	client := r.client.Resource(v1alpha1.WebhookRunResource).Namespace(r.namespace)
+	list, err := client.List(metav1.ListOptions{})
+	if err != nil {
+		return 0, err
+	}
+	pruned := 0
+	errs := []error{}
+	for _, run := range list.Items {
+		if now.Sub(run.GetCreationTimestamp().Time) < ttl {
+			continue
+		}
+		if err := client.Delete(run.GetName(), &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			errs = append(errs, err)
+			continue
+		}
+		pruned++
+	}
+	return pruned, utilerrors.NewAggregate(errs)
+}
+
+// PruneRuns deletes WebhookRuns older than ttl every interval until stopCh
+// is closed.
+func (r *KubernetesRunRecorder) PruneRuns(logger log.Logger, ttl, interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			pruned, err := r.Prune(ttl, time.Now())
+			if err != nil {
+				level.Error(logger).Log("msg", "Couldn't prune webhook runs", "err", err)
+			}
+			if pruned > 0 {
+				level.Info(logger).Log("msg", "Pruned webhook runs", "count", pruned)
+			}
+		}
+	}
+}
+
+// newWebhookRun returns the run for a delivery, which is completed while
+// handling it. The event is set once it's parsed.
+func newWebhookRun(delivery, eventType string) *v1alpha1.WebhookRun {
+	now := metav1.Now()
+	return &v1alpha1.WebhookRun{
+		ObjectMeta: metav1.ObjectMeta{GenerateName: "webhook-"},
+		Spec: v1alpha1.WebhookRunSpec{
+			DeliveryID: delivery,
+			EventType:  eventType,
+		},
+		Status: v1alpha1.WebhookRunStatus{StartTime: &now},
+	}
+}
+
+// setRunEvent sets the event run was created for.
+func setRunEvent(run *v1alpha1.WebhookRun, event *Event) {
+	labels, _ := namespaceLabels(event)
+	run.GenerateName = NamespaceName(event.Vars()["name"]) + "-"
+	run.Labels = labels
+	run.Spec.EventType = event.Type
+	run.Spec.Action = event.Action
+	run.Spec.Repo = event.GetFullName()
+	run.Spec.Ref = event.Ref
+	run.Spec.Revision = event.Revision
+}
+
+type runKey struct{}
+
+// withRun returns a context in which HandleEvent completes run instead of
+// recording a run itself. The caller records it.
+func withRun(ctx context.Context, run *v1alpha1.WebhookRun) context.Context {
+	return context.WithValue(ctx, runKey{}, run)
+}
+
+// contextRun returns the run stored in ctx or nil.
+func contextRun(ctx context.Context) *v1alpha1.WebhookRun {
+	run, _ := ctx.Value(runKey{}).(*v1alpha1.WebhookRun)
+	return run
+}
+
+// recordRun completes run with the response and error of handling it and
+// records it.
+func (h *Handler) recordRun(run *v1alpha1.WebhookRun, hr *handlerResponse, err error) {
+	completeRun(run, hr, err)
+	if err := h.Runs.Record(run); err != nil {
+		level.Error(h.Logger).Log("msg", "Couldn't record run", "delivery", run.Spec.DeliveryID, "err", err)
+	}
+}
+
+// observeStage records the duration of a stage of run.
+func observeStage(run *v1alpha1.WebhookRun, name string, duration time.Duration) {
+	run.Status.Stages = append(run.Status.Stages, v1alpha1.StageTiming{
+		Name:     name,
+		Duration: metav1.Duration{Duration: duration},
+	})
+}
+
+// runObjects converts applied to the objects recorded in a run.
+func runObjects(applied []*AppliedObject) []v1alpha1.ObjectStatus {
+	objects := make([]v1alpha1.ObjectStatus, len(applied))
+	for i, a := range applied {
+		objects[i] = v1alpha1.ObjectStatus{
+			APIVersion: a.APIVersion,
+			Kind:       a.Kind,
+			Namespace:  a.Namespace,
+			Name:       a.Name,
+			UID:        a.UID,
+			Outcome:    a.Outcome,
+			Error:      a.Error,
+		}
+	}
+	return objects
+}
+
+// completeRun sets the status of run from the response and error of handling
+// the delivery.
+func completeRun(run *v1alpha1.WebhookRun, hr *handlerResponse, err error) {
+	now := metav1.Now()
+	run.Status.CompletionTime = &now
+	var status int
+	if hr != nil {
+		run.Status.Message = hr.message
+		status = hr.status
+	}
+	switch requestOutcome(status, err) {
+	case "succeeded":
+		run.Status.Phase = v1alpha1.RunSucceeded
+	case "rejected":
+		run.Status.Phase = v1alpha1.RunRejected
+	default:
+		run.Status.Phase = v1alpha1.RunFailed
+	}
+	if err == nil {
+		return
+	}
+	if agg, ok := err.(utilerrors.Aggregate); ok {
+		for _, e := range agg.Errors() {
+			run.Status.Errors = append(run.Status.Errors, e.Error())
+		}
+		return
+	}
+	run.Status.Errors = append(run.Status.Errors, err.Error())
+}
@@ -0,0 +1,159 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-github/v24/github"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/dynamic/fake"
+
+	"github.com/airbnb/k8s-webhook-handler/api/v1alpha1"
+)
+
+func TestRunAnchor(t *testing.T) {
+	event := &Event{
+		Type:     "push",
+		Ref:      "refs/heads/master",
+		Revision: "00000",
+		Repository: &github.Repository{
+			FullName: github.String("airbnb/foo"),
+			GitURL:   github.String("git://github.com/airbnb/foo.git"),
+			SSHURL:   github.String("git@github.com:airbnb/foo.git"),
+		},
+	}
+
+	anchor, err := runAnchor(RunAnchorConfigMap, event, "1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if anchor.GetName() != "webhook-run-1234" {
+		t.Fatalf("Expected name webhook-run-1234 but got %s", anchor.GetName())
+	}
+	if labels := anchor.GetLabels(); labels[AnchorLabel] != "true" || labels[RepoLabel] != "airbnb-foo" {
+		t.Fatalf("Unexpected labels %v", labels)
+	}
+	data, _, _ := unstructured.NestedStringMap(anchor.Object, "data")
+	if data["delivery"] != "1234" {
+		t.Fatalf("Expected delivery 1234 but got %s", data["delivery"])
+	}
+	decoded := &Event{}
+	if err := json.Unmarshal([]byte(data["event"]), decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.GetFullName() != "airbnb/foo" || decoded.Revision != "00000" {
+		t.Fatalf("Unexpected event %v", decoded)
+	}
+
+	anchor, err = runAnchor(RunAnchorConfigMap, event, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if anchor.GetName() != "" || anchor.GetGenerateName() != "webhook-run-" {
+		t.Fatalf("Expected generated name but got %q/%q", anchor.GetName(), anchor.GetGenerateName())
+	}
+
+	if _, err := runAnchor("secret", event, ""); err == nil {
+		t.Fatal("Expected error for unsupported anchor")
+	}
+}
+
+func TestDeliveryID(t *testing.T) {
+	if id := DeliveryID(context.Background()); id != "" {
+		t.Fatalf("Expected no delivery ID but got %s", id)
+	}
+	if id := DeliveryID(WithDeliveryID(context.Background(), "1234")); id != "1234" {
+		t.Fatalf("Expected delivery ID 1234 but got %s", id)
+	}
+}
+
+func TestRecordRun(t *testing.T) {
+	dc := fake.NewSimpleDynamicClient(runtime.NewScheme())
+	recorder := NewKubernetesRunRecorder(dc, "ci")
+	run := &v1alpha1.WebhookRun{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo-abcde"},
+		Spec:       v1alpha1.WebhookRunSpec{Repo: "airbnb/foo", EventType: "push"},
+		Status: v1alpha1.WebhookRunStatus{
+			Phase:   v1alpha1.RunSucceeded,
+			Objects: []v1alpha1.ObjectStatus{{APIVersion: "v1", Kind: "ConfigMap", Name: "foo", Outcome: OutcomeCreated}},
+			Stages:  []v1alpha1.StageTiming{{Name: "load", Duration: metav1.Duration{Duration: time.Second}}},
+		},
+	}
+	if err := recorder.Record(run); err != nil {
+		t.Fatal(err)
+	}
+
+	obj, err := dc.Resource(v1alpha1.WebhookRunResource).Namespace("ci").Get("foo-abcde", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded := &v1alpha1.WebhookRun{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, recorded); err != nil {
+		t.Fatal(err)
+	}
+	if recorded.Kind != "WebhookRun" || recorded.APIVersion != "k8s-webhook-handler.io/v1alpha1" {
+		t.Fatalf("Unexpected type %v", recorded.TypeMeta)
+	}
+	if diff := cmp.Diff(run.Status, recorded.Status); diff != "" {
+		t.Fatalf("Not Equal (-want +got):\n%s", diff)
+	}
+}
+
+func TestPruneRuns(t *testing.T) {
+	now := time.Now()
+	newRun := func(name string, age time.Duration) runtime.Object {
+		run := &unstructured.Unstructured{}
+		run.SetGroupVersionKind(v1alpha1.SchemeGroupVersion.WithKind("WebhookRun"))
+		run.SetNamespace("ci")
+		run.SetName(name)
+		run.SetCreationTimestamp(metav1.NewTime(now.Add(-age)))
+		return run
+	}
+	dc := fake.NewSimpleDynamicClient(runtime.NewScheme(), newRun("old", 2*time.Hour), newRun("new", time.Minute))
+	recorder := NewKubernetesRunRecorder(dc, "ci")
+
+	pruned, err := recorder.Prune(time.Hour, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 1 {
+		t.Fatalf("Expected 1 pruned run but got %d", pruned)
+	}
+	list, err := dc.Resource(v1alpha1.WebhookRunResource).Namespace("ci").List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Items) != 1 || list.Items[0].GetName() != "new" {
+		t.Fatalf("Expected only run new to be left but got %v", list.Items)
+	}
+}
+
+func TestCompleteRun(t *testing.T) {
+	for _, test := range []struct {
+		hr     *handlerResponse
+		err    error
+		phase  v1alpha1.RunPhase
+		errors []string
+	}{
+		{&handlerResponse{message: "ok"}, nil, v1alpha1.RunSucceeded, nil},
+		{&handlerResponse{status: http.StatusForbidden, message: "denied"}, errors.New("denied"), v1alpha1.RunRejected, []string{"denied"}},
+		{&handlerResponse{message: "failed"}, utilerrors.NewAggregate([]error{errors.New("a"), errors.New("b")}), v1alpha1.RunFailed, []string{"a", "b"}},
+	} {
+		run := &v1alpha1.WebhookRun{}
+		completeRun(run, test.hr, test.err)
+		if run.Status.Phase != test.phase || run.Status.Message != test.hr.message || run.Status.CompletionTime == nil {
+			t.Fatalf("Unexpected status %v", run.Status)
+		}
+		if diff := cmp.Diff(test.errors, run.Status.Errors); diff != "" {
+			t.Fatalf("Not Equal (-want +got):\n%s", diff)
+		}
+	}
+}
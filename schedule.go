@@ -0,0 +1,190 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-kit/kit/metrics"
+	"github.com/google/go-github/v24/github"
+	"github.com/robfig/cron/v3"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// scheduleNameRegex matches valid schedule names. They are part of delivery
+// IDs.
+var scheduleNameRegex = regexp.MustCompile(`^[A-Za-z0-9-]{1,64}$`)
+
+// ScheduleRule handles a repository's ref periodically, e.g. for nightly
+// dependency scans.
+type ScheduleRule struct {
+	Name string `json:"name"`
+	// Repo is the full repository name, e.g. airbnb/foo.
+	Repo string `json:"repo"`
+	// Ref is a branch name or full ref like refs/heads/master. Its head is
+	// resolved every time the rule fires. Tags need to be given as full ref
+	// like refs/tags/v1.0.
+	Ref string `json:"ref"`
+	// Schedule is a cron expression like "0 3 * * *" or a descriptor like
+	// @daily.
+	Schedule string `json:"schedule"`
+	// ResourcePath, if set, is loaded instead of the global resource path.
+	ResourcePath string `json:"resourcePath,omitempty"`
+	// Timezone is the IANA time zone Schedule is interpreted in. Defaults to
+	// UTC.
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// Validate returns an error if the rule is incomplete or its schedule or
+// timezone are invalid.
+func (r *ScheduleRule) Validate() error {
+	if !scheduleNameRegex.MatchString(r.Name) {
+		return fmt.Errorf("Schedule %q needs a name of up to 64 letters, digits and dashes", r.Name)
+	}
+	if parts := strings.Split(r.Repo, "/"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("Schedule %s has invalid repo %q", r.Name, r.Repo)
+	}
+	if r.Ref == "" {
+		return fmt.Errorf("Schedule %s has no ref", r.Name)
+	}
+	if _, err := r.schedule(); err != nil {
+		return fmt.Errorf("Schedule %s is invalid: %s", r.Name, err)
+	}
+	return nil
+}
+
+func (r *ScheduleRule) schedule() (cron.Schedule, error) {
+	spec := r.Schedule
+	if strings.HasPrefix(spec, "TZ=") || strings.HasPrefix(spec, "CRON_TZ=") {
+		return nil, fmt.Errorf("Use timezone instead of %q", spec)
+	}
+	timezone := r.Timezone
+	if timezone == "" {
+		timezone = "UTC"
+	}
+	if _, err := time.LoadLocation(timezone); err != nil {
+		return nil, err
+	}
+	return cron.ParseStandard("CRON_TZ=" + timezone + " " + spec)
+}
+
+// ScheduleEvent is a synthetic event for a ScheduleRule firing.
+type ScheduleEvent struct {
+	Repository *github.Repository
+	Ref        string
+	Revision   string
+	// Schedule is the name of the rule.
+	Schedule string
+}
+
+type resourcePathKey struct{}
+
+// withResourcePath returns a context in which HandleEvent loads path instead
+// of the configured resource path.
+func withResourcePath(ctx context.Context, path string) context.Context {
+	return context.WithValue(ctx, resourcePathKey{}, path)
+}
+
+// resourcePath returns the path stored in ctx or def.
+func resourcePath(ctx context.Context, def string) string {
+	if path, ok := ctx.Value(resourcePathKey{}).(string); ok && path != "" {
+		return path
+	}
+	return def
+}
+
+// scheduleDeliveryID returns the delivery ID rule firing at t is handled as.
+// It's the same on all replicas, so run anchors prevent handling it twice.
+func scheduleDeliveryID(rule *ScheduleRule, t time.Time) string {
+	return "schedule-" + rule.Name + "-" + t.UTC().Format("20060102150405")
+}
+
+// Scheduler handles ScheduleEvents by their rules' schedules.
+type Scheduler struct {
+	log.Logger
+	handler  *Handler
+	resolver RefResolver
+	rules    []*ScheduleRule
+
+	firedCounter metrics.Counter
+	errorCounter metrics.Counter
+}
+
+// NewScheduler returns a scheduler for rules, resolving refs by resolver and
+// handling the events by handler. firedCounter counts fired rules,
+// errorCounter the ones which couldn't be handled.
+func NewScheduler(logger log.Logger, handler *Handler, resolver RefResolver, rules []*ScheduleRule, firedCounter, errorCounter metrics.Counter) (*Scheduler, error) {
+	for _, rule := range rules {
+		if err := rule.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return &Scheduler{
+		Logger:       logger,
+		handler:      handler,
+		resolver:     resolver,
+		rules:        rules,
+		firedCounter: firedCounter,
+		errorCounter: errorCounter,
+	}, nil
+}
+
+// Run fires the rules by their schedules until stopCh is closed. Rules
+// firing while a previous run of them is in progress are skipped.
+func (s *Scheduler) Run(stopCh <-chan struct{}) {
+	c := cron.New(cron.WithChain(cron.SkipIfStillRunning(cron.DiscardLogger)))
+	for _, rule := range s.rules {
+		rule := rule
+		schedule, _ := rule.schedule()
+		c.Schedule(schedule, cron.FuncJob(func() {
+			// Schedules have a resolution of a minute, so this is the time
+			// the rule was scheduled at on all replicas.
+			if err := s.Fire(context.Background(), rule, time.Now().Truncate(time.Minute)); err != nil {
+				level.Error(s.Logger).Log("msg", "Couldn't handle schedule", "schedule", rule.Name, "err", err)
+			}
+		}))
+	}
+	c.Start()
+	<-stopCh
+	<-c.Stop().Done()
+}
+
+// Fire handles rule as if it was scheduled at t.
+func (s *Scheduler) Fire(ctx context.Context, rule *ScheduleRule, t time.Time) (err error) {
+	delivery := scheduleDeliveryID(rule, t)
+	logger := log.With(s.Logger, "schedule", rule.Name, "repo", rule.Repo, "delivery", delivery)
+	s.firedCounter.Add(1)
+	defer func() {
+		if err != nil {
+			s.errorCounter.Add(1)
+		}
+	}()
+
+	ctx, span := startSpan(WithDeliveryID(ctx, delivery), "Schedule", trace.WithAttributes(attrDelivery.String(delivery), attrRepo.String(rule.Repo)))
+	defer func() { endSpan(span, err) }()
+
+	// The normalized ref is resolved, so it's the one the event names.
+	ev := &ScheduleEvent{Ref: normalizeRef(rule.Ref), Schedule: rule.Name}
+	ev.Repository, ev.Revision, err = s.resolver.ResolveRef(ctx, rule.Repo, ev.Ref)
+	if err != nil {
+		return fmt.Errorf("Couldn't resolve %s: %s", rule.Ref, err)
+	}
+	level.Info(logger).Log("msg", "Firing schedule", "ref", ev.Ref, "revision", ev.Revision)
+	ctx = withStageObserver(withResourcePath(ctx, rule.ResourcePath), s.handler.observeStage)
+	hr, err := s.handler.HandleEvent(ctx, ev)
+	if err != nil {
+		if hr != nil && hr.code == CodeAlreadyHandled {
+			level.Info(logger).Log("msg", "Schedule was already handled")
+			return nil
+		}
+		return err
+	}
+	if hr != nil {
+		level.Info(logger).Log("msg", hr.message, "outcome", hr.outcome)
+	}
+	return nil
+}
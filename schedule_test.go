@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics/generic"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestScheduleRuleValidate(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		rule  *ScheduleRule
+		valid bool
+	}{
+		{"valid", &ScheduleRule{Name: "nightly", Repo: "foo/bar", Ref: "master", Schedule: "0 3 * * *"}, true},
+		{"descriptor", &ScheduleRule{Name: "weekly", Repo: "foo/bar", Ref: "master", Schedule: "@weekly"}, true},
+		{"timezone", &ScheduleRule{Name: "nightly", Repo: "foo/bar", Ref: "master", Schedule: "0 3 * * *", Timezone: "Europe/Berlin"}, true},
+		{"no name", &ScheduleRule{Repo: "foo/bar", Ref: "master", Schedule: "0 3 * * *"}, false},
+		{"invalid name", &ScheduleRule{Name: "nightly scan", Repo: "foo/bar", Ref: "master", Schedule: "0 3 * * *"}, false},
+		{"repo pattern", &ScheduleRule{Name: "nightly", Repo: "foo", Ref: "master", Schedule: "0 3 * * *"}, false},
+		{"no ref", &ScheduleRule{Name: "nightly", Repo: "foo/bar", Schedule: "0 3 * * *"}, false},
+		{"invalid schedule", &ScheduleRule{Name: "nightly", Repo: "foo/bar", Ref: "master", Schedule: "0 3 * *"}, false},
+		{"invalid timezone", &ScheduleRule{Name: "nightly", Repo: "foo/bar", Ref: "master", Schedule: "0 3 * * *", Timezone: "Mars/Olympus"}, false},
+		{"inline timezone", &ScheduleRule{Name: "nightly", Repo: "foo/bar", Ref: "master", Schedule: "CRON_TZ=UTC 0 3 * * *"}, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.rule.Validate()
+			if test.valid && err != nil {
+				t.Fatalf("Expected rule to be valid but got: %s", err)
+			}
+			if !test.valid && err == nil {
+				t.Fatal("Expected rule to be invalid")
+			}
+		})
+	}
+}
+
+func TestScheduleTimezone(t *testing.T) {
+	rule := &ScheduleRule{Name: "nightly", Repo: "foo/bar", Ref: "master", Schedule: "0 3 * * *", Timezone: "America/New_York"}
+	schedule, err := rule.schedule()
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := schedule.Next(time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC))
+	if want := time.Date(2020, 1, 2, 8, 0, 0, 0, time.UTC); !next.Equal(want) {
+		t.Fatalf("Expected next run at %s but got %s", want, next.UTC())
+	}
+}
+
+func TestSchedulerFire(t *testing.T) {
+	kc := &mockKubernetesClient{}
+	loader := &mockLoader{}
+	handler := NewGithubHookHandler(log.NewNopLogger(), &Config{Namespace: "ci", ResourcePath: ".ci/workflow.yaml", RunAnchor: RunAnchorConfigMap}, kc, loader, newTestMetrics())
+	resolver := &mockResolver{}
+	rule := &ScheduleRule{Name: "nightly", Repo: "foo/bar", Ref: "master", Schedule: "@daily", ResourcePath: ".ci/nightly.yaml"}
+	fired, errs := generic.NewCounter("fired"), generic.NewCounter("errors")
+	scheduler, err := NewScheduler(log.NewNopLogger(), handler, resolver, []*ScheduleRule{rule}, fired, errs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	at := time.Date(2020, 1, 2, 3, 0, 0, 0, time.UTC)
+	if err := scheduler.Fire(context.Background(), rule, at); err != nil {
+		t.Fatal(err)
+	}
+	if resolver.ref != "refs/heads/master" {
+		t.Fatalf("Expected refs/heads/master to be resolved but got %s", resolver.ref)
+	}
+	if loader.path != ".ci/nightly.yaml" {
+		t.Fatalf("Expected schedule's resource path to be loaded but got %s", loader.path)
+	}
+	// anchor, manifest
+	if len(kc.applied) != 2 {
+		t.Fatalf("Expected 2 applies but got %d", len(kc.applied))
+	}
+	anchor := kc.applied[0].(*unstructured.Unstructured)
+	if delivery := anchor.GetAnnotations()[DeliveryAnnotation]; delivery != "schedule-nightly-20200102030000" {
+		t.Fatalf("Unexpected delivery %s", delivery)
+	}
+	annotations := kc.obj.(*unstructured.Unstructured).GetAnnotations()
+	for k, v := range map[string]string{"event_type": "schedule", "event_action": "nightly", "ref": "refs/heads/master", "revision": "abc"} {
+		if annotations[annotationPrefix+k] != v {
+			t.Errorf("Expected annotation %s=%s but got %v", k, v, annotations)
+		}
+	}
+
+	resolver.err = errors.New("GitHub is down")
+	if err := scheduler.Fire(context.Background(), rule, at.Add(24*time.Hour)); err == nil {
+		t.Fatal("Expected error resolving ref")
+	}
+	if v := fired.Value(); v != 2 {
+		t.Fatalf("Expected 2 fired schedules but got %v", v)
+	}
+	if v := errs.Value(); v != 1 {
+		t.Fatalf("Expected 1 error but got %v", v)
+	}
+}
+
+func TestSchedulerRunStops(t *testing.T) {
+	handler := NewGithubHookHandler(log.NewNopLogger(), &Config{Namespace: "ci"}, &mockKubernetesClient{}, &mockLoader{}, newTestMetrics())
+	rule := &ScheduleRule{Name: "nightly", Repo: "foo/bar", Ref: "master", Schedule: "@daily"}
+	scheduler, err := NewScheduler(log.NewNopLogger(), handler, &mockResolver{}, []*ScheduleRule{rule}, generic.NewCounter("fired"), generic.NewCounter("errors"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		scheduler.Run(stopCh)
+		close(done)
+	}()
+	close(stopCh)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Scheduler wasn't stopped")
+	}
+}
@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// SecretRepoAnnotation names the repository a webhook secret belongs to.
+	SecretRepoAnnotation = annotationPrefix + "repo"
+	// SecretKey is the key in the Secret's data holding the webhook secret.
+	SecretKey = "WEBHOOK_SECRET"
+
+	secretRepoIndex = "repo"
+)
+
+// SecretStore looks up per repository webhook secrets.
+type SecretStore interface {
+	// Secret returns the secret for repo or nil if there is none.
+	Secret(repo string) ([]byte, error)
+}
+
+// KubernetesSecretStore serves webhook secrets from labeled Kubernetes
+// Secrets, cached by an informer.
+type KubernetesSecretStore struct {
+	factory  informers.SharedInformerFactory
+	informer cache.SharedIndexInformer
+}
+
+// NewKubernetesSecretStore returns a store for all Secrets in namespace
+// matching the label selector. Run needs to be called before using it.
+func NewKubernetesSecretStore(client kubernetes.Interface, namespace, selector string, resync time.Duration) (*KubernetesSecretStore, error) {
+	factory := informers.NewSharedInformerFactoryWithOptions(client, resync,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) { o.LabelSelector = selector }),
+	)
+	informer := factory.Core().V1().Secrets().Informer()
+	if err := informer.AddIndexers(cache.Indexers{secretRepoIndex: secretRepoIndexFunc}); err != nil {
+		return nil, err
+	}
+	return &KubernetesSecretStore{factory: factory, informer: informer}, nil
+}
+
+func secretRepoIndexFunc(obj interface{}) ([]string, error) {
+	secret, ok := obj.(*corev1.Secret)
+	if !ok {
+		return nil, nil
+	}
+	repo, ok := secret.Annotations[SecretRepoAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	return []string{strings.ToLower(repo)}, nil
+}
+
+// Run starts the informer and waits for the cache to be synced.
+func (s *KubernetesSecretStore) Run(stopCh <-chan struct{}) error {
+	s.factory.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, s.informer.HasSynced) {
+		return fmt.Errorf("Couldn't sync secret cache")
+	}
+	return nil
+}
+
+func (s *KubernetesSecretStore) Secret(repo string) ([]byte, error) {
+	objs, err := s.informer.GetIndexer().ByIndex(secretRepoIndex, strings.ToLower(repo))
+	if err != nil {
+		return nil, err
+	}
+	switch len(objs) {
+	case 0:
+		return nil, nil
+	case 1:
+	default:
+		return nil, fmt.Errorf("Found %d secrets for repo %s", len(objs), repo)
+	}
+	secret := objs[0].(*corev1.Secret)
+	value, ok := secret.Data[SecretKey]
+	if !ok || len(value) == 0 {
+		return nil, fmt.Errorf("Secret %s/%s has no key %s", secret.Namespace, secret.Name, SecretKey)
+	}
+	return value, nil
+}
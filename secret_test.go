@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func secret(name, repo, value string, labels map[string]string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   "ci",
+			Labels:      labels,
+			Annotations: map[string]string{SecretRepoAnnotation: repo},
+		},
+		Data: map[string][]byte{SecretKey: []byte(value)},
+	}
+}
+
+func TestKubernetesSecretStore(t *testing.T) {
+	labels := map[string]string{"webhook-secret": "true"}
+	client := fake.NewSimpleClientset(
+		secret("foo-bar", "foo/bar", "foobar", labels),
+		secret("foo-baz", "Foo/Baz", "foobaz", labels),
+		secret("unlabeled", "foo/qux", "fooqux", nil),
+		secret("dup-1", "foo/dup", "1", labels),
+		secret("dup-2", "foo/dup", "2", labels),
+	)
+	store, err := NewKubernetesSecretStore(client, "ci", "webhook-secret=true", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	if err := store.Run(stopCh); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		repo        string
+		expect      string
+		expectError bool
+	}{
+		{"foo/bar", "foobar", false},
+		{"foo/baz", "foobaz", false},
+		{"foo/qux", "", false},
+		{"foo/dup", "", true},
+	} {
+		value, err := store.Secret(test.repo)
+		if test.expectError && err == nil {
+			t.Fatalf("Expected error but got nil: %v", test)
+		}
+		if err != nil {
+			if test.expectError {
+				continue
+			}
+			t.Fatalf("Failed with %s for %v", err, test)
+		}
+		if string(value) != test.expect {
+			t.Fatalf("Expected %q for %s but got %q", test.expect, test.repo, value)
+		}
+	}
+}
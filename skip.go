@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/google/go-github/v24/github"
+)
+
+// DefaultSkipDirectives are the commit message directives skipping pushes
+// by default.
+var DefaultSkipDirectives = []string{"skip ci", "ci skip"}
+
+// directiveRegex matches bracketed directives like [skip ci].
+var directiveRegex = regexp.MustCompile(`\[([^\[\]]+)\]`)
+
+// normalizeDirective lower cases d and collapses its whitespace.
+func normalizeDirective(d string) string {
+	return strings.Join(strings.Fields(strings.ToLower(d)), " ")
+}
+
+// manifestName returns the name of a manifest by its path, e.g. deploy for
+// .ci/deploy.yaml.
+func manifestName(p string) string {
+	base := path.Base(p)
+	return strings.TrimSuffix(base, path.Ext(base))
+}
+
+// skipDirective returns the first directive in messages which is one of
+// directives or "skip <manifest>" and an empty string if there is none.
+func skipDirective(messages, directives []string, manifest string) string {
+	scoped := normalizeDirective("skip " + manifest)
+	for _, message := range messages {
+		for _, match := range directiveRegex.FindAllStringSubmatch(message, -1) {
+			d := normalizeDirective(match[1])
+			if manifest != "" && d == scoped {
+				return d
+			}
+			for _, directive := range directives {
+				if d == normalizeDirective(directive) {
+					return d
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// commitMessages returns the message of the push's head commit or, if all
+// is set, of all its commits.
+func commitMessages(e *github.PushEvent, all bool) []string {
+	messages := []string{}
+	if e.HeadCommit != nil {
+		messages = append(messages, e.HeadCommit.GetMessage())
+	}
+	if all {
+		for _, c := range e.Commits {
+			messages = append(messages, c.GetMessage())
+		}
+	}
+	return messages
+}
@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-github/v24/github"
+)
+
+func TestSkipDirective(t *testing.T) {
+	for _, test := range []struct {
+		messages  []string
+		manifest  string
+		directive string
+	}{
+		{[]string{"Fix typo [skip ci]"}, "workflow", "skip ci"},
+		{[]string{"[CI  Skip] Update docs"}, "workflow", "ci skip"},
+		{[]string{"Fix typo\n\n[skip deploy]"}, "deploy", "skip deploy"},
+		{[]string{"Fix typo [skip deploy]"}, "workflow", ""},
+		{[]string{"Fix [skip] handling"}, "workflow", ""},
+		{[]string{"Mention skip ci without brackets"}, "workflow", ""},
+		{[]string{"Add feature", "Fix typo [skip ci]"}, "workflow", "skip ci"},
+		{[]string{}, "workflow", ""},
+	} {
+		if directive := skipDirective(test.messages, DefaultSkipDirectives, test.manifest); directive != test.directive {
+			t.Errorf("Expected directive %q for %q but got %q", test.directive, test.messages, directive)
+		}
+	}
+	if name := manifestName(".ci/deploy.yaml"); name != "deploy" {
+		t.Fatalf("Expected manifest name deploy but got %s", name)
+	}
+}
+
+func TestHandleSkipDirectives(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		head       string
+		commits    []string
+		allCommits bool
+		directives []string
+		outcome    string
+		reason     string
+	}{
+		{name: "no directive", head: "Add feature", directives: DefaultSkipDirectives, outcome: ResponseCreated},
+		{name: "skip ci", head: "Update docs [skip ci]", directives: DefaultSkipDirectives, outcome: ResponseIgnored, reason: "skip ci"},
+		{name: "scoped to manifest", head: "Update docs [skip workflow]", directives: DefaultSkipDirectives, outcome: ResponseIgnored, reason: "skip workflow"},
+		{name: "scoped to other manifest", head: "Update docs [skip deploy]", directives: DefaultSkipDirectives, outcome: ResponseCreated},
+		{name: "disabled", head: "Update docs [skip ci]", outcome: ResponseCreated},
+		{name: "earlier commit", head: "Add feature", commits: []string{"Update docs [skip ci]"}, directives: DefaultSkipDirectives, outcome: ResponseCreated},
+		{name: "all commits", head: "Add feature", commits: []string{"Update docs [skip ci]"}, allCommits: true, directives: DefaultSkipDirectives, outcome: ResponseIgnored, reason: "skip ci"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			config := &Config{Namespace: "ci", ResourcePath: ".ci/workflow.yaml", SkipDirectives: test.directives, SkipAllCommits: test.allCommits}
+			kc := &mockKubernetesClient{}
+			handler := NewGithubHookHandler(log.NewNopLogger(), config, kc, &mockLoader{}, newTestMetrics())
+			commits := []github.PushEventCommit{}
+			for _, message := range test.commits {
+				commits = append(commits, github.PushEventCommit{Message: github.String(message)})
+			}
+			event := &github.PushEvent{
+				Ref:        github.String("refs/heads/master"),
+				Before:     github.String("def"),
+				After:      github.String("abc"),
+				HeadCommit: &github.PushEventCommit{Message: github.String(test.head)},
+				Commits:    commits,
+				Repo:       &github.PushEventRepository{FullName: github.String("foo/bar"), GitURL: github.String("git://github.com/foo/bar.git"), SSHURL: github.String("git@github.com:foo/bar.git")},
+			}
+
+			hr, err := handler.HandleEvent(context.Background(), event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hr.outcome != test.outcome || hr.skipReason != test.reason {
+				t.Fatalf("Expected outcome %s with skip reason %q but got %s with %q: %s", test.outcome, test.reason, hr.outcome, hr.skipReason, hr.message)
+			}
+			if resp := hr.response("1234", nil, nil); resp.SkipReason != test.reason {
+				t.Fatalf("Expected skip reason %q in response but got %q", test.reason, resp.SkipReason)
+			}
+			if test.outcome == ResponseIgnored && len(kc.applied) != 0 {
+				t.Fatalf("Expected nothing to be applied but got %d objects", len(kc.applied))
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/google/go-github/v24/github"
+)
+
+const tagPrefix = "refs/tags/"
+
+// DefaultReleaseActions are the release actions handled by default. GitHub
+// sends prereleased or released in addition to published, so handling
+// only published handles each release once.
+var DefaultReleaseActions = []string{"published"}
+
+// ValidateReleaseActions returns an error if any of actions isn't a release
+// action which can be handled.
+func ValidateReleaseActions(actions []string) error {
+	for _, action := range actions {
+		switch action {
+		case "published", "prereleased", "released":
+		default:
+			return fmt.Errorf("Invalid release action %q", action)
+		}
+	}
+	return nil
+}
+
+// TagEvent is a synthetic event for created tags and handled release
+// actions with the tag resolved to its commit.
+type TagEvent struct {
+	// Type is create or release.
+	Type       string
+	Action     string
+	Repository *github.Repository
+	Tag        string
+	Revision   string
+}
+
+// tagEvent returns the TagEvent for a CreateEvent or ReleaseEvent. If the
+// event can't be handled, a response is returned instead.
+func (h *Handler) tagEvent(ctx context.Context, ev interface{}) (*TagEvent, *handlerResponse, error) {
+	event := &TagEvent{}
+	switch e := ev.(type) {
+	case *github.CreateEvent:
+		if e.GetRefType() != "tag" {
+			return nil, &handlerResponse{outcome: ResponseIgnored, message: "Not a tag, skipping"}, nil
+		}
+		event.Type, event.Repository, event.Tag = "create", e.GetRepo(), e.GetRef()
+	case *github.ReleaseEvent:
+		actions := h.Config.ReleaseActions
+		if len(actions) == 0 {
+			actions = DefaultReleaseActions
+		}
+		if !containsValue(actions, e.GetAction()) {
+			return nil, &handlerResponse{outcome: ResponseIgnored, message: "Release action " + e.GetAction() + " not handled, skipping"}, nil
+		}
+		event.Type, event.Action, event.Repository, event.Tag = "release", e.GetAction(), e.GetRepo(), e.GetRelease().GetTagName()
+	default:
+		return nil, &handlerResponse{status: http.StatusBadRequest, code: CodeUnsupportedEvent, message: "Invalid/unsupported event"}, ErrEventNotSupported
+	}
+	if event.Tag == "" {
+		return nil, &handlerResponse{status: http.StatusBadRequest, code: CodeInvalidPayload, message: "Event has no tag"}, ErrEventInvalid
+	}
+	if h.Refs == nil {
+		return nil, &handlerResponse{code: CodeInternal, message: "Tags not enabled"}, errors.New("No ref resolver configured")
+	}
+	// Commits are looked up by the full ref, so annotated tags are
+	// dereferenced and branches with the same name aren't matched.
+	_, revision, err := h.Refs.ResolveRef(ctx, event.Repository.GetFullName(), tagPrefix+event.Tag)
+	if err != nil {
+		if isRefNotFound(err) {
+			return nil, &handlerResponse{status: http.StatusNotFound, code: CodeRefNotFound, message: "Tag not found"}, err
+		}
+		return nil, &handlerResponse{status: http.StatusBadGateway, code: CodeResolveFailed, message: "Couldn't resolve tag"}, err
+	}
+	event.Revision = revision
+	return event, nil, nil
+}
+
+// tagAnchorName returns the name of the run anchor shared by all events of
+// a tag, so only the first of its push, creation and release is handled.
+// It's empty for other events and replays, which are anchored by delivery.
+func tagAnchorName(ctx context.Context, event *Event) string {
+	if !strings.HasPrefix(event.Ref, tagPrefix) || isReplay(ctx) {
+		return ""
+	}
+	switch event.Type {
+	case "push", "create", "release":
+	default:
+		return ""
+	}
+	sum := sha256.Sum256([]byte(event.GetFullName() + "@" + event.Ref))
+	return NamespaceName(anchorPrefix + "tag-" + hex.EncodeToString(sum[:])[:16])
+}
+
+// tagVersion returns the semantic version of a tag ref like
+// refs/tags/v1.2.3 or nil if ref isn't a tag or not a semantic version.
+func tagVersion(ref string) *semver.Version {
+	if !strings.HasPrefix(ref, tagPrefix) {
+		return nil
+	}
+	version, err := semver.StrictNewVersion(strings.TrimPrefix(strings.TrimPrefix(ref, tagPrefix), "v"))
+	if err != nil {
+		return nil
+	}
+	return version
+}
+
+// TagConstraint is a semver constraint like ">= 1.0, < 2" tags need to
+// match to be handled.
+type TagConstraint string
+
+// Validate returns an error if the constraint is invalid.
+func (c TagConstraint) Validate() error {
+	if c == "" {
+		return nil
+	}
+	if _, err := semver.NewConstraint(string(c)); err != nil {
+		return fmt.Errorf("Invalid tag constraint %q: %s", c, err)
+	}
+	return nil
+}
+
+// Allows returns false if ref is a tag which isn't a semantic version
+// matching the constraint. Other refs are always allowed.
+func (c TagConstraint) Allows(ref string) bool {
+	if c == "" || !strings.HasPrefix(ref, tagPrefix) {
+		return true
+	}
+	constraint, err := semver.NewConstraint(string(c))
+	if err != nil {
+		return false
+	}
+	version := tagVersion(ref)
+	return version != nil && constraint.Check(version)
+}
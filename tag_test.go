@@ -0,0 +1,294 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-github/v24/github"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestTagVersion(t *testing.T) {
+	for ref, want := range map[string]string{
+		"refs/tags/v1.2.3":        "1.2.3",
+		"refs/tags/1.2.3-rc.1":    "1.2.3-rc.1",
+		"refs/tags/v2.0.0+build5": "2.0.0+build5",
+		"refs/tags/v1.2":          "",
+		"refs/tags/release":       "",
+		"refs/heads/v1.2.3":       "",
+	} {
+		version := tagVersion(ref)
+		got := ""
+		if version != nil {
+			got = version.String()
+		}
+		if got != want {
+			t.Errorf("Expected version %q for %s but got %q", want, ref, got)
+		}
+	}
+}
+
+func TestTagConstraint(t *testing.T) {
+	if err := TagConstraint(">= 1.0, < 2").Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := TagConstraint("~> foo").Validate(); err == nil {
+		t.Fatal("Expected invalid constraint to be rejected")
+	}
+	for _, test := range []struct {
+		constraint TagConstraint
+		ref        string
+		allowed    bool
+	}{
+		{"", "refs/tags/release", true},
+		{">= 1.0, < 2", "refs/heads/master", true},
+		{">= 1.0, < 2", "refs/tags/v1.4.0", true},
+		{">= 1.0, < 2", "refs/tags/v2.0.0", false},
+		{">= 1.0, < 2", "refs/tags/release", false},
+		{">= 1.0", "refs/tags/v1.4.0-rc.1", false},
+		{">= 1.0-0", "refs/tags/v1.4.0-rc.1", true},
+	} {
+		if allowed := test.constraint.Allows(test.ref); allowed != test.allowed {
+			t.Errorf("Expected %q allowing %s to be %t", test.constraint, test.ref, test.allowed)
+		}
+	}
+}
+
+func TestHandleTagEvents(t *testing.T) {
+	repo := &github.Repository{
+		FullName: github.String("foo/bar"),
+		GitURL:   github.String("git://github.com/foo/bar.git"),
+		SSHURL:   github.String("git@github.com:foo/bar.git"),
+	}
+	notFound := &github.ErrorResponse{Response: &http.Response{StatusCode: http.StatusUnprocessableEntity, Request: httptest.NewRequest("GET", "http://api.github.com/", nil)}, Message: "No commit found"}
+	for _, test := range []struct {
+		name        string
+		event       interface{}
+		constraint  TagConstraint
+		actions     []string
+		resolverErr error
+		status      int
+		code        ErrorCode
+		outcome     string
+		annotations map[string]string
+	}{
+		{
+			name:    "branch created",
+			event:   &github.CreateEvent{RefType: github.String("branch"), Ref: github.String("feature"), Repo: repo},
+			outcome: ResponseIgnored,
+		},
+		{
+			name:    "tag created",
+			event:   &github.CreateEvent{RefType: github.String("tag"), Ref: github.String("v1.2.3"), Repo: repo},
+			outcome: ResponseCreated,
+			annotations: map[string]string{
+				"event_type":         "create",
+				"ref":                "refs/tags/v1.2.3",
+				"revision":           "abc",
+				"version":            "1.2.3",
+				"version_major":      "1",
+				"version_minor":      "2",
+				"version_patch":      "3",
+				"version_prerelease": "",
+			},
+		},
+		{
+			name:    "release published",
+			event:   &github.ReleaseEvent{Action: github.String("published"), Release: &github.RepositoryRelease{TagName: github.String("v2.0.0-rc.1")}, Repo: repo},
+			outcome: ResponseCreated,
+			annotations: map[string]string{
+				"event_type":         "release",
+				"event_action":       "published",
+				"ref":                "refs/tags/v2.0.0-rc.1",
+				"version_major":      "2",
+				"version_prerelease": "rc.1",
+			},
+		},
+		{
+			name:    "release prereleased",
+			event:   &github.ReleaseEvent{Action: github.String("prereleased"), Release: &github.RepositoryRelease{TagName: github.String("v2.0.0-rc.1")}, Repo: repo},
+			outcome: ResponseIgnored,
+		},
+		{
+			name:    "release prereleased enabled",
+			event:   &github.ReleaseEvent{Action: github.String("prereleased"), Release: &github.RepositoryRelease{TagName: github.String("v2.0.0-rc.1")}, Repo: repo},
+			actions: []string{"prereleased"},
+			outcome: ResponseCreated,
+			annotations: map[string]string{
+				"event_action": "prereleased",
+				"ref":          "refs/tags/v2.0.0-rc.1",
+			},
+		},
+		{
+			name:    "release published disabled",
+			event:   &github.ReleaseEvent{Action: github.String("published"), Release: &github.RepositoryRelease{TagName: github.String("v2.0.0-rc.1")}, Repo: repo},
+			actions: []string{"prereleased", "released"},
+			outcome: ResponseIgnored,
+		},
+		{
+			name:    "release edited",
+			event:   &github.ReleaseEvent{Action: github.String("edited"), Release: &github.RepositoryRelease{TagName: github.String("v1.2.3")}, Repo: repo},
+			outcome: ResponseIgnored,
+		},
+		{
+			name:       "constraint matches",
+			event:      &github.CreateEvent{RefType: github.String("tag"), Ref: github.String("v1.2.3"), Repo: repo},
+			constraint: "^1.0",
+			outcome:    ResponseCreated,
+		},
+		{
+			name:       "constraint doesn't match",
+			event:      &github.CreateEvent{RefType: github.String("tag"), Ref: github.String("v2.0.0"), Repo: repo},
+			constraint: "^1.0",
+			outcome:    ResponseIgnored,
+		},
+		{
+			name:        "tag not found",
+			event:       &github.CreateEvent{RefType: github.String("tag"), Ref: github.String("v1.2.3"), Repo: repo},
+			resolverErr: notFound,
+			status:      http.StatusNotFound,
+			code:        CodeRefNotFound,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			kc := &mockKubernetesClient{}
+			handler := NewGithubHookHandler(log.NewNopLogger(), &Config{Namespace: "ci", TagConstraint: test.constraint, ReleaseActions: test.actions}, kc, &mockLoader{}, newTestMetrics())
+			resolver := &mockResolver{err: test.resolverErr}
+			handler.Refs = resolver
+
+			hr, err := handler.HandleEvent(context.Background(), test.event)
+			if test.code != "" {
+				if err == nil || hr.code != test.code || hr.status != test.status {
+					t.Fatalf("Expected %d %s but got %v: %v", test.status, test.code, hr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hr.outcome != test.outcome {
+				t.Fatalf("Expected outcome %s but got %s: %s", test.outcome, hr.outcome, hr.message)
+			}
+			if test.outcome != ResponseCreated {
+				if len(kc.applied) != 0 {
+					t.Fatalf("Expected nothing to be applied but got %d objects", len(kc.applied))
+				}
+				return
+			}
+			annotations := kc.obj.(*unstructured.Unstructured).GetAnnotations()
+			if ref := annotations[annotationPrefix+"ref"]; resolver.ref != ref {
+				t.Fatalf("Expected %s to be resolved but got %q", ref, resolver.ref)
+			}
+			for k, v := range test.annotations {
+				if got, ok := annotations[annotationPrefix+k]; !ok || got != v {
+					t.Errorf("Expected annotation %s=%s but got %v", k, v, annotations)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleTagTemplate(t *testing.T) {
+	repo := &github.Repository{
+		FullName: github.String("foo/bar"),
+		GitURL:   github.String("git://github.com/foo/bar.git"),
+		SSHURL:   github.String("git@github.com:foo/bar.git"),
+	}
+	obj := workflow()
+	obj.Object["spec"] = map[string]interface{}{"image": "foo/bar:{{version}}", "channel": "v{{major}}.{{minor}}"}
+	kc := &mockKubernetesClient{}
+	handler := NewGithubHookHandler(log.NewNopLogger(), &Config{Namespace: "ci"}, kc, &mockLoader{obj: obj}, newTestMetrics())
+	handler.Refs = &mockResolver{}
+
+	create := &github.CreateEvent{RefType: github.String("tag"), Ref: github.String("v1.2.3"), Repo: repo}
+	if _, err := handler.HandleEvent(context.Background(), create); err != nil {
+		t.Fatal(err)
+	}
+	spec, _, _ := unstructured.NestedStringMap(kc.obj.(*unstructured.Unstructured).Object, "spec")
+	if diff := cmp.Diff(map[string]string{"image": "foo/bar:1.2.3", "channel": "v1.2"}, spec); diff != "" {
+		t.Fatalf("Unexpected spec (-want +got):\n%s", diff)
+	}
+}
+
+func TestValidateReleaseActions(t *testing.T) {
+	if err := ValidateReleaseActions([]string{"published", "prereleased", "released"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateReleaseActions([]string{"edited"}); err == nil {
+		t.Fatal("Expected invalid action to be rejected")
+	}
+}
+
+func TestHandleTagRetry(t *testing.T) {
+	repo := &github.Repository{
+		FullName: github.String("foo/bar"),
+		GitURL:   github.String("git://github.com/foo/bar.git"),
+		SSHURL:   github.String("git@github.com:foo/bar.git"),
+	}
+	create := &github.CreateEvent{RefType: github.String("tag"), Ref: github.String("v1.2.3"), Repo: repo}
+	release := &github.ReleaseEvent{Action: github.String("published"), Release: &github.RepositoryRelease{TagName: github.String("v1.2.3")}, Repo: repo}
+
+	kc := &anchoredClient{mockKubernetesClient: &mockKubernetesClient{}, err: errors.New("apply failed")}
+	handler := NewGithubHookHandler(log.NewNopLogger(), &Config{Namespace: "ci", RunAnchor: RunAnchorConfigMap}, kc, &mockLoader{}, newTestMetrics())
+	handler.Refs = &mockResolver{}
+
+	if _, err := handler.HandleEvent(WithDeliveryID(context.Background(), "1"), create); err == nil {
+		t.Fatal("Expected error")
+	}
+	if len(kc.deletedObjects) != 1 {
+		t.Fatalf("Expected tag anchor to be deleted but got %v", kc.deletedObjects)
+	}
+	// A later event of the tag isn't suppressed by the failed one.
+	kc.err = nil
+	hr, err := handler.HandleEvent(WithDeliveryID(context.Background(), "2"), release)
+	if err != nil || hr.outcome != ResponseCreated {
+		t.Fatalf("Expected release to be handled but got %v: %v", hr, err)
+	}
+}
+
+func TestHandleTagOnce(t *testing.T) {
+	repo := &github.Repository{
+		FullName: github.String("foo/bar"),
+		GitURL:   github.String("git://github.com/foo/bar.git"),
+		SSHURL:   github.String("git@github.com:foo/bar.git"),
+	}
+	push := &github.PushEvent{
+		Ref:    github.String("refs/tags/v1.2.3"),
+		Before: github.String(nullRevision),
+		After:  github.String("abc"),
+		Repo:   &github.PushEventRepository{FullName: repo.FullName, GitURL: repo.GitURL, SSHURL: repo.SSHURL},
+	}
+	release := &github.ReleaseEvent{Action: github.String("published"), Release: &github.RepositoryRelease{TagName: github.String("v1.2.3")}, Repo: repo}
+
+	kc := &anchoredClient{mockKubernetesClient: &mockKubernetesClient{}}
+	handler := NewGithubHookHandler(log.NewNopLogger(), &Config{Namespace: "ci", RunAnchor: RunAnchorConfigMap}, kc, &mockLoader{}, newTestMetrics())
+	handler.Refs = &mockResolver{}
+
+	hr, err := handler.HandleEvent(WithDeliveryID(context.Background(), "1"), push)
+	if err != nil || hr.outcome != ResponseCreated {
+		t.Fatalf("Expected push to be handled but got %v: %v", hr, err)
+	}
+	create := &github.CreateEvent{RefType: github.String("tag"), Ref: github.String("v1.2.3"), Repo: repo}
+	for i, ev := range []interface{}{create, release} {
+		hr, err = handler.HandleEvent(WithDeliveryID(context.Background(), strconv.Itoa(i+2)), ev)
+		if err != nil || hr.outcome != ResponseIgnored || hr.message != "Tag already handled, skipping" {
+			t.Fatalf("Expected %T of handled tag to be ignored but got %v: %v", ev, hr, err)
+		}
+	}
+	// anchor, manifest
+	if len(kc.applied) != 2 {
+		t.Fatalf("Expected 2 applies but got %d", len(kc.applied))
+	}
+
+	// Replays are anchored by delivery.
+	hr, err = handler.HandleEvent(withReplayOptions(WithDeliveryID(context.Background(), "4"), &ReplayOptions{}), release)
+	if err != nil || hr.outcome != ResponseCreated {
+		t.Fatalf("Expected replayed release to be handled but got %v: %v", hr, err)
+	}
+}
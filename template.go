@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"regexp"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+var placeholderRegex = regexp.MustCompile(`{{\s*([a-zA-Z0-9_.-]+)\s*}}`)
+
+// expand replaces {{name}} placeholders in s by the value of name in vars.
+// Unknown placeholders are left as they are, so templates of other tools
+// like Argo's {{inputs.parameters.foo}} are not affected.
+func expand(s string, vars map[string]string) string {
+	return placeholderRegex.ReplaceAllStringFunc(s, func(placeholder string) string {
+		name := placeholderRegex.FindStringSubmatch(placeholder)[1]
+		if value, ok := vars[name]; ok {
+			return value
+		}
+		return placeholder
+	})
+}
+
+// expandObject expands placeholders in all string values of obj.
+func expandObject(obj runtime.Object, vars map[string]string) error {
+	return eachObject(obj, func(o *unstructured.Unstructured) error {
+		o.Object = expandValue(o.Object, vars).(map[string]interface{})
+		return nil
+	})
+}
+
+func expandValue(v interface{}, vars map[string]string) interface{} {
+	switch v := v.(type) {
+	case string:
+		return expand(v, vars)
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = expandValue(value, vars)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = expandValue(value, vars)
+		}
+	}
+	return v
+}
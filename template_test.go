@@ -0,0 +1,18 @@
+package handler
+
+import "testing"
+
+func TestExpand(t *testing.T) {
+	vars := map[string]string{"repo": "foo/bar", "name": "bar", "ref": "refs/heads/master"}
+	for in, out := range map[string]string{
+		"":                                       "",
+		"system:serviceaccount:ci:repo-{{name}}": "system:serviceaccount:ci:repo-bar",
+		"{{repo}}@{{ ref }}":                     "foo/bar@refs/heads/master",
+		"{{inputs.parameters.message}}":          "{{inputs.parameters.message}}",
+		"{{name":                                 "{{name",
+	} {
+		if got := expand(in, vars); got != out {
+			t.Fatalf("Expected %q for %q but got %q", out, in, got)
+		}
+	}
+}
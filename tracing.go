@@ -0,0 +1,109 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies the handler's spans. Spans are reported to the
+// global TracerProvider, which drops them unless one is configured.
+const tracerName = "github.com/airbnb/k8s-webhook-handler"
+
+// Span attributes.
+const (
+	attrDelivery  = attribute.Key("webhook.delivery_id")
+	attrEventType = attribute.Key("webhook.event_type")
+	attrAction    = attribute.Key("webhook.action")
+	attrRepo      = attribute.Key("webhook.repo")
+	attrRef       = attribute.Key("webhook.ref")
+	attrRevision  = attribute.Key("webhook.revision")
+	attrPath      = attribute.Key("webhook.path")
+	attrNamespace = attribute.Key("k8s.namespace.name")
+	attrApplyMode = attribute.Key("webhook.apply_mode")
+	attrObjects   = attribute.Key("webhook.objects")
+)
+
+// startSpan starts a span named name as child of the span in ctx.
+func startSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, opts...)
+}
+
+// endSpan records err, if any, on span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// eventAttributes returns the attributes identifying event and its delivery.
+func eventAttributes(event *Event, delivery string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attrDelivery.String(delivery),
+		attrEventType.String(event.Type),
+		attrAction.String(event.Action),
+		attrRepo.String(event.GetFullName()),
+		attrRef.String(event.Ref),
+		attrRevision.String(event.Revision),
+	}
+}
+
+// TracingTransport returns a RoundTripper reporting a client span for each
+// request to rt and propagating it to the server by the global propagator.
+// Only requests made within a span are traced, so background requests like
+// renewing the leader Lease don't start traces of their own. It can be used
+// as rest.Config's WrapTransport.
+func TracingTransport(rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &tracingTransport{rt}
+}
+
+type tracingTransport struct {
+	rt http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !trace.SpanContextFromContext(req.Context()).IsValid() {
+		return t.rt.RoundTrip(req)
+	}
+	ctx, span := startSpan(req.Context(), "HTTP "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.HTTPClientAttributesFromHTTPRequest(req)...),
+	)
+	// RoundTrippers must not modify the request, so inject into a copy.
+	req = req.WithContext(ctx)
+	req.Header = req.Header.Clone()
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+	span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(resp.StatusCode)...)
+	span.SetStatus(semconv.SpanStatusFromHTTPStatusCodeAndSpanKind(resp.StatusCode, trace.SpanKindClient))
+	span.End()
+	return resp, nil
+}
+
+// contextTransport replaces the context of requests, which client-go's
+// dynamic client doesn't allow passing, so spans started by TracingTransport
+// become children of the span in ctx.
+type contextTransport struct {
+	ctx context.Context
+	rt  http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.rt.RoundTrip(req.WithContext(t.ctx))
+}
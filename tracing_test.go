@@ -0,0 +1,199 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/rest"
+)
+
+// withSpanRecorder installs a TracerProvider recording all spans until the
+// returned function is called.
+func withSpanRecorder() (*tracetest.SpanRecorder, func()) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return recorder, func() {
+		otel.SetTracerProvider(trace.NewNoopTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	}
+}
+
+// spanTree returns "parent > child" for each ended span, sorted.
+func spanTree(spans []sdktrace.ReadOnlySpan) []string {
+	names := map[trace.SpanID]string{}
+	for _, span := range spans {
+		names[span.SpanContext().SpanID()] = span.Name()
+	}
+	tree := []string{}
+	for _, span := range spans {
+		parent := "<root>"
+		if span.Parent().IsValid() {
+			parent = names[span.Parent().SpanID()]
+		}
+		tree = append(tree, parent+" > "+span.Name())
+	}
+	sort.Strings(tree)
+	return tree
+}
+
+func spanAttributes(span sdktrace.ReadOnlySpan) map[string]string {
+	attrs := map[string]string{}
+	for _, kv := range span.Attributes() {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	return attrs
+}
+
+func TestTracingSpans(t *testing.T) {
+	recorder, reset := withSpanRecorder()
+	defer reset()
+
+	var traceparent string
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/repos/foo/bar/contents/.ci", func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		fmt.Fprintf(w, `[{"type": "file", "name": "workflow.yaml", "download_url": "%s/raw"}]`, server.URL)
+	})
+	mux.HandleFunc("/raw", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: foo\n")
+	})
+	loader, err := NewGithubLoader("", server.URL+"/", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &kubernetesClient{RESTMapper: &fakeRESTMapper{}, Interface: fake.NewSimpleDynamicClient(runtime.NewScheme())}
+	config := &Config{Namespace: "ci", ResourcePath: ".ci/workflow.yaml", Secret: []byte("foobar")}
+	handler := NewGithubHookHandler(log.NewNopLogger(), config, client, loader, newTestMetrics())
+
+	req := newRequest("push", pushPayload, "foobar")
+	req.Header.Set("X-GitHub-Delivery", "d1")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 but got %d: %s", w.Code, w.Body)
+	}
+
+	spans := recorder.Ended()
+	if diff := cmp.Diff([]string{
+		"<root> > ServeHTTP",
+		"GithubLoader.Load > HTTP GET",
+		"HandleEvent > GithubLoader.Load",
+		"HandleEvent > kubernetesClient.Apply",
+		"ServeHTTP > HandleEvent",
+	}, spanTree(spans)); diff != "" {
+		t.Fatalf("Unexpected span tree (-want +got):\n%s", diff)
+	}
+
+	var root trace.SpanContext
+	for _, span := range spans {
+		attrs := spanAttributes(span)
+		if attrs["webhook.delivery_id"] != "d1" && span.Name() != "HTTP GET" {
+			t.Errorf("Expected delivery ID on span %s but got %v", span.Name(), attrs)
+		}
+		switch span.Name() {
+		case "ServeHTTP":
+			root = span.SpanContext()
+			if attrs["http.status_code"] != "200" {
+				t.Errorf("Expected status code on span %s but got %v", span.Name(), attrs)
+			}
+			fallthrough
+		case "HandleEvent":
+			for k, v := range map[string]string{"webhook.repo": "foo/bar", "webhook.ref": "refs/heads/feature-123", "webhook.revision": "abc"} {
+				if attrs[k] != v {
+					t.Errorf("Expected %s=%s on span %s but got %v", k, v, span.Name(), attrs)
+				}
+			}
+		case "kubernetesClient.Apply":
+			if attrs["k8s.namespace.name"] != "ci" || attrs["webhook.objects"] != "1" {
+				t.Errorf("Unexpected attributes on span %s: %v", span.Name(), attrs)
+			}
+		}
+	}
+	if want := root.TraceID().String(); traceparent == "" || traceparent[3:35] != want {
+		t.Fatalf("Expected trace %s to be propagated to GitHub but got traceparent %q", want, traceparent)
+	}
+}
+
+func TestTracingTransportWithoutSpan(t *testing.T) {
+	recorder, reset := withSpanRecorder()
+	defer reset()
+
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: TracingTransport(nil)}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if traceparent != "" || len(recorder.Ended()) != 0 {
+		t.Fatalf("Expected request outside of a span not to be traced but got traceparent %q and %d spans", traceparent, len(recorder.Ended()))
+	}
+}
+
+func TestTracingKubernetes(t *testing.T) {
+	recorder, reset := withSpanRecorder()
+	defer reset()
+
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		w.Header().Set("Content-Type", "application/json")
+		io.Copy(w, r.Body)
+	}))
+	defer server.Close()
+
+	config := &rest.Config{Host: server.URL, WrapTransport: TracingTransport}
+	client := &kubernetesClient{RESTMapper: &fakeRESTMapper{}, Interface: dynamic.NewForConfigOrDie(config), config: config}
+	ctx, span := startSpan(context.Background(), "test")
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{"apiVersion": "v1", "kind": "ConfigMap", "metadata": map[string]interface{}{"name": "cm"}}}
+	if _, err := client.Apply(ctx, obj, &ApplyOptions{Namespace: "ci"}); err != nil {
+		t.Fatal(err)
+	}
+	span.End()
+
+	if diff := cmp.Diff([]string{
+		"<root> > test",
+		"kubernetesClient.Apply > HTTP POST",
+		"test > kubernetesClient.Apply",
+	}, spanTree(recorder.Ended())); diff != "" {
+		t.Fatalf("Unexpected span tree (-want +got):\n%s", diff)
+	}
+	if want := span.SpanContext().TraceID().String(); traceparent == "" || traceparent[3:35] != want {
+		t.Fatalf("Expected trace %s to be propagated to the API server but got traceparent %q", want, traceparent)
+	}
+
+	// Cancelling the request's context, e.g. when GitHub drops the
+	// connection, doesn't abort applies.
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := client.Apply(cancelled, obj, &ApplyOptions{Namespace: "ci"}); err != nil {
+		t.Fatalf("Expected apply with cancelled context to succeed but got %s", err)
+	}
+	if want := span.SpanContext().TraceID().String(); traceparent[3:35] != want {
+		t.Fatalf("Expected trace %s to be propagated with cancelled context but got traceparent %q", want, traceparent)
+	}
+}
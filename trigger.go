@@ -0,0 +1,215 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/google/go-github/v24/github"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ManualEvent is a synthetic event to handle a repository's ref without a
+// webhook, e.g. for nightly reruns.
+type ManualEvent struct {
+	Repository *github.Repository
+	Ref        string
+	Revision   string
+	// Sender is the identity of the caller.
+	Sender string
+}
+
+// RefResolver looks up repositories and resolves refs to revisions.
+type RefResolver interface {
+	// ResolveRef returns repo and the SHA ref points to.
+	ResolveRef(ctx context.Context, repo, ref string) (*github.Repository, string, error)
+}
+
+// ResolveRef returns repo and the SHA ref points to. If ref is empty, only
+// the repository is returned.
+func (l *GithubLoader) ResolveRef(ctx context.Context, repo, ref string) (*github.Repository, string, error) {
+	parts := strings.SplitN(repo, "/", 2)
+	if len(parts) != 2 {
+		return nil, "", fmt.Errorf("Invalid repository %q", repo)
+	}
+	r, _, err := l.Client.Repositories.Get(ctx, parts[0], parts[1])
+	if err != nil {
+		return nil, "", err
+	}
+	if ref == "" {
+		return r, "", nil
+	}
+	sha, _, err := l.Client.Repositories.GetCommitSHA1(ctx, parts[0], parts[1], ref, "")
+	if err != nil {
+		return nil, "", err
+	}
+	return r, sha, nil
+}
+
+// TriggerRequest is the body of requests to the TriggerHandler.
+type TriggerRequest struct {
+	Repo string `json:"repo"`
+	// Ref is a branch name or full ref like refs/heads/master. Tags need to
+	// be passed as full ref like refs/tags/v1.0.
+	Ref string `json:"ref"`
+	// Revision, if set, is applied instead of the one ref points to.
+	Revision string `json:"revision,omitempty"`
+}
+
+// TriggerHandler handles ManualEvents for POST requests. Callers are
+// authenticated by a bearer token or a verified TLS client certificate.
+type TriggerHandler struct {
+	log.Logger
+	handler  *Handler
+	resolver RefResolver
+	// tokens maps bearer tokens to the identity of their owner.
+	tokens map[string]string
+	// clientNames, if set, restricts the allowed client certificates by
+	// their common name.
+	clientNames []string
+}
+
+// NewTriggerHandler returns a TriggerHandler resolving refs by resolver and
+// handling the events by handler. tokens maps bearer tokens to the caller's
+// identity. Clients with a verified certificate are identified by its common
+// name, which needs to be in clientNames if it's not empty.
+func NewTriggerHandler(logger log.Logger, handler *Handler, resolver RefResolver, tokens map[string]string, clientNames []string) *TriggerHandler {
+	return &TriggerHandler{Logger: logger, handler: handler, resolver: resolver, tokens: tokens, clientNames: clientNames}
+}
+
+// identity returns the authenticated caller's identity or an empty string.
+func (t *TriggerHandler) identity(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token := []byte(strings.TrimPrefix(auth, "Bearer "))
+		for known, identity := range t.tokens {
+			if subtle.ConstantTimeCompare(token, []byte(known)) == 1 {
+				return identity
+			}
+		}
+		return ""
+	}
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if name == "" {
+		return ""
+	}
+	if len(t.clientNames) == 0 {
+		return name
+	}
+	for _, allowed := range t.clientNames {
+		if name == allowed {
+			return name
+		}
+	}
+	return ""
+}
+
+func (t *TriggerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := log.With(t.Logger, "client", r.RemoteAddr)
+	delivery, err := manualDeliveryID()
+	if err != nil {
+		level.Error(logger).Log("msg", "Couldn't generate delivery ID", "err", err)
+		http.Error(w, "Couldn't generate delivery ID", http.StatusInternalServerError)
+		return
+	}
+	hr, event, err := t.trigger(logger, r, delivery)
+	if hr.status == 0 {
+		hr.status = http.StatusOK
+		if err != nil {
+			hr.status = http.StatusInternalServerError
+		}
+	}
+	if werr := hr.write(w, r, delivery, event, err); werr != nil {
+		level.Error(logger).Log("msg", "Couldn't write response", "err", werr)
+	}
+}
+
+func (t *TriggerHandler) trigger(logger log.Logger, r *http.Request, delivery string) (hr *handlerResponse, event *Event, err error) {
+	if r.Method != http.MethodPost {
+		return &handlerResponse{status: http.StatusMethodNotAllowed, code: CodeMethodNotAllowed, message: "Method not supported"}, nil, errors.New("Method not supported")
+	}
+	identity := t.identity(r)
+	if identity == "" {
+		level.Warn(logger).Log("msg", "Rejecting unauthorized trigger request")
+		return &handlerResponse{status: http.StatusUnauthorized, code: CodeUnauthorized, message: "Unauthorized"}, nil, errors.New("Unauthorized")
+	}
+	logger = log.With(logger, "sender", identity)
+
+	req := &TriggerRequest{}
+	if err = json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(req); err != nil {
+		return &handlerResponse{status: http.StatusBadRequest, code: CodeInvalidPayload, message: "Invalid request"}, nil, err
+	}
+	if req.Repo == "" || req.Ref == "" {
+		return &handlerResponse{status: http.StatusBadRequest, code: CodeInvalidParameter, message: "Invalid request"}, nil, errors.New("repo and ref are required")
+	}
+
+	ctx, span := startSpan(WithDeliveryID(r.Context(), delivery), "Trigger", trace.WithAttributes(attrDelivery.String(delivery), attrRepo.String(req.Repo)))
+	defer func() { endSpan(span, err) }()
+
+	// The normalized ref is resolved, so a bare tag name isn't resolved as
+	// tag while the event names a branch.
+	ev := &ManualEvent{Ref: normalizeRef(req.Ref), Revision: req.Revision, Sender: identity}
+	resolve := ev.Ref
+	if req.Revision != "" {
+		resolve = ""
+	}
+	ev.Repository, ev.Revision, err = t.resolver.ResolveRef(ctx, req.Repo, resolve)
+	if err != nil {
+		if isRefNotFound(err) {
+			return &handlerResponse{status: http.StatusNotFound, code: CodeRefNotFound, message: "Repository or ref not found"}, nil, err
+		}
+		return &handlerResponse{status: http.StatusBadGateway, code: CodeResolveFailed, message: "Couldn't resolve ref"}, nil, err
+	}
+	if req.Revision != "" {
+		ev.Revision = req.Revision
+	}
+
+	level.Info(logger).Log("msg", "Triggering manual event", "repo", req.Repo, "ref", ev.Ref, "revision", ev.Revision, "delivery", delivery)
+	ctx = withStageObserver(withHandledEvent(ctx, &event), t.handler.observeStage)
+	hr, err = t.handler.HandleEvent(ctx, ev)
+	if err != nil {
+		level.Error(logger).Log("msg", "Couldn't handle manual event", "err", err)
+	}
+	if hr == nil {
+		hr = &handlerResponse{}
+	}
+	return hr, event, err
+}
+
+// isRefNotFound returns true if ResolveRef failed because the repository or
+// ref doesn't exist. GitHub answers unknown refs with 422.
+func isRefNotFound(err error) bool {
+	resp, ok := err.(*github.ErrorResponse)
+	if !ok || resp.Response == nil {
+		return false
+	}
+	return resp.Response.StatusCode == http.StatusNotFound || resp.Response.StatusCode == http.StatusUnprocessableEntity
+}
+
+// normalizeRef returns names which aren't full refs as branch refs.
+func normalizeRef(ref string) string {
+	if ref == "" || strings.HasPrefix(ref, "refs/") {
+		return ref
+	}
+	return branchToRef(ref)
+}
+
+// manualDeliveryID returns a random delivery ID for manual events.
+func manualDeliveryID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "manual-" + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,153 @@
+package handler
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-github/v24/github"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+type mockResolver struct {
+	ref string
+	err error
+}
+
+func (r *mockResolver) ResolveRef(ctx context.Context, repo, ref string) (*github.Repository, string, error) {
+	r.ref = ref
+	if r.err != nil {
+		return nil, "", r.err
+	}
+	repository := &github.Repository{
+		FullName: github.String(repo),
+		GitURL:   github.String("git://github.com/" + repo + ".git"),
+		SSHURL:   github.String("git@github.com:" + repo + ".git"),
+	}
+	if ref == "" {
+		return repository, "", nil
+	}
+	return repository, "abc", nil
+}
+
+func TestTrigger(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		method      string
+		body        string
+		token       string
+		clientName  string
+		resolverErr error
+		status      int
+		code        ErrorCode
+		sender      string
+		ref         string
+		revision    string
+	}{
+		{name: "method", method: "GET", token: "secret", status: http.StatusMethodNotAllowed, code: CodeMethodNotAllowed},
+		{name: "unauthorized", body: `{"repo": "foo/bar", "ref": "master"}`, token: "wrong", status: http.StatusUnauthorized, code: CodeUnauthorized},
+		{name: "no credentials", body: `{"repo": "foo/bar", "ref": "master"}`, status: http.StatusUnauthorized, code: CodeUnauthorized},
+		{name: "invalid body", body: `{`, token: "secret", status: http.StatusBadRequest, code: CodeInvalidPayload},
+		{name: "missing ref", body: `{"repo": "foo/bar"}`, token: "secret", status: http.StatusBadRequest, code: CodeInvalidParameter},
+		{name: "token", body: `{"repo": "foo/bar", "ref": "master"}`, token: "secret", status: http.StatusOK, sender: "nightly", ref: "refs/heads/master", revision: "abc"},
+		{name: "tag", body: `{"repo": "foo/bar", "ref": "refs/tags/v1.2.3"}`, token: "secret", status: http.StatusOK, sender: "nightly", ref: "refs/tags/v1.2.3", revision: "abc"},
+		{name: "revision", body: `{"repo": "foo/bar", "ref": "refs/tags/v1", "revision": "def"}`, token: "secret", status: http.StatusOK, sender: "nightly", ref: "refs/tags/v1", revision: "def"},
+		{name: "client certificate", body: `{"repo": "foo/bar", "ref": "master"}`, clientName: "deployer", status: http.StatusOK, sender: "deployer", ref: "refs/heads/master", revision: "abc"},
+		{name: "unknown client certificate", body: `{"repo": "foo/bar", "ref": "master"}`, clientName: "other", status: http.StatusUnauthorized, code: CodeUnauthorized},
+		{
+			name:        "ref not found",
+			body:        `{"repo": "foo/bar", "ref": "missing"}`,
+			token:       "secret",
+			resolverErr: &github.ErrorResponse{Response: &http.Response{StatusCode: http.StatusUnprocessableEntity, Request: httptest.NewRequest("GET", "http://api.github.com/", nil)}, Message: "No commit found for SHA: missing"},
+			status:      http.StatusNotFound,
+			code:        CodeRefNotFound,
+		},
+		{
+			name:        "resolve failed",
+			body:        `{"repo": "foo/bar", "ref": "master"}`,
+			token:       "secret",
+			resolverErr: &github.ErrorResponse{Response: &http.Response{StatusCode: http.StatusInternalServerError, Request: httptest.NewRequest("GET", "http://api.github.com/", nil)}, Message: "Server Error"},
+			status:      http.StatusBadGateway,
+			code:        CodeResolveFailed,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			kc := &mockKubernetesClient{}
+			handler := NewGithubHookHandler(log.NewNopLogger(), &Config{Namespace: "ci"}, kc, &mockLoader{}, newTestMetrics())
+			resolver := &mockResolver{err: test.resolverErr}
+			trigger := NewTriggerHandler(log.NewNopLogger(), handler, resolver, map[string]string{"secret": "nightly"}, []string{"deployer"})
+
+			method := test.method
+			if method == "" {
+				method = "POST"
+			}
+			req := httptest.NewRequest(method, "http://example.com/trigger", strings.NewReader(test.body))
+			if test.token != "" {
+				req.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			if test.clientName != "" {
+				cert := &x509.Certificate{Subject: pkix.Name{CommonName: test.clientName}}
+				req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+			}
+			w := httptest.NewRecorder()
+			trigger.ServeHTTP(w, req)
+			if w.Code != test.status {
+				t.Fatalf("Expected status %d but got %d: %s", test.status, w.Code, w.Body.String())
+			}
+			resp := &Response{}
+			if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(resp.DeliveryID, "manual-") {
+				t.Fatalf("Expected manual delivery ID but got %s", resp.DeliveryID)
+			}
+			if test.code != "" {
+				if resp.Error == nil || resp.Error.Code != test.code {
+					t.Fatalf("Expected error code %s but got %s", test.code, w.Body.String())
+				}
+				if len(kc.applied) != 0 {
+					t.Fatalf("Expected nothing to be applied but got %d objects", len(kc.applied))
+				}
+				return
+			}
+			if len(kc.applied) != 1 {
+				t.Fatalf("Expected 1 apply but got %d", len(kc.applied))
+			}
+			if resp.Event == nil || resp.Event.Type != "manual" || resp.Event.Ref != test.ref || resp.Event.Revision != test.revision {
+				t.Fatalf("Unexpected event in response %s", w.Body.String())
+			}
+			annotations := kc.obj.(*unstructured.Unstructured).GetAnnotations()
+			for k, v := range map[string]string{"event_type": "manual", "sender": test.sender, "ref": test.ref, "revision": test.revision} {
+				if annotations[annotationPrefix+k] != v {
+					t.Errorf("Expected annotation %s=%s but got %v", k, v, annotations)
+				}
+			}
+			if test.revision == "def" && resolver.ref != "" {
+				t.Errorf("Expected ref not to be resolved for explicit revision but got %s", resolver.ref)
+			}
+			if test.revision == "abc" && resolver.ref != test.ref {
+				t.Errorf("Expected %s to be resolved but got %s", test.ref, resolver.ref)
+			}
+		})
+	}
+}
+
+func TestNormalizeRef(t *testing.T) {
+	for ref, want := range map[string]string{
+		"master":          "refs/heads/master",
+		"feature/foo":     "refs/heads/feature/foo",
+		"refs/tags/v1.0":  "refs/tags/v1.0",
+		"refs/heads/main": "refs/heads/main",
+	} {
+		if got := normalizeRef(ref); got != want {
+			t.Errorf("Expected %s to be normalized to %s but got %s", ref, want, got)
+		}
+	}
+}